@@ -0,0 +1,204 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"deviceproxy/model"
+)
+
+const (
+	logPrefix = "DeviceProxyAdmin "
+
+	connectionsPath = "/connections"
+	devicesPath     = "/devices/"
+
+	maxMessageSize = 1 << 20
+)
+
+// ConnectionManager gives admin API access to live connections of the proxy.
+// Device tags of tenants are scoped with model.ScopeDeviceTag.
+type ConnectionManager interface {
+	Connections() []model.ConnectionInfo
+	Disconnect(connectionID string) bool
+	DisconnectDevice(deviceTag string) int
+	SendMsg(msg, deviceTag string) error
+}
+
+// Admin serves HTTP API to inspect and manage live connections.
+//
+//	GET    /connections[?deviceTag=tag&tenant=tenant]   lists connections
+//	DELETE /connections/{connectionID}                  disconnects single connection
+//	DELETE /devices/{deviceTag}/connections[?tenant=]   disconnects all connections of the device
+//	POST   /devices/{deviceTag}/messages[?tenant=]      sends request body to the device
+type Admin struct {
+	manager    ConnectionManager
+	token      string
+	httpServer *http.Server
+}
+
+// NewAdmin creates admin API, requests have to carry "Authorization: Bearer <token>" header when token is not empty
+func NewAdmin(manager ConnectionManager, token string) *Admin {
+	return &Admin{
+		manager: manager,
+		token:   token,
+	}
+}
+
+// Serve ...
+func (a *Admin) Serve(port string) error {
+	a.httpServer = &http.Server{Addr: ":" + port, Handler: a.Handler()}
+
+	log.Printf(logPrefix+"Starting admin API on port %v\n", port)
+
+	return a.httpServer.ListenAndServe()
+}
+
+// Shutdown ...
+func (a *Admin) Shutdown() error {
+	if a.httpServer == nil {
+		return nil
+	}
+
+	return a.httpServer.Shutdown(context.Background())
+}
+
+// Handler ...
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(connectionsPath, a.handleConnections)
+	mux.HandleFunc(connectionsPath+"/", a.handleConnection)
+	mux.HandleFunc(devicesPath, a.handleDevice)
+
+	return a.authenticated(mux)
+}
+
+func (a *Admin) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if a.token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+			writeResponseMsg(wr, http.StatusUnauthorized, model.CodeUnauthorized, "Missing or invalid admin token")
+			return
+		}
+
+		next.ServeHTTP(wr, req)
+	})
+}
+
+func (a *Admin) handleConnections(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeResponseMsg(wr, http.StatusMethodNotAllowed, model.CodeError, "Method not allowed")
+		return
+	}
+
+	connections := a.manager.Connections()
+	query := req.URL.Query()
+
+	if deviceTag, tenant := query.Get("deviceTag"), query.Get("tenant"); deviceTag != "" || tenant != "" {
+		filtered := []model.ConnectionInfo{}
+
+		for _, connection := range connections {
+			if (deviceTag == "" || connection.DeviceTag == deviceTag) && (tenant == "" || connection.Tenant == tenant) {
+				filtered = append(filtered, connection)
+			}
+		}
+
+		connections = filtered
+	}
+
+	writeJSON(wr, http.StatusOK, connections)
+}
+
+func (a *Admin) handleConnection(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		writeResponseMsg(wr, http.StatusMethodNotAllowed, model.CodeError, "Method not allowed")
+		return
+	}
+
+	connectionID, ok := pathParam(req, connectionsPath+"/", "")
+	if !ok {
+		writeResponseMsg(wr, http.StatusNotFound, model.CodeError, "Not found")
+		return
+	}
+
+	if !a.manager.Disconnect(connectionID) {
+		writeResponseMsg(wr, http.StatusNotFound, model.CodeError, "Connection "+connectionID+" does not exist")
+		return
+	}
+
+	log.Printf(logPrefix+"Connection %v disconnected by admin\n", connectionID)
+	writeResponseMsg(wr, http.StatusOK, model.CodeSuccess, "Connection disconnected")
+}
+
+// handleDevice serves device endpoints, devices of tenants are selected with tenant query param
+func (a *Admin) handleDevice(wr http.ResponseWriter, req *http.Request) {
+	tenant := req.URL.Query().Get("tenant")
+
+	if deviceTag, ok := pathParam(req, devicesPath, "/connections"); ok && req.Method == http.MethodDelete {
+		disconnected := a.manager.DisconnectDevice(model.ScopeDeviceTag(tenant, deviceTag))
+		log.Printf(logPrefix+"%v connections of device %v disconnected by admin\n", disconnected, model.ScopeDeviceTag(tenant, deviceTag))
+		writeJSON(wr, http.StatusOK, map[string]int{"disconnected": disconnected})
+		return
+	}
+
+	if deviceTag, ok := pathParam(req, devicesPath, "/messages"); ok && req.Method == http.MethodPost {
+		a.sendMessage(wr, req, model.ScopeDeviceTag(tenant, deviceTag))
+		return
+	}
+
+	writeResponseMsg(wr, http.StatusNotFound, model.CodeError, "Not found")
+}
+
+func (a *Admin) sendMessage(wr http.ResponseWriter, req *http.Request, deviceTag string) {
+	msg, err := ioutil.ReadAll(http.MaxBytesReader(wr, req.Body, maxMessageSize))
+	if err != nil {
+		writeResponseMsg(wr, http.StatusBadRequest, model.CodeError, "Can not read message: "+err.Error())
+		return
+	}
+
+	if err = a.manager.SendMsg(string(msg), deviceTag); err != nil {
+		writeResponseMsg(wr, http.StatusNotFound, model.CodeError, err.Error())
+		return
+	}
+
+	writeResponseMsg(wr, http.StatusAccepted, model.CodeSuccess, "Message sent to device")
+}
+
+// pathParam extracts escaped path segment between prefix and suffix
+func pathParam(req *http.Request, prefix, suffix string) (string, bool) {
+	path := req.URL.EscapedPath()
+
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+
+	param := strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix)
+	if param == "" || strings.Contains(param, "/") {
+		return "", false
+	}
+
+	unescaped, err := url.PathUnescape(param)
+
+	return unescaped, err == nil
+}
+
+func writeResponseMsg(wr http.ResponseWriter, status, code int, msg string) {
+	writeJSON(wr, status, model.ResponseMsg{
+		Code:    code,
+		Message: msg,
+	})
+}
+
+func writeJSON(wr http.ResponseWriter, status int, v interface{}) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+
+	if err := json.NewEncoder(wr).Encode(v); err != nil {
+		log.Printf(logPrefix+"Can not write response err:%v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/admin"
+	"deviceproxy/mocks_test"
+	"deviceproxy/model"
+)
+
+type AdminTestSuite struct {
+	suite.Suite
+
+	managerMock *mocks_test.ConnectionManager
+	handler     http.Handler
+}
+
+func TestExecuteAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(AdminTestSuite))
+}
+
+func (suite *AdminTestSuite) SetupTest() {
+	suite.managerMock = &mocks_test.ConnectionManager{}
+	suite.handler = admin.NewAdmin(suite.managerMock, "secret").Handler()
+}
+
+func (suite *AdminTestSuite) TearDownTest() {
+	suite.managerMock.AssertExpectations(suite.T())
+}
+
+func (suite *AdminTestSuite) Test_RequestWithoutTokenIsRejected() {
+	response := suite.do(http.MethodGet, "/connections", "", "")
+
+	suite.Equal(http.StatusUnauthorized, response.Code)
+	suite.Equal(model.CodeUnauthorized, responseMsg(response).Code)
+}
+
+func (suite *AdminTestSuite) Test_ConnectionsAreListedAndFilteredByDeviceTag() {
+	connections := []model.ConnectionInfo{
+		{ConnectionID: "c0", DeviceTag: "device0", RemoteAddr: "10.0.0.1:1234", ConnectedAt: time.Now().UTC(), MessagesIn: 3},
+		{ConnectionID: "c1", DeviceTag: "device1", RemoteAddr: "10.0.0.2:1234", ConnectedAt: time.Now().UTC()},
+	}
+	suite.managerMock.On("Connections").Return(connections)
+
+	response := suite.do(http.MethodGet, "/connections?deviceTag=device0", "secret", "")
+	suite.Equal(http.StatusOK, response.Code)
+
+	var listed []model.ConnectionInfo
+	suite.Nil(json.Unmarshal(response.Body.Bytes(), &listed))
+	suite.Len(listed, 1)
+	suite.Equal("c0", listed[0].ConnectionID)
+	suite.Equal(uint64(3), listed[0].MessagesIn)
+}
+
+func (suite *AdminTestSuite) Test_ConnectionIsDisconnected() {
+	suite.managerMock.On("Disconnect", "c0").Return(true)
+	suite.managerMock.On("Disconnect", "unknown").Return(false)
+
+	suite.Equal(http.StatusOK, suite.do(http.MethodDelete, "/connections/c0", "secret", "").Code)
+	suite.Equal(http.StatusNotFound, suite.do(http.MethodDelete, "/connections/unknown", "secret", "").Code)
+}
+
+func (suite *AdminTestSuite) Test_AllConnectionsOfDeviceAreDisconnected() {
+	suite.managerMock.On("DisconnectDevice", "device/0").Return(2)
+
+	response := suite.do(http.MethodDelete, "/devices/device%2F0/connections", "secret", "")
+	suite.Equal(http.StatusOK, response.Code)
+	suite.JSONEq(`{"disconnected":2}`, response.Body.String())
+}
+
+func (suite *AdminTestSuite) Test_TestMessageIsSentToDevice() {
+	suite.managerMock.On("SendMsg", "hello", "device0").Return(nil)
+	suite.managerMock.On("SendMsg", "hello", "offline").Return(errors.New("no connection"))
+
+	suite.Equal(http.StatusAccepted, suite.do(http.MethodPost, "/devices/device0/messages", "secret", "hello").Code)
+	suite.Equal(http.StatusNotFound, suite.do(http.MethodPost, "/devices/offline/messages", "secret", "hello").Code)
+}
+
+func (suite *AdminTestSuite) Test_DevicesOfTenantAreSelectedWithTenantParam() {
+	suite.managerMock.On("DisconnectDevice", "acme/device0").Return(1)
+	suite.managerMock.On("SendMsg", "hello", "acme/device0").Return(nil)
+
+	suite.Equal(http.StatusOK, suite.do(http.MethodDelete, "/devices/device0/connections?tenant=acme", "secret", "").Code)
+	suite.Equal(http.StatusAccepted, suite.do(http.MethodPost, "/devices/device0/messages?tenant=acme", "secret", "hello").Code)
+}
+
+func (suite *AdminTestSuite) do(method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response := httptest.NewRecorder()
+	suite.handler.ServeHTTP(response, req)
+
+	return response
+}
+
+func responseMsg(response *httptest.ResponseRecorder) model.ResponseMsg {
+	var msg model.ResponseMsg
+	json.Unmarshal(response.Body.Bytes(), &msg)
+	return msg
+}
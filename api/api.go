@@ -1,55 +1,148 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
+	"net/http"
 	"sync"
+	"time"
 
-	queuewrapper "git.krk.awesome-ind.com/GoUtils/QueueWrapper"
-
+	"deviceproxy/mailbox"
+	"deviceproxy/metrics"
+	"deviceproxy/model"
 	"deviceproxy/resources"
+	"deviceproxy/topics"
 )
 
 const (
 	logPrefix = "DeviceProxyAPI "
+
+	// mailboxReplayBatch is how many stored messages are read from the mailbox at once during replay
+	mailboxReplayBatch = 32
+	// mailboxReplayTimeout is how long replay waits for room in outbound queue of the device
+	mailboxReplayTimeout = 10 * time.Second
 )
 
 //NOTE: access to data of this structure has to be synchronized
 // API ...
 type API struct {
-	msgSender          MessageSender
-	sessionsPerClients map[string][]string
-	clientsPerTopics   map[string]int
-	msgQueue           queuewrapper.IMsgQueue
-	connectionMutex    sync.RWMutex
-	messageMutex       sync.RWMutex
+	// Mailbox stores messages for devices without connection, when nil such messages are lost
+	Mailbox mailbox.Store
+	// MailboxTTL is how long subscription of the device is kept after its last client disconnected
+	MailboxTTL time.Duration
+	// DeliveryAcks makes devices acknowledge every message, unacknowledged messages are redelivered by the queue
+	DeliveryAcks bool
+	// AckTimeout is how long to wait for ack from device
+	AckTimeout time.Duration
+	// RawPayloads publishes device messages as they are instead of wrapping them in model.Envelope
+	RawPayloads bool
+	// RPCEnabled subscribes to RPC request topics of connected devices
+	RPCEnabled bool
+	// RPCTimeout is how long to wait for device response when request does not specify its own timeout
+	RPCTimeout time.Duration
+	// RPCReplyPrefix is prefix reply-to topics of RPC requests have to start with, empty allows any topic not owned by the proxy
+	RPCReplyPrefix string
+	// EnvelopeHeaders lists upgrade request headers put to Envelope of every message of the connection
+	EnvelopeHeaders []string
+	// PresenceTopic is where online/offline events of devices are published, empty disables them
+	PresenceTopic string
+	// Metrics counts failed publishes when set
+	Metrics *metrics.Metrics
+
+	logDebugEnabled        bool
+	topics                 *topics.Set
+	tenant                 string
+	multiTenant            bool
+	instanceID             string
+	clusterTopic           string
+	registry               *deviceRegistry //NOTE: nil when cluster is not enabled
+	announceInterval       time.Duration
+	stopAnnouncing         chan struct{}
+	msgSender              MessageSender
+	sessionsPerClients     map[string][]string
+	clientsPerTopics       map[string]int
+	remoteAddrs            map[string]string
+	connectionHeaders      map[string]map[string]string
+	lingeringSubscriptions map[string]*time.Timer
+	replays                map[string]bool //NOTE: device tags with mailbox replay, true once it started; guarded by connectionMutex
+	pendingAcks            map[string]chan model.DeliveryAck
+	pendingRPCs            map[string]*pendingRPC
+	msgQueue               Broker
+	connectionMutex        sync.RWMutex
+	messageMutex           sync.RWMutex
+	ackMutex               sync.Mutex
+	rpcMutex               sync.Mutex
 }
 
 // NewAPI ...
-func NewAPI(msgSender MessageSender, msgQueue queuewrapper.IMsgQueue) *API {
+func NewAPI(msgSender MessageSender, msgQueue Broker, config *resources.Config) *API {
+	topicSet, err := config.Topics.Set()
+	if err != nil {
+		log.Printf(logPrefix+"%v, falling back to default topics\n", err)
+		topicSet = topics.DefaultSet()
+	}
+
+	var registry *deviceRegistry
+	if config.Cluster.Enabled {
+		registry = newDeviceRegistry(config.Cluster.RegistryTTL)
+	}
+
 	return &API{
-		msgSender:          msgSender,
-		clientsPerTopics:   map[string]int{},
-		connectionMutex:    sync.RWMutex{},
-		messageMutex:       sync.RWMutex{},
-		msgQueue:           msgQueue,
-		sessionsPerClients: make(map[string][]string),
+		MailboxTTL:             config.Mailbox.TTL,
+		DeliveryAcks:           config.Delivery.Acks,
+		AckTimeout:             config.Delivery.AckTimeout,
+		RawPayloads:            config.Delivery.RawPayloads,
+		RPCEnabled:             config.Delivery.RPCEnabled,
+		RPCTimeout:             config.Delivery.RPCTimeout,
+		RPCReplyPrefix:         config.Delivery.RPCReplyPrefix,
+		EnvelopeHeaders:        config.Delivery.EnvelopeHeaders,
+		PresenceTopic:          config.Delivery.PresenceTopic,
+		logDebugEnabled:        config.Service.LogDebug,
+		topics:                 topicSet,
+		tenant:                 config.Topics.Tenant,
+		multiTenant:            config.Tenancy.Enabled(),
+		instanceID:             config.Cluster.InstanceID,
+		clusterTopic:           config.Cluster.Topic,
+		registry:               registry,
+		announceInterval:       config.Cluster.AnnounceInterval,
+		msgSender:              msgSender,
+		clientsPerTopics:       map[string]int{},
+		remoteAddrs:            map[string]string{},
+		connectionHeaders:      map[string]map[string]string{},
+		lingeringSubscriptions: map[string]*time.Timer{},
+		replays:                map[string]bool{},
+		pendingAcks:            map[string]chan model.DeliveryAck{},
+		pendingRPCs:            map[string]*pendingRPC{},
+		connectionMutex:        sync.RWMutex{},
+		messageMutex:           sync.RWMutex{},
+		msgQueue:               msgQueue,
+		sessionsPerClients:     make(map[string][]string),
 	}
 }
 
 // OnConnectionEstabilishedFromClient ...
-func (api *API) OnConnectionEstabilishedFromClient(connectionID string, deviceTag *string) error {
+func (api *API) OnConnectionEstabilishedFromClient(connectionID string, deviceTag *string, remoteAddr string) error {
 	api.connectionMutex.Lock()
 	defer api.connectionMutex.Unlock()
 
-	eventQueueTopic := getEventQueueTopic(deviceTag)
+	eventQueueTopic := api.getEventQueueTopic(deviceTag)
 
 	clientsPerTopics, msgQueueExist := api.clientsPerTopics[eventQueueTopic]
 
 	if msgQueueExist {
 		api.clientsPerTopics[eventQueueTopic] = clientsPerTopics + 1
 		log.Printf(logPrefix+"OnConnectionEstabilishedFromClient: %v connected clients for topic:%v\n", api.clientsPerTopics[eventQueueTopic], eventQueueTopic)
+
+		api.remoteAddrs[connectionID] = remoteAddr
+		api.publishPresence(model.PresenceOnline, connectionID, *deviceTag, "", clientsPerTopics+1)
+
+		if clientsPerTopics == 0 {
+			api.stopLingering(eventQueueTopic)
+			api.publishRegistryEvent(model.RegistryOnline, *deviceTag)
+			api.awaitReplay(*deviceTag)
+		}
+
 		return nil
 	}
 
@@ -60,39 +153,144 @@ func (api *API) OnConnectionEstabilishedFromClient(connectionID string, deviceTa
 		return err
 	}
 
+	if api.RPCEnabled {
+		rpcQueueTopic := api.getRPCQueueTopic(deviceTag)
+
+		if err = api.msgQueue.AddSubscription(rpcQueueTopic, api, false); err != nil {
+			log.Printf(logPrefix+"Error while subscribing to topic %v: %v\n", rpcQueueTopic, err)
+			api.msgQueue.RemoveSubscription(eventQueueTopic)
+			return err
+		}
+	}
+
 	api.clientsPerTopics[eventQueueTopic] = 1
 
+	api.remoteAddrs[connectionID] = remoteAddr
+	api.publishPresence(model.PresenceOnline, connectionID, *deviceTag, "", 1)
+	api.publishRegistryEvent(model.RegistryOnline, *deviceTag)
+
+	api.awaitReplay(*deviceTag)
+
 	return nil
 }
 
+// OnConnectionHeaders keeps values of EnvelopeHeaders the upgrade request carries, they are put to Envelope
+// of every message of the connection
+func (api *API) OnConnectionHeaders(connectionID string, headers http.Header) {
+	selected := map[string]string{}
+	for _, name := range api.EnvelopeHeaders {
+		if value := headers.Get(name); value != "" {
+			selected[name] = value
+		}
+	}
+
+	if len(selected) == 0 {
+		return
+	}
+
+	api.connectionMutex.Lock()
+	defer api.connectionMutex.Unlock()
+
+	api.connectionHeaders[connectionID] = selected
+}
+
+// OnConnectionReady replays mailbox of the device once the client has received the handshake response
+func (api *API) OnConnectionReady(connectionID string, deviceTag *string) {
+	api.connectionMutex.Lock()
+	defer api.connectionMutex.Unlock()
+
+	if started, ok := api.replays[*deviceTag]; !ok || started {
+		return
+	}
+
+	if messages, err := api.Mailbox.Peek(*deviceTag, 1); err == nil && len(messages) == 0 {
+		delete(api.replays, *deviceTag)
+		return
+	}
+
+	api.replays[*deviceTag] = true
+
+	go api.replayMailbox(*deviceTag)
+}
+
 // OnMessageReceivedFromClient ...
 func (api *API) OnMessageReceivedFromClient(connectionID string, msg *string, deviceTag *string) error {
 	api.messageMutex.Lock()
 	defer api.messageMutex.Unlock()
 
-	publishQueueTopic := getPublishQueueTopic(deviceTag)
-	eventQueueTopic := getEventQueueTopic(deviceTag)
+	publishQueueTopic := api.getPublishQueueTopic(deviceTag)
+	eventQueueTopic := api.getEventQueueTopic(deviceTag)
 
 	if !api.queueExists(eventQueueTopic) {
 		return fmt.Errorf(logPrefix + "OnMessageReceivedFromClient: Trying to send message to queue to the topic of the device but service is not registered to listen to it")
 	}
 
-	logDebug(fmt.Sprintf("Publishing message %v to queue topic: %v \n", publishQueueTopic, *msg))
-	err := api.msgQueue.PublishMessage(publishQueueTopic, *msg)
+	if api.handleDeviceFrame(*msg, *deviceTag) {
+		return nil
+	}
+
+	queueMsg, err := api.queueMessage(connectionID, *msg, *deviceTag)
+	if err != nil {
+		return fmt.Errorf(logPrefix+"OnMessageReceivedFromClient: Error preparing client message for queue: %v\n", err)
+	}
+
+	return api.publishFromClient(publishQueueTopic, queueMsg)
+}
+
+// OnBinaryMessageReceivedFromClient publishes binary frame of the device, it can not be a control frame
+func (api *API) OnBinaryMessageReceivedFromClient(connectionID string, msg []byte, deviceTag *string) error {
+	api.messageMutex.Lock()
+	defer api.messageMutex.Unlock()
+
+	publishQueueTopic := api.getPublishQueueTopic(deviceTag)
+	eventQueueTopic := api.getEventQueueTopic(deviceTag)
+
+	if !api.queueExists(eventQueueTopic) {
+		return fmt.Errorf(logPrefix + "OnBinaryMessageReceivedFromClient: Trying to send message to queue to the topic of the device but service is not registered to listen to it")
+	}
+
+	queueMsg, err := api.queueBinaryMessage(connectionID, msg, *deviceTag)
+	if err != nil {
+		return fmt.Errorf(logPrefix+"OnBinaryMessageReceivedFromClient: Error preparing client message for queue: %v\n", err)
+	}
+
+	return api.publishFromClient(publishQueueTopic, queueMsg)
+}
+
+// NOTE: has to be called with messageMutex locked
+func (api *API) publishFromClient(publishQueueTopic, queueMsg string) error {
+	api.logDebug(fmt.Sprintf("Publishing message %v to queue topic: %v \n", publishQueueTopic, queueMsg))
+	err := api.msgQueue.PublishMessage(publishQueueTopic, queueMsg)
+
+	if err == ErrBrokerUnavailable {
+		api.Metrics.PublishFailed()
+		return model.ResponseMsg{Code: model.CodeQueueUnavailable, Message: "Platform is temporarily unavailable, retry later"}
+	}
 
 	if err != nil {
+		api.Metrics.PublishFailed()
 		return fmt.Errorf(logPrefix+"OnMessageReceivedFromClient: Error publishing client message to queue: %v\n", err)
 	}
 
 	return nil
 }
 
+// SubscriptionCount returns number of device topics the API is subscribed to, including lingering ones
+func (api *API) SubscriptionCount() int {
+	api.connectionMutex.RLock()
+	defer api.connectionMutex.RUnlock()
+
+	return len(api.clientsPerTopics)
+}
+
 // OnClientDisconnected ...
-func (api *API) OnClientDisconnected(connectionID string, deviceTag *string) error {
+func (api *API) OnClientDisconnected(connectionID string, deviceTag *string, reason string) error {
 	api.connectionMutex.Lock()
 	defer api.connectionMutex.Unlock()
 
-	eventQueueTopic := getEventQueueTopic(deviceTag)
+	log.Printf(logPrefix+"OnClientDisconnected: connection %v of device %v closed, reason: %v\n", connectionID, *deviceTag, reason)
+
+	eventQueueTopic := api.getEventQueueTopic(deviceTag)
 	clientsPerTopics, msgQueueExist := api.clientsPerTopics[eventQueueTopic]
 
 	_, ok := api.sessionsPerClients[connectionID]
@@ -101,6 +299,9 @@ func (api *API) OnClientDisconnected(connectionID string, deviceTag *string) err
 		delete(api.sessionsPerClients, connectionID)
 	}
 
+	defer delete(api.remoteAddrs, connectionID)
+	defer delete(api.connectionHeaders, connectionID)
+
 	if !msgQueueExist {
 		log.Printf(logPrefix+"OnClientDisconnected: Could not find queue with topic %v\n", eventQueueTopic)
 		return nil
@@ -109,10 +310,35 @@ func (api *API) OnClientDisconnected(connectionID string, deviceTag *string) err
 	api.clientsPerTopics[eventQueueTopic] = clientsPerTopics - 1
 
 	if api.clientsPerTopics[eventQueueTopic] > 0 {
+		api.publishPresence(model.PresenceOnline, connectionID, *deviceTag, reason, api.clientsPerTopics[eventQueueTopic])
 		log.Printf(logPrefix+"OnClientDisconnected: %v connected clients left for topic:%v\n", api.clientsPerTopics[eventQueueTopic], eventQueueTopic)
 		return nil
 	}
 
+	api.publishPresence(model.PresenceOffline, connectionID, *deviceTag, reason, 0)
+	api.publishRegistryEvent(model.RegistryOffline, *deviceTag)
+
+	if api.Mailbox != nil && api.MailboxTTL > 0 {
+		api.startLingering(eventQueueTopic)
+		log.Printf(logPrefix+"OnClientDisconnected: Keeping subscription for topic:%v for %v to store messages in mailbox\n", eventQueueTopic, api.MailboxTTL)
+		return nil
+	}
+
+	return api.removeSubscription(eventQueueTopic)
+}
+
+// NOTE: has to be called with connectionMutex locked
+func (api *API) removeSubscription(eventQueueTopic string) error {
+	if api.RPCEnabled {
+		deviceTag, err := api.getDeviceTagFromTopic(eventQueueTopic)
+
+		if err != nil {
+			log.Printf(logPrefix+"OnClientDisconnected: Could not find RPC topic for topic:%v Error:%v\n", eventQueueTopic, err)
+		} else if err = api.msgQueue.RemoveSubscription(api.getRPCQueueTopic(&deviceTag)); err != nil {
+			log.Printf(logPrefix+"OnClientDisconnected: Could not remove subscription for RPC topic of device:%v Error:%v\n", deviceTag, err)
+		}
+	}
+
 	err := api.msgQueue.RemoveSubscription(eventQueueTopic)
 
 	if err != nil {
@@ -127,25 +353,264 @@ func (api *API) OnClientDisconnected(connectionID string, deviceTag *string) err
 	return nil
 }
 
-// OnServerStopped ...
+// OnServerStopped removes subscriptions of all devices, including lingering ones, and shuts the queue down
 func (api *API) OnServerStopped() {
+	api.connectionMutex.Lock()
+
+	for eventQueueTopic := range api.clientsPerTopics {
+		api.stopLingering(eventQueueTopic)
+		api.removeSubscription(eventQueueTopic)
+	}
+
+	api.connectionMutex.Unlock()
+
+	api.leaveCluster()
 	api.msgQueue.ShutDown()
 	log.Printf(logPrefix + "OnServerStopped: API closed all queues\n")
 }
 
 // ParseMsg ...
 func (api *API) ParseMsg(topic, msg string) error {
+	if handled, err := api.handleClusterMsg(topic, msg); handled {
+		return err
+	}
+
+	if rpcDeviceTag, err := api.getDeviceTagFromRPCTopic(topic); err == nil {
+		return api.handleRPCRequest(msg, rpcDeviceTag)
+	}
+
+	if forwarded, err := api.forwardIfRemote(topic, msg); forwarded {
+		return err
+	}
+
 	if !api.queueExists(topic) {
 		log.Printf(logPrefix + "Error: Wrong state of the service. Unscubscribing from topic should have happened\n")
 		return nil // we don't want to return err to queue because it'll retry to deliver the message
 	}
 
-	logDebug(fmt.Sprintf("Received msg: %v for topic: %v \n", msg, topic))
+	api.logDebug(fmt.Sprintf("Received msg: %v for topic: %v \n", msg, topic))
+
+	deviceTag, err := api.getDeviceTagFromTopic(topic)
+	if err != nil {
+		log.Printf(logPrefix+"Error: %v\n", err)
+		return nil // message can not be routed so there is no point in redelivering it
+	}
+
+	return api.deliver(topic, deviceTag, msg)
+}
+
+// deliver sends message to device connected to this instance, message of offline device is put to the mailbox
+func (api *API) deliver(topic, deviceTag, msg string) error {
+	stored, err := api.storeIfOffline(topic, deviceTag, msg)
+	if stored || err != nil {
+		return err
+	}
+
+	if api.DeliveryAcks && !isBinary(msg) {
+		return api.deliverWithAck(msg, deviceTag)
+	}
+
+	err = api.send(msg, deviceTag)
+	if err != nil {
+		return api.storeUndelivered(msg, deviceTag, err)
+	}
+
+	return nil
+}
+
+// send delivers message flagged as binary by model.BinaryMsg as binary frame when the sender supports it
+func (api *API) send(msg, deviceTag string) error {
+	if binary, ok := binaryPayload(msg); ok {
+		if sender, ok := api.msgSender.(BinaryMessageSender); ok {
+			return sender.SendBinaryMsg(binary, deviceTag)
+		}
+	}
 
-	deviceTag := getDeviceTagFromTopic(topic)
 	return api.msgSender.SendMsg(msg, deviceTag)
 }
 
+// handleDeviceFrame consumes control frames sent by device, it returns false for regular messages
+func (api *API) handleDeviceFrame(msg, deviceTag string) bool {
+	if !api.DeliveryAcks && !api.RPCEnabled {
+		return false
+	}
+
+	frame := model.DeviceFrame{}
+	if err := json.Unmarshal([]byte(msg), &frame); err != nil {
+		return false
+	}
+
+	if api.DeliveryAcks && frame.Ack != nil && frame.Ack.ID != "" {
+		api.handleAck(*frame.Ack, deviceTag)
+		return true
+	}
+
+	if api.RPCEnabled && frame.RPCResponse != nil && frame.RPCResponse.CorrelationID != "" {
+		api.handleRPCResponse(*frame.RPCResponse, deviceTag)
+		return true
+	}
+
+	return false
+}
+
+// storeUndelivered puts message which could not be sent to the mailbox, without mailbox the send error is returned
+func (api *API) storeUndelivered(msg, deviceTag string, sendErr error) error {
+	if api.Mailbox == nil {
+		return sendErr
+	}
+
+	log.Printf(logPrefix+"Could not deliver message to device %v, storing it in mailbox. Err: %v\n", deviceTag, sendErr)
+
+	return api.Mailbox.Put(deviceTag, msg)
+}
+
+// storeIfOffline puts message to mailbox when subscription of the topic is kept only for the mailbox,
+// or behind stored messages which are being replayed so the order is kept
+func (api *API) storeIfOffline(topic, deviceTag, msg string) (bool, error) {
+	api.connectionMutex.RLock()
+	defer api.connectionMutex.RUnlock()
+
+	if _, replaying := api.replays[deviceTag]; api.Mailbox == nil || (api.clientsPerTopics[topic] > 0 && !replaying) {
+		return false, nil
+	}
+
+	api.logDebug(fmt.Sprintf("Device %v is offline, storing message in mailbox\n", deviceTag))
+
+	return true, api.Mailbox.Put(deviceTag, msg)
+}
+
+// awaitReplay makes messages of the device go to its mailbox until the stored ones are replayed
+// NOTE: has to be called with connectionMutex locked
+func (api *API) awaitReplay(deviceTag string) {
+	if api.Mailbox == nil {
+		return
+	}
+
+	if _, ok := api.replays[deviceTag]; !ok {
+		api.replays[deviceTag] = false
+	}
+}
+
+// replayMailbox sends stored messages of the device oldest first, they are removed from the mailbox only
+// once outbound queue of the device accepted them. Replay stops when the device does not take messages,
+// the rest of them is kept for the next connection.
+func (api *API) replayMailbox(deviceTag string) {
+	replayed := 0
+
+	defer func() {
+		if replayed > 0 {
+			log.Printf(logPrefix+"Delivered %v messages from mailbox of device %v\n", replayed, deviceTag)
+		}
+	}()
+
+	for {
+		messages, err := api.Mailbox.Peek(deviceTag, mailboxReplayBatch)
+		if err != nil {
+			log.Printf(logPrefix+"Could not read mailbox of device %v: %v\n", deviceTag, err)
+			api.stopReplay(deviceTag)
+			return
+		}
+
+		if len(messages) == 0 && api.finishReplay(deviceTag) {
+			return
+		}
+
+		accepted := 0
+		for _, msg := range messages {
+			if err = api.sendQueued(api.wrapForDevice(msg.Payload), deviceTag); err != nil {
+				break
+			}
+			accepted++
+		}
+
+		if accepted > 0 {
+			if removeErr := api.Mailbox.Remove(deviceTag, messages[:accepted]); removeErr != nil {
+				log.Printf(logPrefix+"Could not remove replayed messages from mailbox of device %v: %v\n", deviceTag, removeErr)
+				api.stopReplay(deviceTag)
+				return
+			}
+			replayed += accepted
+		}
+
+		if err != nil {
+			log.Printf(logPrefix+"Could not replay mailbox of device %v, keeping the rest for next connection. Err: %v\n", deviceTag, err)
+			api.stopReplay(deviceTag)
+			return
+		}
+	}
+}
+
+// finishReplay ends replay when the mailbox is empty, new messages can not be stored meanwhile as connectionMutex is locked
+func (api *API) finishReplay(deviceTag string) bool {
+	api.connectionMutex.Lock()
+	defer api.connectionMutex.Unlock()
+
+	messages, err := api.Mailbox.Peek(deviceTag, 1)
+	if err == nil && len(messages) > 0 {
+		return false
+	}
+
+	delete(api.replays, deviceTag)
+
+	return true
+}
+
+func (api *API) stopReplay(deviceTag string) {
+	api.connectionMutex.Lock()
+	defer api.connectionMutex.Unlock()
+
+	delete(api.replays, deviceTag)
+}
+
+// sendQueued waits for room in outbound queue of the device when the sender supports it
+func (api *API) sendQueued(msg, deviceTag string) error {
+	sender, ok := api.msgSender.(QueuedMessageSender)
+	if !ok {
+		return api.send(msg, deviceTag)
+	}
+
+	if binary, ok := binaryPayload(msg); ok {
+		return sender.SendBinaryMsgQueued(binary, deviceTag, mailboxReplayTimeout)
+	}
+
+	return sender.SendMsgQueued(msg, deviceTag, mailboxReplayTimeout)
+}
+
+func (api *API) putBack(deviceTag string, messages []mailbox.Message) {
+	for _, msg := range messages {
+		if err := api.Mailbox.Put(deviceTag, msg.Payload); err != nil {
+			log.Printf(logPrefix+"Could not put message back to mailbox of device %v: %v\n", deviceTag, err)
+		}
+	}
+}
+
+// NOTE: has to be called with connectionMutex locked
+func (api *API) startLingering(eventQueueTopic string) {
+	var timer *time.Timer
+
+	timer = time.AfterFunc(api.MailboxTTL, func() {
+		api.connectionMutex.Lock()
+		defer api.connectionMutex.Unlock()
+
+		if api.lingeringSubscriptions[eventQueueTopic] != timer || api.clientsPerTopics[eventQueueTopic] > 0 {
+			return
+		}
+
+		delete(api.lingeringSubscriptions, eventQueueTopic)
+		api.removeSubscription(eventQueueTopic)
+	})
+
+	api.lingeringSubscriptions[eventQueueTopic] = timer
+}
+
+// NOTE: has to be called with connectionMutex locked
+func (api *API) stopLingering(eventQueueTopic string) {
+	if timer, ok := api.lingeringSubscriptions[eventQueueTopic]; ok {
+		timer.Stop()
+		delete(api.lingeringSubscriptions, eventQueueTopic)
+	}
+}
+
 func (api *API) queueExists(topic string) bool {
 	api.connectionMutex.RLock()
 	defer api.connectionMutex.RUnlock()
@@ -155,25 +620,53 @@ func (api *API) queueExists(topic string) bool {
 	return msgQueueExist
 }
 
-func getPublishQueueTopic(deviceTag *string) string {
-	return "cloud.msg." + *deviceTag
+// topicParams returns tenant and plain device tag of the device. With tenancy enabled device tags
+// coming from the server are scoped with tenant of the connection, otherwise tenant of the deployment is used.
+func (api *API) topicParams(deviceTag string) topics.Params {
+	if !api.multiTenant {
+		return topics.Params{Tenant: api.tenant, DeviceTag: deviceTag}
+	}
+
+	tenant, plainDeviceTag := model.SplitScopedDeviceTag(deviceTag)
+
+	return topics.Params{Tenant: tenant, DeviceTag: plainDeviceTag}
+}
+
+func (api *API) getPublishQueueTopic(deviceTag *string) string {
+	return api.topics.Publish.Format(api.topicParams(*deviceTag))
+}
+
+func (api *API) getAckQueueTopic(deviceTag *string) string {
+	return api.topics.Ack.Format(api.topicParams(*deviceTag))
+}
+
+func (api *API) getEventQueueTopic(deviceTag *string) string {
+	return api.topics.Event.Format(api.topicParams(*deviceTag))
 }
 
-func getEventQueueTopic(deviceTag *string) string {
-	return "edge.msg." + *deviceTag
+func (api *API) getDeviceTagFromTopic(queueTopic string) (string, error) {
+	return api.parseDeviceTag(api.topics.Event, queueTopic)
 }
 
-func getDeviceTagFromTopic(queueTopic string) string {
-	s := strings.Split(queueTopic, ".msg.")
-	if len(s) < 2 {
-		panic(logPrefix + "This function has been called with wrong argument")
+func (api *API) parseDeviceTag(template *topics.Template, queueTopic string) (string, error) {
+	params, err := template.Parse(queueTopic)
+	if err != nil {
+		return "", fmt.Errorf(logPrefix+"Topic %v does not match template %v", queueTopic, template)
+	}
+
+	if api.multiTenant {
+		return model.ScopeDeviceTag(params.Tenant, params.DeviceTag), nil
+	}
+
+	if params.Tenant != api.tenant {
+		return "", fmt.Errorf(logPrefix+"Topic %v belongs to another tenant", queueTopic)
 	}
 
-	return s[1]
+	return params.DeviceTag, nil
 }
 
-func logDebug(s string) {
-	if resources.DeviceProxyLogDebug {
+func (api *API) logDebug(s string) {
+	if api.logDebugEnabled {
 		log.Printf(logPrefix + s)
 	}
 }
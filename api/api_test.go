@@ -1,15 +1,22 @@
 package api_test
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bxcodec/faker"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 
-	queuewrapper "git.krk.awesome-ind.com/GoUtils/QueueWrapper"
-
 	"deviceproxy/api"
+	"deviceproxy/mailbox"
 	"deviceproxy/mocks_test"
+	"deviceproxy/model"
+	"deviceproxy/resources"
 )
 
 type ServerTestSuite struct {
@@ -17,7 +24,7 @@ type ServerTestSuite struct {
 
 	api               *api.API
 	messageSenderMock *mocks_test.MessageSender
-	msgQueueMock      *queuewrapper.MsgQueueMock
+	msgQueueMock      *mocks_test.Broker
 
 	connectionID0 string
 	connectionID1 string
@@ -31,6 +38,7 @@ type ServerTestSuite struct {
 	publishQueueTopic1 string
 
 	eventMsgJSON string
+	remoteAddr   string
 
 	msg string
 }
@@ -41,9 +49,10 @@ func TestExecuteServerTestSuite(t *testing.T) {
 
 func (suite *ServerTestSuite) SetupTest() {
 	suite.messageSenderMock = &mocks_test.MessageSender{}
-	suite.msgQueueMock = queuewrapper.NewMsgQueueMock()
+	suite.msgQueueMock = mocks_test.NewBroker()
 
-	suite.api = api.NewAPI(suite.messageSenderMock, suite.msgQueueMock)
+	suite.api = api.NewAPI(suite.messageSenderMock, suite.msgQueueMock, resources.DefaultConfig())
+	suite.api.RawPayloads = true
 
 	suite.connectionID0 = "piesek"
 	suite.connectionID1 = "leszek"
@@ -57,6 +66,7 @@ func (suite *ServerTestSuite) SetupTest() {
 	suite.publishQueueTopic1 = "cloud.msg." + suite.deviceTag1
 
 	suite.eventMsgJSON = "{}"
+	suite.remoteAddr = "10.0.0.1:40000"
 
 	faker.FakeData(&suite.msg)
 }
@@ -67,65 +77,485 @@ func (suite *ServerTestSuite) AfterTest(suiteName, testName string) {
 }
 
 func (suite *ServerTestSuite) Test_MessageIsSentToClientIfItComesFromQueue() {
-	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
 
 	suite.messageSenderMock.On("SendMsg", suite.eventMsgJSON, suite.deviceTag0).Once().Return(nil)
-	queuewrapper.SendQueueMsgToService(suite.msgQueueMock, suite.eventQueueTopic0, suite.eventMsgJSON)
+	suite.msgQueueMock.Deliver(suite.eventQueueTopic0, suite.eventMsgJSON)
 }
 
 func (suite *ServerTestSuite) Test_APIIsUnsubcribedFromTopicAfterClientIsDisconnected() {
-	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0)
-	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &suite.deviceTag1)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &suite.deviceTag1, suite.remoteAddr)
 
-	suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0)
+	suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0, "closed by client")
 
 	err := suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &suite.publishQueueTopic0)
 	suite.NotNil(err)
 
-	queuewrapper.SendQueueMsgToService(suite.msgQueueMock, suite.eventQueueTopic0, suite.eventMsgJSON)
+	suite.msgQueueMock.Deliver(suite.eventQueueTopic0, suite.eventMsgJSON)
 
 	suite.messageSenderMock.On("SendMsg", suite.eventMsgJSON, suite.deviceTag1).Once().Return(nil)
-	queuewrapper.SendQueueMsgToService(suite.msgQueueMock, suite.eventQueueTopic1, suite.eventMsgJSON)
+	suite.msgQueueMock.Deliver(suite.eventQueueTopic1, suite.eventMsgJSON)
 }
 
 func (suite *ServerTestSuite) Test_APIReturnsNoErrorIfTwoClientsWantsToSpeakWithTheSameDevice() {
-	err := suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0)
+	err := suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
 	suite.Nil(err)
 
-	err = suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &suite.deviceTag0)
+	err = suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &suite.deviceTag0, suite.remoteAddr)
 	suite.Nil(err)
 }
 
 func (suite *ServerTestSuite) Test_TopicIsNotUnsubscribedIfThereIsStillClientConnectedToIt() {
-	err := suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0)
+	err := suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
 	suite.Nil(err)
 
-	err = suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0)
+	err = suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
 	suite.Nil(err)
 
 	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, suite.msg).Return(nil)
 	err = suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &suite.deviceTag0)
 	suite.Nil(err)
 
-	err = suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0)
+	err = suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0, "closed by client")
 	suite.Nil(err)
 
 	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, suite.msg).Return(nil)
 	err = suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &suite.deviceTag0)
 	suite.Nil(err)
 
-	err = suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0)
+	err = suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0, "closed by client")
 	suite.Nil(err)
 
 	err = suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &suite.deviceTag0)
 	suite.NotNil(err)
 }
 
+func (suite *ServerTestSuite) Test_MessagesForOfflineDeviceAreDeliveredWhenItReconnects() {
+	suite.api.Mailbox = mailbox.NewMemoryStore(10, time.Hour)
+
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+	suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0, "closed by client")
+
+	err := suite.msgQueueMock.Deliver(suite.eventQueueTopic0, "msg1")
+	suite.Nil(err)
+	err = suite.msgQueueMock.Deliver(suite.eventQueueTopic0, "msg2")
+	suite.Nil(err)
+
+	delivered := []string{}
+	suite.messageSenderMock.On("SendMsg", mock.Anything, suite.deviceTag0).Twice().Return(nil).Run(func(args mock.Arguments) {
+		delivered = append(delivered, args.String(0))
+	})
+
+	err = suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &suite.deviceTag0, suite.remoteAddr)
+	suite.Nil(err)
+	suite.Empty(delivered, "mailbox is replayed only after handshake response")
+
+	suite.api.OnConnectionReady(suite.connectionID1, &suite.deviceTag0)
+
+	suite.Eventually(func() bool {
+		messages, err := suite.api.Mailbox.Peek(suite.deviceTag0, 0)
+		return err == nil && len(messages) == 0
+	}, time.Second, 10*time.Millisecond)
+	suite.Equal([]string{"msg1", "msg2"}, delivered)
+}
+
+func (suite *ServerTestSuite) Test_UndeliverableMessageIsStoredInMailbox() {
+	suite.api.Mailbox = mailbox.NewMemoryStore(10, time.Hour)
+
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+	suite.api.OnConnectionReady(suite.connectionID0, &suite.deviceTag0)
+
+	suite.messageSenderMock.On("SendMsg", suite.eventMsgJSON, suite.deviceTag0).Once().Return(errors.New("no connection"))
+	err := suite.msgQueueMock.Deliver(suite.eventQueueTopic0, suite.eventMsgJSON)
+	suite.Nil(err)
+
+	messages, err := suite.api.Mailbox.Drain(suite.deviceTag0)
+	suite.Nil(err)
+	suite.Len(messages, 1)
+}
+
+func (suite *ServerTestSuite) Test_MessageIsAcknowledgedByDevice() {
+	suite.api.DeliveryAcks = true
+	suite.api.AckTimeout = time.Second
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+
+	delivered := make(chan model.DeliveryMsg, 1)
+	suite.messageSenderMock.On("SendMsg", mock.Anything, suite.deviceTag0).Once().Return(nil).Run(func(args mock.Arguments) {
+		deliveryMsg := model.DeliveryMsg{}
+		json.Unmarshal([]byte(args.String(0)), &deliveryMsg)
+		delivered <- deliveryMsg
+	})
+	suite.msgQueueMock.On("PublishMessage", "cloud.ack."+suite.deviceTag0, mock.MatchedBy(func(event string) bool {
+		return strings.Contains(event, `"status":"ack"`)
+	})).Once().Return(nil)
+
+	go func() {
+		deliveryMsg := <-delivered
+		suite.Equal(suite.eventMsgJSON, deliveryMsg.Payload)
+
+		ack := `{"ack":{"id":"` + deliveryMsg.ID + `","ok":true}}`
+		suite.Nil(suite.api.OnMessageReceivedFromClient(suite.connectionID0, &ack, &suite.deviceTag0))
+	}()
+
+	err := suite.msgQueueMock.Deliver(suite.eventQueueTopic0, suite.eventMsgJSON)
+	suite.Nil(err)
+}
+
+func (suite *ServerTestSuite) Test_MessageWithoutAckIsReturnedToQueue() {
+	suite.api.DeliveryAcks = true
+	suite.api.AckTimeout = 20 * time.Millisecond
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+
+	suite.messageSenderMock.On("SendMsg", mock.Anything, suite.deviceTag0).Once().Return(nil)
+	suite.msgQueueMock.On("PublishMessage", "cloud.ack."+suite.deviceTag0, mock.MatchedBy(func(event string) bool {
+		return strings.Contains(event, `"status":"nack"`) && strings.Contains(event, `"reason":"timeout"`)
+	})).Once().Return(nil)
+
+	err := suite.msgQueueMock.Deliver(suite.eventQueueTopic0, suite.eventMsgJSON)
+	suite.NotNil(err)
+}
+
+func (suite *ServerTestSuite) Test_MessageFromClientIsPublishedInEnvelope() {
+	suite.api.RawPayloads = false
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+
+	published := model.Envelope{}
+	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, mock.Anything).Once().Return(nil).Run(func(args mock.Arguments) {
+		json.Unmarshal([]byte(args.String(1)), &published)
+	})
+
+	msg := `{"temperature":21}`
+	err := suite.api.OnMessageReceivedFromClient(suite.connectionID0, &msg, &suite.deviceTag0)
+	suite.Nil(err)
+
+	suite.Equal(model.EnvelopeVersion, published.Version)
+	suite.NotEmpty(published.ID)
+	suite.Equal(suite.deviceTag0, published.DeviceTag)
+	suite.Equal(suite.connectionID0, published.ConnectionID)
+	suite.Equal(model.ContentTypeJSON, published.ContentType)
+	suite.Equal(msg, published.Payload)
+	suite.False(published.ReceivedAt.IsZero())
+}
+
+func (suite *ServerTestSuite) Test_SelectedUpgradeHeadersArePutToEnvelope() {
+	suite.api.RawPayloads = false
+	suite.api.EnvelopeHeaders = []string{"X-Correlation-ID", "X-Firmware"}
+	suite.api.OnConnectionHeaders(suite.connectionID0, http.Header{
+		"X-Correlation-Id": {"abc"},
+		"Authorization":    {"Bearer secret"},
+	})
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+
+	published := model.Envelope{}
+	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, mock.Anything).Once().Return(nil).Run(func(args mock.Arguments) {
+		json.Unmarshal([]byte(args.String(1)), &published)
+	})
+
+	msg := "hello"
+	suite.Nil(suite.api.OnMessageReceivedFromClient(suite.connectionID0, &msg, &suite.deviceTag0))
+	suite.Equal(map[string]string{"X-Correlation-ID": "abc"}, published.Headers)
+}
+
+func (suite *ServerTestSuite) Test_RPCResponseOfDeviceIsRoutedToReplyTopic() {
+	suite.api.RPCEnabled = true
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+
+	frame := model.ProxyFrame{}
+	suite.messageSenderMock.On("SendMsg", mock.Anything, suite.deviceTag0).Once().Return(nil).Run(func(args mock.Arguments) {
+		json.Unmarshal([]byte(args.String(0)), &frame)
+	})
+
+	request := `{"correlationId":"call1","replyTo":"backend.replies","payload":"reboot"}`
+	err := suite.msgQueueMock.Deliver("rpc.req."+suite.deviceTag0, request)
+	suite.Nil(err)
+
+	suite.Require().NotNil(frame.RPC)
+	suite.Equal("call1", frame.RPC.CorrelationID)
+	suite.Equal("reboot", frame.RPC.Payload)
+
+	suite.msgQueueMock.On("PublishMessage", "backend.replies", mock.MatchedBy(func(msg string) bool {
+		response := model.RPCResponse{}
+		json.Unmarshal([]byte(msg), &response)
+		return response.CorrelationID == "call1" && response.Payload == "done" && response.Error == ""
+	})).Once().Return(nil)
+
+	response := `{"rpcResponse":{"correlationId":"call1","payload":"done"}}`
+	err = suite.api.OnMessageReceivedFromClient(suite.connectionID0, &response, &suite.deviceTag0)
+	suite.Nil(err)
+}
+
+func (suite *ServerTestSuite) Test_RPCRequestWithReplyToOfProxyTopicIsRefused() {
+	suite.api.RPCEnabled = true
+	suite.api.PresenceTopic = "device.presence"
+	suite.msgQueueMock.On("PublishMessage", "device.presence", mock.Anything).Return(nil)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+
+	request := func(replyTo string) {
+		request, _ := json.Marshal(model.RPCRequest{CorrelationID: "call1", ReplyTo: replyTo, Payload: "reboot"})
+		suite.Nil(suite.msgQueueMock.Deliver("rpc.req."+suite.deviceTag0, string(request)), replyTo)
+	}
+
+	for _, replyTo := range []string{
+		"cloud.msg." + suite.deviceTag1,
+		"edge.msg." + suite.deviceTag1,
+		"cloud.ack." + suite.deviceTag1,
+		"rpc.req." + suite.deviceTag1,
+		"device.presence",
+		"backend.>",
+	} {
+		request(replyTo)
+	}
+
+	suite.api.RPCReplyPrefix = "backend."
+	request("other.replies")
+
+	suite.messageSenderMock.AssertNotCalled(suite.T(), "SendMsg", mock.Anything, mock.Anything)
+	suite.msgQueueMock.AssertNotCalled(suite.T(), "PublishMessage", "cloud.msg."+suite.deviceTag1, mock.Anything)
+}
+
+func (suite *ServerTestSuite) Test_RPCTimeoutProducesErrorReply() {
+	suite.api.RPCEnabled = true
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+
+	suite.messageSenderMock.On("SendMsg", mock.Anything, suite.deviceTag0).Once().Return(nil)
+
+	replied := make(chan model.RPCResponse, 1)
+	suite.msgQueueMock.On("PublishMessage", "backend.replies", mock.Anything).Once().Return(nil).Run(func(args mock.Arguments) {
+		response := model.RPCResponse{}
+		json.Unmarshal([]byte(args.String(1)), &response)
+		replied <- response
+	})
+
+	request := `{"correlationId":"call2","replyTo":"backend.replies","payload":"reboot","timeoutMillis":20}`
+	err := suite.msgQueueMock.Deliver("rpc.req."+suite.deviceTag0, request)
+	suite.Nil(err)
+
+	select {
+	case response := <-replied:
+		suite.Equal("call2", response.CorrelationID)
+		suite.Equal("timeout", response.Error)
+	case <-time.After(time.Second):
+		suite.Fail("RPC timeout has not been replied")
+	}
+}
+
+func (suite *ServerTestSuite) Test_PresenceEventsArePublishedWhenConnectionCountChanges() {
+	suite.api.PresenceTopic = "device.presence"
+
+	events := []model.PresenceEvent{}
+	suite.msgQueueMock.On("PublishMessage", "device.presence", mock.Anything).Times(3).Return(nil).Run(func(args mock.Arguments) {
+		event := model.PresenceEvent{}
+		json.Unmarshal([]byte(args.String(1)), &event)
+		events = append(events, event)
+	})
+
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &suite.deviceTag0, "10.0.0.2:40000")
+	suite.api.OnClientDisconnected(suite.connectionID1, &suite.deviceTag0, "pong timeout")
+
+	suite.Require().Len(events, 3)
+
+	suite.Equal(model.PresenceOnline, events[0].Status)
+	suite.Equal(suite.deviceTag0, events[0].DeviceTag)
+	suite.Equal(suite.remoteAddr, events[0].RemoteAddr)
+	suite.Equal(1, events[0].ConnectionCount)
+
+	suite.Equal(model.PresenceOnline, events[1].Status)
+	suite.Equal(2, events[1].ConnectionCount)
+
+	suite.Equal(model.PresenceOnline, events[2].Status)
+	suite.Equal("10.0.0.2:40000", events[2].RemoteAddr)
+	suite.Equal("pong timeout", events[2].Reason)
+	suite.Equal(1, events[2].ConnectionCount)
+
+	suite.msgQueueMock.On("PublishMessage", "device.presence", mock.MatchedBy(func(msg string) bool {
+		event := model.PresenceEvent{}
+		json.Unmarshal([]byte(msg), &event)
+		return event.Status == model.PresenceOffline && event.ConnectionCount == 0 && event.ConnectionID == suite.connectionID0
+	})).Once().Return(nil)
+
+	suite.api.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0, "closed by client")
+}
+
 func (suite *ServerTestSuite) Test_APIPublishMessageToQueueIfMessageComesFromClient() {
-	err := suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0)
+	err := suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
 	suite.Nil(err)
 
 	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, suite.msg).Return(nil)
 	err = suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &suite.deviceTag0)
 	suite.Nil(err)
 }
+
+func (suite *ServerTestSuite) Test_AllSubscriptionsAreRemovedWhenServerStops() {
+	suite.api.Mailbox = mailbox.NewMemoryStore(10, time.Hour)
+
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &suite.deviceTag1, suite.remoteAddr)
+	suite.api.OnClientDisconnected(suite.connectionID1, &suite.deviceTag1, "server shutdown")
+	suite.Equal(2, suite.api.SubscriptionCount())
+
+	suite.msgQueueMock.On("ShutDown").Maybe()
+	suite.api.OnServerStopped()
+
+	suite.Equal(0, suite.api.SubscriptionCount())
+}
+
+func (suite *ServerTestSuite) Test_MessagesAreRoutedWithConfiguredTopicTemplates() {
+	config := resources.DefaultConfig()
+	config.Topics.Tenant = "acme"
+	config.Topics.Publish = "{tenant}.devices.{tag}.up"
+	config.Topics.Event = "{tenant}.devices.{tag}.down"
+	suite.api = api.NewAPI(suite.messageSenderMock, suite.msgQueueMock, config)
+	suite.api.RawPayloads = true
+
+	deviceTag := "edge.msg.device.down"
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &deviceTag, suite.remoteAddr)
+
+	suite.msgQueueMock.On("PublishMessage", "acme.devices."+deviceTag+".up", suite.msg).Once().Return(nil)
+	err := suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &deviceTag)
+	suite.Nil(err)
+
+	suite.messageSenderMock.On("SendMsg", suite.eventMsgJSON, deviceTag).Once().Return(nil)
+	suite.msgQueueMock.Deliver("acme.devices."+deviceTag+".down", suite.eventMsgJSON)
+}
+
+func (suite *ServerTestSuite) Test_DevicesOfDifferentTenantsWithTheSameTagAreSeparated() {
+	config := resources.DefaultConfig()
+	config.Tenancy.Source = "claim"
+	config.Topics.Publish = "{tenant}.devices.{tag}.up"
+	config.Topics.Event = "{tenant}.devices.{tag}.down"
+	suite.api = api.NewAPI(suite.messageSenderMock, suite.msgQueueMock, config)
+
+	acmeDeviceTag := model.ScopeDeviceTag("acme", suite.deviceTag0)
+	otherDeviceTag := model.ScopeDeviceTag("other", suite.deviceTag0)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &acmeDeviceTag, suite.remoteAddr)
+	suite.api.OnConnectionEstabilishedFromClient(suite.connectionID1, &otherDeviceTag, suite.remoteAddr)
+
+	suite.msgQueueMock.On("PublishMessage", "acme.devices."+suite.deviceTag0+".up", mock.MatchedBy(func(msg string) bool {
+		envelope := model.Envelope{}
+		return json.Unmarshal([]byte(msg), &envelope) == nil && envelope.Tenant == "acme" && envelope.DeviceTag == suite.deviceTag0
+	})).Once().Return(nil)
+	err := suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &acmeDeviceTag)
+	suite.Nil(err)
+
+	suite.messageSenderMock.On("SendMsg", suite.eventMsgJSON, otherDeviceTag).Once().Return(nil)
+	suite.msgQueueMock.Deliver("other.devices."+suite.deviceTag0+".down", suite.eventMsgJSON)
+}
+
+func (suite *ServerTestSuite) Test_ClientIsAskedToRetryWhenQueueIsUnavailable() {
+	err := suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr)
+	suite.Nil(err)
+
+	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, suite.msg).Return(api.ErrBrokerUnavailable)
+	err = suite.api.OnMessageReceivedFromClient(suite.connectionID0, &suite.msg, &suite.deviceTag0)
+
+	response, ok := err.(model.ResponseMsg)
+	suite.True(ok)
+	suite.Equal(model.CodeQueueUnavailable, response.Code)
+}
+
+func (suite *ServerTestSuite) newClusterAPI(instanceID string) *api.API {
+	return suite.newClusterAPIWithConfig(instanceID, resources.DefaultConfig())
+}
+
+func (suite *ServerTestSuite) newClusterAPIWithConfig(instanceID string, config *resources.Config) *api.API {
+	config.Cluster.Enabled = true
+	config.Cluster.InstanceID = instanceID
+
+	clusterAPI := api.NewAPI(suite.messageSenderMock, suite.msgQueueMock, config)
+	clusterAPI.RawPayloads = true
+
+	suite.msgQueueMock.On("PublishMessage", "deviceproxy.cluster.registry", `{"kind":"hello","instance":"`+instanceID+`"}`).Once().Return(nil)
+	suite.Nil(clusterAPI.JoinCluster())
+
+	return clusterAPI
+}
+
+func (suite *ServerTestSuite) Test_MessageOfDeviceConnectedToAnotherInstanceIsForwarded() {
+	clusterAPI := suite.newClusterAPI("a")
+
+	online, _ := json.Marshal(model.RegistryEvent{Kind: model.RegistryOnline, Instance: "b", DeviceTag: suite.deviceTag0})
+	suite.Nil(suite.msgQueueMock.Deliver("deviceproxy.cluster.registry", string(online)))
+
+	forwarded, _ := json.Marshal(model.ForwardedMsg{DeviceTag: suite.deviceTag0, Payload: suite.msg})
+	suite.msgQueueMock.On("PublishMessage", "deviceproxy.cluster.forward.b", string(forwarded)).Once().Return(nil)
+
+	suite.Nil(clusterAPI.ParseMsg(suite.eventQueueTopic0, suite.msg))
+}
+
+func (suite *ServerTestSuite) Test_MessageIsKeptInLocalMailboxWhenInstanceHoldingDeviceStopsAnnouncingIt() {
+	config := resources.DefaultConfig()
+	config.Cluster.RegistryTTL = 100 * time.Millisecond
+	clusterAPI := suite.newClusterAPIWithConfig("a", config)
+	clusterAPI.Mailbox = mailbox.NewMemoryStore(10, time.Hour)
+	clusterAPI.MailboxTTL = time.Hour
+
+	online, _ := json.Marshal(model.RegistryEvent{Kind: model.RegistryOnline, Instance: "b", DeviceTag: suite.deviceTag0})
+	suite.Nil(suite.msgQueueMock.Deliver("deviceproxy.cluster.registry", string(online)))
+	time.Sleep(50 * time.Millisecond) // device moved to b before it reconnected to a
+
+	suite.msgQueueMock.On("PublishMessage", "deviceproxy.cluster.registry", mock.Anything).Return(nil)
+	suite.Nil(clusterAPI.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr))
+	clusterAPI.OnConnectionReady(suite.connectionID0, &suite.deviceTag0)
+	suite.Nil(clusterAPI.OnClientDisconnected(suite.connectionID0, &suite.deviceTag0, "closed by client"))
+
+	forwarded, _ := json.Marshal(model.ForwardedMsg{DeviceTag: suite.deviceTag0, Payload: "msg1"})
+	suite.msgQueueMock.On("PublishMessage", "deviceproxy.cluster.forward.b", string(forwarded)).Once().Return(nil)
+	suite.Nil(clusterAPI.ParseMsg(suite.eventQueueTopic0, "msg1"))
+
+	time.Sleep(150 * time.Millisecond)
+
+	suite.Nil(clusterAPI.ParseMsg(suite.eventQueueTopic0, "msg2"))
+
+	messages, err := clusterAPI.Mailbox.Drain(suite.deviceTag0)
+	suite.Nil(err)
+	suite.Require().Len(messages, 1)
+	suite.Equal("msg2", messages[0].Payload)
+}
+
+func (suite *ServerTestSuite) Test_ForwardedMessageIsDeliveredToLocalDevice() {
+	clusterAPI := suite.newClusterAPI("b")
+
+	suite.msgQueueMock.On("PublishMessage", "deviceproxy.cluster.registry", mock.Anything).Once().Return(nil)
+	suite.Nil(clusterAPI.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr))
+
+	forwarded, _ := json.Marshal(model.ForwardedMsg{DeviceTag: suite.deviceTag0, Payload: suite.msg})
+	suite.messageSenderMock.On("SendMsg", suite.msg, suite.deviceTag0).Once().Return(nil)
+
+	suite.Nil(suite.msgQueueMock.Deliver("deviceproxy.cluster.forward.b", string(forwarded)))
+}
+
+func (suite *ServerTestSuite) Test_BinaryFrameIsPublishedBase64EncodedInEnvelope() {
+	suite.api.RawPayloads = false
+	suite.Nil(suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr))
+
+	var published string
+	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, mock.Anything).Once().Return(nil).Run(func(args mock.Arguments) {
+		published = args.String(1)
+	})
+
+	suite.Nil(suite.api.OnBinaryMessageReceivedFromClient(suite.connectionID0, []byte{0xa1, 0x01}, &suite.deviceTag0))
+
+	envelope := model.Envelope{}
+	suite.Nil(json.Unmarshal([]byte(published), &envelope))
+	suite.Equal(model.ContentTypeBinary, envelope.ContentType)
+	suite.Equal("oQE=", envelope.Payload)
+}
+
+func (suite *ServerTestSuite) Test_BinaryFrameIsPublishedAsBinaryMsgWithRawPayloads() {
+	suite.api.RawPayloads = true
+	suite.Nil(suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr))
+
+	suite.msgQueueMock.On("PublishMessage", suite.publishQueueTopic0, `{"$binary":"oQE="}`).Once().Return(nil)
+
+	suite.Nil(suite.api.OnBinaryMessageReceivedFromClient(suite.connectionID0, []byte{0xa1, 0x01}, &suite.deviceTag0))
+}
+
+func (suite *ServerTestSuite) Test_MessageFlaggedAsBinaryIsSentAsBinaryFrame() {
+	suite.Nil(suite.api.OnConnectionEstabilishedFromClient(suite.connectionID0, &suite.deviceTag0, suite.remoteAddr))
+
+	suite.messageSenderMock.On("SendBinaryMsg", []byte{0xa1, 0x01}, suite.deviceTag0).Once().Return(nil)
+
+	suite.Nil(suite.msgQueueMock.Deliver(suite.eventQueueTopic0, `{"$binary":"oQE="}`))
+}
@@ -0,0 +1,21 @@
+package api
+
+import "errors"
+
+// ErrBrokerUnavailable is returned by brokers which can not publish while they are reconnecting
+var ErrBrokerUnavailable = errors.New(logPrefix + "Message queue is unavailable")
+
+// MsgParser handles messages of subscribed topic. Brokers which support redelivery deliver the message
+// again later when error is returned.
+type MsgParser interface {
+	ParseMsg(topic, msg string) error
+}
+
+// Broker is the message queue the proxy exchanges messages with the platform through.
+// Durable subscriptions keep messages published while the proxy is not subscribed when broker supports it.
+type Broker interface {
+	AddSubscription(topic string, parser MsgParser, durable bool) error
+	RemoveSubscription(topic string) error
+	PublishMessage(topic, msg string) error
+	ShutDown()
+}
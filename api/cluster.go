@@ -0,0 +1,323 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"deviceproxy/model"
+)
+
+// deviceRegistry says which proxy instances hold connections of which devices. Instances announce their devices
+// periodically, entries which were not announced for ttl are stale, e.g. when the instance died without saying bye.
+type deviceRegistry struct {
+	instances map[string]map[string]time.Time //NOTE: when the instance announced the device last time
+	ttl       time.Duration                   //NOTE: 0 means entries do not expire
+	mutex     sync.Mutex
+}
+
+func newDeviceRegistry(ttl time.Duration) *deviceRegistry {
+	return &deviceRegistry{instances: map[string]map[string]time.Time{}, ttl: ttl}
+}
+
+// add records announcement of the device, it returns false when the instance already held the device
+func (r *deviceRegistry) add(deviceTag, instance string, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.instances[deviceTag] == nil {
+		r.instances[deviceTag] = map[string]time.Time{}
+	}
+
+	announced, known := r.instances[deviceTag][instance]
+	r.instances[deviceTag][instance] = now
+
+	return !known || r.stale(announced, now)
+}
+
+func (r *deviceRegistry) remove(deviceTag, instance string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.instances[deviceTag], instance)
+	if len(r.instances[deviceTag]) == 0 {
+		delete(r.instances, deviceTag)
+	}
+}
+
+func (r *deviceRegistry) removeInstance(instance string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for deviceTag, instances := range r.instances {
+		delete(instances, instance)
+		if len(instances) == 0 {
+			delete(r.instances, deviceTag)
+		}
+	}
+}
+
+// owner picks the same instance on every replica when device is connected to several of them, stale entries are dropped
+func (r *deviceRegistry) owner(deviceTag string, now time.Time) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	owners := []string{}
+	for instance, announced := range r.instances[deviceTag] {
+		if r.stale(announced, now) {
+			delete(r.instances[deviceTag], instance)
+			continue
+		}
+		owners = append(owners, instance)
+	}
+
+	if len(owners) == 0 {
+		delete(r.instances, deviceTag)
+		return "", false
+	}
+
+	sort.Strings(owners)
+
+	return owners[0], true
+}
+
+func (r *deviceRegistry) stale(announced, now time.Time) bool {
+	return r.ttl > 0 && now.Sub(announced) > r.ttl
+}
+
+// JoinCluster subscribes to device registry shared by proxy instances and to messages forwarded to this instance.
+// It does nothing when cluster is not enabled.
+func (api *API) JoinCluster() error {
+	if api.registry == nil {
+		return nil
+	}
+
+	if err := api.msgQueue.AddSubscription(api.registryTopic(), api, false); err != nil {
+		return fmt.Errorf(logPrefix+"Could not subscribe to cluster registry: %v", err)
+	}
+
+	if err := api.msgQueue.AddSubscription(api.forwardTopic(api.instanceID), api, false); err != nil {
+		api.msgQueue.RemoveSubscription(api.registryTopic())
+		return fmt.Errorf(logPrefix+"Could not subscribe to forwarded messages: %v", err)
+	}
+
+	api.publishRegistryEvent(model.RegistryHello, "")
+
+	if api.announceInterval > 0 {
+		api.stopAnnouncing = make(chan struct{})
+		go api.announcePeriodically(api.stopAnnouncing)
+	}
+
+	log.Printf(logPrefix+"Instance %v joined cluster %v\n", api.instanceID, api.clusterTopic)
+
+	return nil
+}
+
+func (api *API) leaveCluster() {
+	if api.registry == nil {
+		return
+	}
+
+	if api.stopAnnouncing != nil {
+		close(api.stopAnnouncing)
+	}
+
+	api.publishRegistryEvent(model.RegistryBye, "")
+
+	for _, topic := range []string{api.registryTopic(), api.forwardTopic(api.instanceID)} {
+		if err := api.msgQueue.RemoveSubscription(topic); err != nil {
+			log.Printf(logPrefix+"Could not remove subscription for topic:%v Error:%v\n", topic, err)
+		}
+	}
+}
+
+func (api *API) publishRegistryEvent(kind, deviceTag string) {
+	if api.registry == nil {
+		return
+	}
+
+	event, err := json.Marshal(model.RegistryEvent{Kind: kind, Instance: api.instanceID, DeviceTag: deviceTag})
+	if err != nil {
+		log.Printf(logPrefix+"Could not marshal registry event: %v\n", err)
+		return
+	}
+
+	if err = api.msgQueue.PublishMessage(api.registryTopic(), string(event)); err != nil {
+		log.Printf(logPrefix+"Could not publish %v registry event of device %v: %v\n", kind, deviceTag, err)
+	}
+}
+
+// handleClusterMsg handles registry events and forwarded messages, it returns false for other topics
+func (api *API) handleClusterMsg(topic, msg string) (bool, error) {
+	if api.registry == nil {
+		return false, nil
+	}
+
+	switch topic {
+	case api.registryTopic():
+		api.handleRegistryEvent(msg)
+		return true, nil
+	case api.forwardTopic(api.instanceID):
+		return true, api.handleForwardedMsg(msg)
+	}
+
+	return false, nil
+}
+
+func (api *API) handleRegistryEvent(msg string) {
+	event := model.RegistryEvent{}
+	if err := json.Unmarshal([]byte(msg), &event); err != nil {
+		log.Printf(logPrefix+"Could not parse registry event: %v\n", err)
+		return
+	}
+
+	if event.Instance == api.instanceID {
+		return
+	}
+
+	switch event.Kind {
+	case model.RegistryOnline:
+		if api.registry.add(event.DeviceTag, event.Instance, time.Now()) {
+			go api.handOver(event.DeviceTag, event.Instance)
+		}
+	case model.RegistryOffline:
+		api.registry.remove(event.DeviceTag, event.Instance)
+	case model.RegistryHello:
+		api.registry.removeInstance(event.Instance)
+		api.announceDevices()
+	case model.RegistryBye:
+		api.registry.removeInstance(event.Instance)
+	}
+}
+
+// announceDevices tells other instances about all devices connected to this one
+func (api *API) announceDevices() {
+	api.connectionMutex.RLock()
+	defer api.connectionMutex.RUnlock()
+
+	for eventQueueTopic, clients := range api.clientsPerTopics {
+		if clients == 0 {
+			continue
+		}
+
+		deviceTag, err := api.getDeviceTagFromTopic(eventQueueTopic)
+		if err != nil {
+			continue
+		}
+
+		api.publishRegistryEvent(model.RegistryOnline, deviceTag)
+	}
+}
+
+// announcePeriodically keeps devices of this instance in registries of other instances until stop is closed
+func (api *API) announcePeriodically(stop chan struct{}) {
+	ticker := time.NewTicker(api.announceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			api.announceDevices()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handOver drops subscription kept for offline device which connected to another instance and forwards its mailbox there,
+// so messages are not stored by both instances
+func (api *API) handOver(deviceTag, instance string) {
+	api.connectionMutex.Lock()
+	defer api.connectionMutex.Unlock()
+
+	eventQueueTopic := api.getEventQueueTopic(&deviceTag)
+
+	if clients, ok := api.clientsPerTopics[eventQueueTopic]; !ok || clients > 0 {
+		return
+	}
+
+	api.stopLingering(eventQueueTopic)
+	api.removeSubscription(eventQueueTopic)
+
+	if api.Mailbox == nil {
+		return
+	}
+
+	messages, err := api.Mailbox.Drain(deviceTag)
+	if err != nil {
+		log.Printf(logPrefix+"Could not read mailbox of device %v: %v\n", deviceTag, err)
+		return
+	}
+
+	for i, msg := range messages {
+		if err = api.forward(msg.Payload, deviceTag, instance); err != nil {
+			log.Printf(logPrefix+"Could not hand over mailbox of device %v to %v, putting back %v messages. Err: %v\n", deviceTag, instance, len(messages)-i, err)
+			api.putBack(deviceTag, messages[i:])
+			return
+		}
+	}
+
+	if len(messages) > 0 {
+		log.Printf(logPrefix+"Handed over %v messages from mailbox of device %v to %v\n", len(messages), deviceTag, instance)
+	}
+}
+
+// forwardIfRemote forwards message of device which is not connected to this instance to the instance holding it
+func (api *API) forwardIfRemote(topic, msg string) (bool, error) {
+	if api.registry == nil {
+		return false, nil
+	}
+
+	deviceTag, err := api.getDeviceTagFromTopic(topic)
+	if err != nil {
+		return false, nil
+	}
+
+	api.connectionMutex.RLock()
+	local := api.clientsPerTopics[topic] > 0
+	api.connectionMutex.RUnlock()
+
+	if local {
+		return false, nil
+	}
+
+	instance, ok := api.registry.owner(deviceTag, time.Now())
+	if !ok {
+		return false, nil //NOTE: device is not connected anywhere else, mailbox of this instance keeps the message
+	}
+
+	api.logDebug(fmt.Sprintf("Device %v is connected to %v, forwarding message\n", deviceTag, instance))
+
+	return true, api.forward(msg, deviceTag, instance)
+}
+
+func (api *API) forward(msg, deviceTag, instance string) error {
+	data, err := json.Marshal(model.ForwardedMsg{DeviceTag: deviceTag, Payload: msg})
+	if err != nil {
+		return err
+	}
+
+	return api.msgQueue.PublishMessage(api.forwardTopic(instance), string(data))
+}
+
+// handleForwardedMsg delivers message forwarded by another instance, it is not forwarded again
+func (api *API) handleForwardedMsg(msg string) error {
+	forwarded := model.ForwardedMsg{}
+	if err := json.Unmarshal([]byte(msg), &forwarded); err != nil {
+		log.Printf(logPrefix+"Could not parse forwarded message: %v\n", err)
+		return nil // malformed message will not get better with redelivery
+	}
+
+	return api.deliver(api.getEventQueueTopic(&forwarded.DeviceTag), forwarded.DeviceTag, forwarded.Payload)
+}
+
+func (api *API) registryTopic() string {
+	return api.clusterTopic + ".registry"
+}
+
+func (api *API) forwardTopic(instance string) string {
+	return api.clusterTopic + ".forward." + instance
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"deviceproxy/model"
+)
+
+const ackTimeoutReason = "timeout"
+
+// deliverWithAck sends message wrapped in DeliveryMsg and waits until device acknowledges it, so it blocks the queue
+// callback which is fine only for queues dispatching every topic on its own (see resources.DeliveryConfig).
+// Error is returned when there is no ack in AckTimeout so the queue delivers the message again.
+func (api *API) deliverWithAck(msg, deviceTag string) error {
+	id := uuid.NewV4().String()
+
+	acks := api.registerPendingAck(id)
+	defer api.unregisterPendingAck(id)
+
+	err := api.msgSender.SendMsg(wrapInDeliveryMsg(id, msg), deviceTag)
+	if err != nil {
+		return api.storeUndelivered(msg, deviceTag, err)
+	}
+
+	timer := time.NewTimer(api.AckTimeout)
+	defer timer.Stop()
+
+	select {
+	case ack := <-acks:
+		api.publishAckEvent(deviceTag, ack)
+		return nil
+	case <-timer.C:
+		api.publishAckEvent(deviceTag, model.DeliveryAck{ID: id, OK: false, Reason: ackTimeoutReason})
+		return fmt.Errorf(logPrefix+"Device %v did not acknowledge message %v in %v", deviceTag, id, api.AckTimeout)
+	}
+}
+
+func (api *API) handleAck(ack model.DeliveryAck, deviceTag string) {
+	if !api.resolvePendingAck(ack) {
+		// nobody waits for it anymore (timed out or replayed from mailbox) but the platform still wants to know
+		api.publishAckEvent(deviceTag, ack)
+	}
+}
+
+// wrapForDevice wraps message sent without waiting for ack, device acks it and the ack event is still published.
+// Binary messages can not carry delivery id so they are sent as they are.
+func (api *API) wrapForDevice(msg string) string {
+	if !api.DeliveryAcks || isBinary(msg) {
+		return msg
+	}
+
+	return wrapInDeliveryMsg(uuid.NewV4().String(), msg)
+}
+
+func (api *API) registerPendingAck(id string) chan model.DeliveryAck {
+	api.ackMutex.Lock()
+	defer api.ackMutex.Unlock()
+
+	acks := make(chan model.DeliveryAck, 1)
+	api.pendingAcks[id] = acks
+
+	return acks
+}
+
+func (api *API) unregisterPendingAck(id string) {
+	api.ackMutex.Lock()
+	defer api.ackMutex.Unlock()
+
+	delete(api.pendingAcks, id)
+}
+
+func (api *API) resolvePendingAck(ack model.DeliveryAck) bool {
+	api.ackMutex.Lock()
+	defer api.ackMutex.Unlock()
+
+	acks, ok := api.pendingAcks[ack.ID]
+	if !ok {
+		return false
+	}
+
+	select {
+	case acks <- ack:
+	default: // duplicated ack from other connection of the same device
+	}
+
+	return true
+}
+
+func (api *API) publishAckEvent(deviceTag string, ack model.DeliveryAck) {
+	status := model.AckStatusAck
+	if !ack.OK {
+		status = model.AckStatusNack
+	}
+
+	params := api.topicParams(deviceTag)
+
+	event, err := json.Marshal(model.AckEvent{
+		ID:        ack.ID,
+		Tenant:    params.Tenant,
+		DeviceTag: params.DeviceTag,
+		Status:    status,
+		Reason:    ack.Reason,
+		Timestamp: time.Now().UTC(),
+	})
+
+	if err != nil {
+		log.Printf(logPrefix+"Could not marshal ack event: %v\n", err)
+		return
+	}
+
+	ackQueueTopic := api.getAckQueueTopic(&deviceTag)
+
+	if err = api.msgQueue.PublishMessage(ackQueueTopic, string(event)); err != nil {
+		log.Printf(logPrefix+"Could not publish ack event to topic %v: %v\n", ackQueueTopic, err)
+	}
+}
+
+func wrapInDeliveryMsg(id, msg string) string {
+	data, _ := json.Marshal(model.DeliveryMsg{ID: id, Payload: msg})
+	return string(data)
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"deviceproxy/model"
+)
+
+// queueMessage returns message as it is published to the queue, either raw or wrapped in model.Envelope
+func (api *API) queueMessage(connectionID, msg, deviceTag string) (string, error) {
+	if api.RawPayloads {
+		return msg, nil
+	}
+
+	return api.envelope(connectionID, deviceTag, detectContentType(msg), msg)
+}
+
+// queueBinaryMessage returns binary frame as it is published to the queue, it is base64 encoded in model.Envelope,
+// with raw payloads it is published as model.BinaryMsg so consumers can tell it from text message
+func (api *API) queueBinaryMessage(connectionID string, msg []byte, deviceTag string) (string, error) {
+	if api.RawPayloads {
+		data, err := json.Marshal(model.BinaryMsg{Binary: msg})
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	return api.envelope(connectionID, deviceTag, model.ContentTypeBinary, base64.StdEncoding.EncodeToString(msg))
+}
+
+func (api *API) envelope(connectionID, deviceTag, contentType, payload string) (string, error) {
+	params := api.topicParams(deviceTag)
+
+	api.connectionMutex.RLock()
+	headers := api.connectionHeaders[connectionID]
+	api.connectionMutex.RUnlock()
+
+	envelope := model.Envelope{
+		Version:      model.EnvelopeVersion,
+		ID:           uuid.NewV4().String(),
+		Tenant:       params.Tenant,
+		DeviceTag:    params.DeviceTag,
+		ConnectionID: connectionID,
+		ReceivedAt:   time.Now().UTC(),
+		ContentType:  contentType,
+		Headers:      headers,
+		Payload:      payload,
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func detectContentType(msg string) string {
+	if json.Valid([]byte(msg)) {
+		return model.ContentTypeJSON
+	}
+
+	return model.ContentTypeText
+}
+
+// binaryPayload decodes message of the platform flagged as binary by model.BinaryMsg
+func binaryPayload(msg string) ([]byte, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(msg), `{"$binary"`) {
+		return nil, false
+	}
+
+	binaryMsg := model.BinaryMsg{}
+	if err := json.Unmarshal([]byte(msg), &binaryMsg); err != nil || binaryMsg.Binary == nil {
+		return nil, false
+	}
+
+	return binaryMsg.Binary, true
+}
+
+func isBinary(msg string) bool {
+	_, ok := binaryPayload(msg)
+	return ok
+}
@@ -1,6 +1,21 @@
 package api
 
+import "time"
+
 // MessageSender ...
 type MessageSender interface {
 	SendMsg(msg, deviceTag string) error
 }
+
+// QueuedMessageSender is implemented by senders which can wait for room in outbound queue of the device instead of
+// dropping messages, error means the message has not been accepted
+type QueuedMessageSender interface {
+	SendMsgQueued(msg, deviceTag string, timeout time.Duration) error
+	SendBinaryMsgQueued(msg []byte, deviceTag string, timeout time.Duration) error
+}
+
+// BinaryMessageSender is implemented by senders which can deliver binary frames, messages flagged as binary
+// are sent as text otherwise
+type BinaryMessageSender interface {
+	SendBinaryMsg(msg []byte, deviceTag string) error
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"deviceproxy/model"
+)
+
+// NOTE: has to be called with connectionMutex locked
+func (api *API) publishPresence(status, connectionID, deviceTag, reason string, connectionCount int) {
+	if api.PresenceTopic == "" {
+		return
+	}
+
+	params := api.topicParams(deviceTag)
+
+	event, err := json.Marshal(model.PresenceEvent{
+		Status:          status,
+		Tenant:          params.Tenant,
+		DeviceTag:       params.DeviceTag,
+		ConnectionID:    connectionID,
+		RemoteAddr:      api.remoteAddrs[connectionID],
+		Timestamp:       time.Now().UTC(),
+		Reason:          reason,
+		ConnectionCount: connectionCount,
+	})
+
+	if err != nil {
+		log.Printf(logPrefix+"Could not marshal presence event: %v\n", err)
+		return
+	}
+
+	if err = api.msgQueue.PublishMessage(api.PresenceTopic, string(event)); err != nil {
+		log.Printf(logPrefix+"Could not publish presence event of device %v: %v\n", deviceTag, err)
+	}
+}
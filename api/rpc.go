@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"deviceproxy/model"
+)
+
+const (
+	rpcErrorTimeout       = "timeout"
+	rpcErrorDeviceOffline = "device offline"
+)
+
+type pendingRPC struct {
+	replyTo   string
+	deviceTag string
+	timer     *time.Timer
+}
+
+// handleRPCRequest forwards request from the queue to device and waits in background for its response.
+// Nil is returned for requests which can not be handled so they are not redelivered, the caller gets error reply instead.
+func (api *API) handleRPCRequest(msg, deviceTag string) error {
+	request := model.RPCRequest{}
+
+	if err := json.Unmarshal([]byte(msg), &request); err != nil || request.CorrelationID == "" || request.ReplyTo == "" {
+		log.Printf(logPrefix+"Dropping malformed RPC request for device %v: %v\n", deviceTag, msg)
+		return nil
+	}
+
+	if !api.allowedReplyTo(request.ReplyTo) {
+		log.Printf(logPrefix+"Dropping RPC request %v for device %v, reply-to topic %v is not allowed\n", request.CorrelationID, deviceTag, request.ReplyTo)
+		return nil
+	}
+
+	if !api.deviceOnline(deviceTag) {
+		api.publishRPCResponse(request.ReplyTo, model.RPCResponse{CorrelationID: request.CorrelationID, DeviceTag: deviceTag, Error: rpcErrorDeviceOffline})
+		return nil
+	}
+
+	timeout := api.RPCTimeout
+	if request.TimeoutMillis > 0 {
+		timeout = time.Duration(request.TimeoutMillis) * time.Millisecond
+	}
+
+	api.registerPendingRPC(request, deviceTag, timeout)
+
+	frame, _ := json.Marshal(model.ProxyFrame{RPC: &model.RPCCall{CorrelationID: request.CorrelationID, Payload: request.Payload}})
+
+	if err := api.msgSender.SendMsg(string(frame), deviceTag); err != nil {
+		if pending, ok := api.takePendingRPC(request.CorrelationID); ok {
+			api.publishRPCResponse(pending.replyTo, model.RPCResponse{CorrelationID: request.CorrelationID, DeviceTag: deviceTag, Error: err.Error()})
+		}
+	}
+
+	return nil
+}
+
+// handleRPCResponse routes response of the device to reply-to topic of the request
+func (api *API) handleRPCResponse(response model.RPCResponse, deviceTag string) {
+	pending, ok := api.takePendingRPC(response.CorrelationID)
+
+	if !ok || pending.deviceTag != deviceTag {
+		log.Printf(logPrefix+"Dropping RPC response %v from device %v, there is no pending request for it\n", response.CorrelationID, deviceTag)
+		return
+	}
+
+	response.DeviceTag = deviceTag
+	api.publishRPCResponse(pending.replyTo, response)
+}
+
+func (api *API) registerPendingRPC(request model.RPCRequest, deviceTag string, timeout time.Duration) {
+	api.rpcMutex.Lock()
+	defer api.rpcMutex.Unlock()
+
+	api.pendingRPCs[request.CorrelationID] = &pendingRPC{
+		replyTo:   request.ReplyTo,
+		deviceTag: deviceTag,
+		timer: time.AfterFunc(timeout, func() {
+			if pending, ok := api.takePendingRPC(request.CorrelationID); ok {
+				api.publishRPCResponse(pending.replyTo, model.RPCResponse{CorrelationID: request.CorrelationID, DeviceTag: deviceTag, Error: rpcErrorTimeout})
+			}
+		}),
+	}
+}
+
+// takePendingRPC removes pending request so only one of response, send error or timeout is replied
+func (api *API) takePendingRPC(correlationID string) (*pendingRPC, bool) {
+	api.rpcMutex.Lock()
+	defer api.rpcMutex.Unlock()
+
+	pending, ok := api.pendingRPCs[correlationID]
+	if ok {
+		pending.timer.Stop()
+		delete(api.pendingRPCs, correlationID)
+	}
+
+	return pending, ok
+}
+
+func (api *API) publishRPCResponse(replyTo string, response model.RPCResponse) {
+	//NOTE: requester knows tenant from topic it sent the request to, so the response carries plain device tag
+	response.DeviceTag = api.topicParams(response.DeviceTag).DeviceTag
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Printf(logPrefix+"Could not marshal RPC response: %v\n", err)
+		return
+	}
+
+	if err = api.msgQueue.PublishMessage(replyTo, string(data)); err != nil {
+		log.Printf(logPrefix+"Could not publish RPC response to %v: %v\n", replyTo, err)
+	}
+}
+
+// allowedReplyTo refuses topics the proxy publishes or consumes on behalf of devices, otherwise anyone who can send
+// RPC request could publish data attributed to a device on its topics
+func (api *API) allowedReplyTo(replyTo string) bool {
+	if !strings.HasPrefix(replyTo, api.RPCReplyPrefix) {
+		return false
+	}
+
+	if strings.ContainsAny(replyTo, "*>+#") || strings.IndexFunc(replyTo, unicode.IsSpace) >= 0 {
+		return false
+	}
+
+	if api.topics.Owns(replyTo) || replyTo == api.PresenceTopic {
+		return false
+	}
+
+	return api.registry == nil || !strings.HasPrefix(replyTo, api.clusterTopic+".")
+}
+
+func (api *API) deviceOnline(deviceTag string) bool {
+	api.connectionMutex.RLock()
+	defer api.connectionMutex.RUnlock()
+
+	return api.clientsPerTopics[api.getEventQueueTopic(&deviceTag)] > 0
+}
+
+func (api *API) getRPCQueueTopic(deviceTag *string) string {
+	return api.topics.RPC.Format(api.topicParams(*deviceTag))
+}
+
+func (api *API) getDeviceTagFromRPCTopic(queueTopic string) (string, error) {
+	return api.parseDeviceTag(api.topics.RPC, queueTopic)
+}
@@ -0,0 +1,157 @@
+package deviceproxy_test
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy"
+	"deviceproxy/model"
+	"deviceproxy/resources"
+)
+
+type clusterInstance struct {
+	proxy   *deviceproxy.DeviceProxy
+	url     string
+	stopped chan error
+}
+
+type ClusterTestSuite struct {
+	suite.Suite
+
+	natsServer *natsserver.Server
+	platform   *nats.Conn
+	presence   chan model.PresenceEvent
+	instances  []*clusterInstance
+}
+
+func TestExecuteClusterTestSuite(t *testing.T) {
+	suite.Run(t, new(ClusterTestSuite))
+}
+
+func (suite *ClusterTestSuite) SetupTest() {
+	options := natstest.DefaultTestOptions
+	options.Port = -1
+	suite.natsServer = natstest.RunServer(&options)
+
+	var err error
+	suite.platform, err = nats.Connect(suite.natsServer.ClientURL())
+	suite.Require().Nil(err)
+
+	suite.presence = make(chan model.PresenceEvent, 10)
+	_, err = suite.platform.Subscribe("presence", func(msg *nats.Msg) {
+		event := model.PresenceEvent{}
+		json.Unmarshal(msg.Data, &event)
+		suite.presence <- event
+	})
+	suite.Require().Nil(err)
+
+	suite.instances = []*clusterInstance{suite.startInstance("a"), suite.startInstance("b")}
+}
+
+func (suite *ClusterTestSuite) TearDownTest() {
+	for _, instance := range suite.instances {
+		suite.Nil(instance.proxy.Shutdown())
+		suite.Nil(<-instance.stopped)
+	}
+
+	suite.platform.Close()
+	suite.natsServer.Shutdown()
+}
+
+func (suite *ClusterTestSuite) startInstance(instanceID string) *clusterInstance {
+	listener, err := net.Listen("tcp", "localhost:0")
+	suite.Require().Nil(err)
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	config := resources.DefaultConfig()
+	config.Service.Port = port
+	config.Queue.Mode = "nats"
+	config.Queue.ClientID = instanceID
+	config.NATS.URL = suite.natsServer.ClientURL()
+	config.NATS.Username = ""
+	config.NATS.Password = ""
+	config.Mailbox.Mode = "memory"
+	config.Mailbox.TTL = time.Minute
+	config.Delivery.PresenceTopic = "presence"
+	config.Cluster.Enabled = true
+	config.Cluster.InstanceID = instanceID
+
+	instance := &clusterInstance{
+		proxy:   deviceproxy.NewDeviceProxy(config),
+		url:     "ws://localhost:" + port + config.Service.Endpoint,
+		stopped: make(chan error, 1),
+	}
+
+	go func() {
+		instance.stopped <- instance.proxy.Run()
+	}()
+
+	return instance
+}
+
+func (suite *ClusterTestSuite) Test_MailboxOfDeviceIsHandedOverToInstanceItReconnectedTo() {
+	device := suite.connect(suite.instances[0], "device")
+	suite.expectPresence(model.PresenceOnline)
+	device.Close()
+	suite.expectPresence(model.PresenceOffline)
+
+	suite.Nil(suite.platform.Publish("edge.msg.device", []byte("while offline")))
+	suite.Nil(suite.platform.Flush())
+	time.Sleep(100 * time.Millisecond) // NOTE: gives instance a time to store the message in its mailbox
+
+	device = suite.connect(suite.instances[1], "device")
+	defer device.Close()
+
+	suite.expectMessage(device, "while offline")
+
+	suite.Nil(suite.platform.Publish("edge.msg.device", []byte("online")))
+	suite.expectMessage(device, "online")
+
+	device.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, msg, err := device.ReadMessage()
+	suite.NotNil(err, "message delivered twice: %s", msg)
+}
+
+// connect retries until the instance accepts connections
+func (suite *ClusterTestSuite) connect(instance *clusterInstance, deviceTag string) *websocket.Conn {
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		device, _, err := websocket.DefaultDialer.Dial(instance.url+"?deviceTag="+deviceTag, nil)
+		if err == nil {
+			responseMsg := model.ResponseMsg{}
+			suite.Nil(device.ReadJSON(&responseMsg))
+			suite.Equal(model.CodeSuccess, responseMsg.Code)
+			return device
+		}
+
+		suite.Require().True(time.Now().Before(deadline), "instance is not accepting connections: %v", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (suite *ClusterTestSuite) expectPresence(status string) {
+	select {
+	case event := <-suite.presence:
+		suite.Equal(status, event.Status)
+	case <-time.After(time.Second):
+		suite.Fail("presence event not published", status)
+	}
+}
+
+func (suite *ClusterTestSuite) expectMessage(device *websocket.Conn, expected string) {
+	device.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := device.ReadMessage()
+	suite.Nil(err)
+	suite.Equal(expected, string(msg))
+}
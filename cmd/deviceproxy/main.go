@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"deviceproxy"
+	"deviceproxy/resources"
+)
+
+const usage = `Usage: deviceproxy <command> [flags]
+
+Commands:
+  serve          run the proxy until SIGINT or SIGTERM
+  check-config   validate configuration and exit
+  version        print version and exit
+
+Flags override environment variables which override config file, run "deviceproxy <command> -h" to list them.
+`
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "serve", "check-config":
+		config, err := loadConfig(command, args, stderr)
+		if err == flag.ErrHelp {
+			return 0
+		} else if err != nil {
+			return 2
+		}
+
+		if command == "serve" {
+			return serve(config, stderr)
+		}
+		return checkConfig(config, stdout, stderr)
+	case "version":
+		fmt.Fprintf(stdout, "%v %v\n", resources.ServiceName, version)
+		return 0
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "Unknown command %q\n\n%v", command, usage)
+	return 2
+}
+
+func serve(config *resources.Config, stderr io.Writer) int {
+	proxy := deviceproxy.NewDeviceProxy(config)
+
+	if err := proxy.CheckConfig(); err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- proxy.Run()
+	}()
+
+	select {
+	case err := <-result:
+		return exitCode(err, stderr)
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down DeviceProxy\n", sig)
+	}
+
+	if err := proxy.Shutdown(); err != nil {
+		log.Printf("DeviceProxy error when shutting down:%v\n", err)
+	}
+
+	return exitCode(<-result, stderr)
+}
+
+func checkConfig(config *resources.Config, stdout, stderr io.Writer) int {
+	if err := deviceproxy.NewDeviceProxy(config).CheckConfig(); err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintln(stdout, "Configuration is valid")
+	return 0
+}
+
+func exitCode(err error, stderr io.Writer) int {
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// loadConfig builds config from defaults, config file, environment and flags, each overriding the previous one.
+// Invalid config file or environment is reported as flag error so it results in usage exit code.
+func loadConfig(command string, args []string, stderr io.Writer) (*resources.Config, error) {
+	config := resources.DefaultConfig()
+	configFile := os.Getenv(resources.EnvConfigFile)
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&configFile, "config", configFile, "YAML or JSON config file")
+	bindFlags(flags, config)
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "Unexpected arguments: %v\n", flags.Args())
+		return nil, fmt.Errorf("unexpected arguments")
+	}
+
+	// flags are bound to fields of config so loaded values are copied into it and explicitly set flags applied again
+	setFlags := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	loaded, err := resources.LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return nil, err
+	}
+
+	*config = *loaded
+
+	for name, value := range setFlags {
+		if err := flags.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+func bindFlags(flags *flag.FlagSet, config *resources.Config) {
+	flags.StringVar(&config.Service.Port, "port", config.Service.Port, "port devices connect to")
+	flags.StringVar(&config.Service.Endpoint, "endpoint", config.Service.Endpoint, "path of websocket endpoint")
+	flags.BoolVar(&config.Service.LogDebug, "debug", config.Service.LogDebug, "log every message")
+	flags.DurationVar(&config.Service.DrainTimeout, "drain-timeout", config.Service.DrainTimeout, "time to wait for connections on shutdown")
+
+	flags.StringVar(&config.Queue.Mode, "queue-mode", config.Queue.Mode, "nats-streaming, nats, mqtt or memory (in-process queue for local development)")
+	flags.StringVar(&config.Queue.ClientID, "queue-client-id", config.Queue.ClientID, "client ID durable subscriptions are kept for")
+	flags.DurationVar(&config.Queue.RedeliveryDelay, "queue-redelivery-delay", config.Queue.RedeliveryDelay, "delay before unhandled message is redelivered")
+	flags.DurationVar(&config.Queue.ReconnectDelay, "queue-reconnect-delay", config.Queue.ReconnectDelay, "delay before reconnecting lost NATS Streaming connection, doubled after every failed attempt")
+	flags.DurationVar(&config.Queue.ReconnectMaxDelay, "queue-reconnect-max-delay", config.Queue.ReconnectMaxDelay, "maximal delay between reconnect attempts")
+	flags.StringVar(&config.NATS.URL, "nats-url", config.NATS.URL, "NATS Streaming server URL")
+	flags.StringVar(&config.NATS.Cluster, "nats-cluster", config.NATS.Cluster, "NATS Streaming cluster name")
+	flags.StringVar(&config.NATS.Username, "nats-user", config.NATS.Username, "NATS username")
+	flags.StringVar(&config.NATS.Password, "nats-password", config.NATS.Password, "NATS password")
+	flags.StringVar(&config.MQTT.URL, "mqtt-url", config.MQTT.URL, "MQTT broker URL")
+	flags.StringVar(&config.MQTT.Username, "mqtt-user", config.MQTT.Username, "MQTT username")
+	flags.StringVar(&config.MQTT.Password, "mqtt-password", config.MQTT.Password, "MQTT password")
+
+	flags.IntVar(&config.Connection.SendQueueSize, "send-queue-size", config.Connection.SendQueueSize, "outbound messages buffered per connection")
+	flags.StringVar(&config.Connection.SendQueueOverflow, "send-queue-overflow", config.Connection.SendQueueOverflow, "drop-oldest, drop-newest or disconnect")
+	flags.DurationVar(&config.Connection.PingInterval, "ping-interval", config.Connection.PingInterval, "websocket ping interval, 0 disables pings")
+	flags.DurationVar(&config.Connection.PongWait, "pong-wait", config.Connection.PongWait, "time to wait for pong, 0 disables it")
+	flags.DurationVar(&config.Connection.ReadIdleTimeout, "read-idle-timeout", config.Connection.ReadIdleTimeout, "close connections idle for that long, 0 disables it")
+	flags.BoolVar(&config.Connection.Compression, "compression", config.Connection.Compression, "accept permessage-deflate offered by devices")
+	flags.IntVar(&config.Connection.CompressionLevel, "compression-level", config.Connection.CompressionLevel, "flate compression level from -2 to 9")
+	flags.Var((*stringList)(&config.Connection.AllowedOrigins), "allowed-origins", "comma separated origins allowed to connect, * allows any")
+	flags.BoolVar(&config.Connection.AllowEmptyOrigin, "allow-empty-origin", config.Connection.AllowEmptyOrigin, "allow requests without Origin header")
+	flags.IntVar(&config.Connection.CompressionThreshold, "compression-threshold", config.Connection.CompressionThreshold, "smallest outbound message in bytes which is compressed")
+
+	flags.IntVar(&config.Limits.MaxMessageSize, "max-message-size", config.Limits.MaxMessageSize, "largest message in bytes device may send, 0 means no limit")
+	flags.Float64Var(&config.Limits.ConnectionRate, "connection-rate", config.Limits.ConnectionRate, "messages per second of every connection, 0 disables the limit")
+	flags.IntVar(&config.Limits.ConnectionBurst, "connection-burst", config.Limits.ConnectionBurst, "messages connection may send at once")
+	flags.Float64Var(&config.Limits.DeviceRate, "device-rate", config.Limits.DeviceRate, "messages per second of all connections of device, 0 disables the limit")
+	flags.IntVar(&config.Limits.DeviceBurst, "device-burst", config.Limits.DeviceBurst, "messages device may send at once")
+	flags.StringVar(&config.Limits.Violation, "limit-violation", config.Limits.Violation, "reject, delay or disconnect message over rate limit")
+
+	flags.StringVar(&config.Auth.Mode, "auth-mode", config.Auth.Mode, "none, jwt or psk")
+	flags.StringVar(&config.Auth.JWTSecret, "jwt-secret", config.Auth.JWTSecret, "HMAC secret of device tokens")
+	flags.StringVar(&config.Auth.PSKFile, "psk-file", config.Auth.PSKFile, "file with pre-shared keys of devices")
+
+	flags.StringVar(&config.TLS.Mode, "tls-mode", config.TLS.Mode, "none, tls or mtls")
+	flags.StringVar(&config.TLS.CertFile, "tls-cert", config.TLS.CertFile, "server certificate")
+	flags.StringVar(&config.TLS.KeyFile, "tls-key", config.TLS.KeyFile, "server private key")
+	flags.StringVar(&config.TLS.ClientCAFile, "tls-client-ca", config.TLS.ClientCAFile, "CA bundle of device certificates")
+	flags.StringVar(&config.TLS.CRLFile, "tls-crl", config.TLS.CRLFile, "revocation list of device certificates")
+	flags.StringVar(&config.TLS.CertIdentity, "tls-cert-identity", config.TLS.CertIdentity, "cn or san-uri")
+
+	flags.StringVar(&config.Mailbox.Mode, "mailbox-mode", config.Mailbox.Mode, "none, memory or file")
+	flags.StringVar(&config.Mailbox.Dir, "mailbox-dir", config.Mailbox.Dir, "directory of file mailbox")
+	flags.IntVar(&config.Mailbox.Size, "mailbox-size", config.Mailbox.Size, "messages kept per offline device")
+	flags.DurationVar(&config.Mailbox.TTL, "mailbox-ttl", config.Mailbox.TTL, "how long messages are kept for offline device")
+
+	flags.BoolVar(&config.Delivery.Acks, "delivery-acks", config.Delivery.Acks, "require device acks, needs nats-streaming or memory queue")
+	flags.DurationVar(&config.Delivery.AckTimeout, "ack-timeout", config.Delivery.AckTimeout, "time to wait for device ack")
+	flags.BoolVar(&config.Delivery.RawPayloads, "raw-payloads", config.Delivery.RawPayloads, "publish device messages without envelope, binary frames as {\"$binary\":\"<base64>\"}")
+	flags.Var((*stringList)(&config.Delivery.EnvelopeHeaders), "envelope-headers", "comma separated upgrade request headers copied to message envelopes")
+	flags.BoolVar(&config.Delivery.RPCEnabled, "rpc", config.Delivery.RPCEnabled, "forward RPC requests to devices")
+	flags.DurationVar(&config.Delivery.RPCTimeout, "rpc-timeout", config.Delivery.RPCTimeout, "default time to wait for RPC response")
+	flags.StringVar(&config.Delivery.RPCReplyPrefix, "rpc-reply-prefix", config.Delivery.RPCReplyPrefix, "prefix reply-to topics of RPC requests have to start with")
+	flags.StringVar(&config.Delivery.PresenceTopic, "presence-topic", config.Delivery.PresenceTopic, "topic of presence events, empty disables them")
+
+	flags.StringVar(&config.Topics.Tenant, "topic-tenant", config.Topics.Tenant, "tenant put in place of {tenant} in topic templates")
+	flags.StringVar(&config.Topics.Publish, "topic-publish", config.Topics.Publish, "template of topics device messages are published to")
+	flags.StringVar(&config.Topics.Event, "topic-event", config.Topics.Event, "template of topics messages for devices come from")
+	flags.StringVar(&config.Topics.Ack, "topic-ack", config.Topics.Ack, "template of topics delivery acks are published to")
+	flags.StringVar(&config.Topics.RPC, "topic-rpc", config.Topics.RPC, "template of topics RPC requests come from")
+
+	flags.StringVar(&config.Tenancy.Source, "tenant-source", config.Tenancy.Source, "where tenant of connection comes from: none, claim, subdomain or path")
+	flags.StringVar(&config.Tenancy.Domain, "tenant-domain", config.Tenancy.Domain, "parent domain of tenant subdomains")
+	flags.IntVar(&config.Tenancy.MaxConnections, "tenant-max-connections", config.Tenancy.MaxConnections, "connection limit of every tenant, 0 means no limit")
+
+	flags.BoolVar(&config.Cluster.Enabled, "cluster", config.Cluster.Enabled, "share device registry with other replicas and forward messages between them")
+	flags.StringVar(&config.Cluster.InstanceID, "cluster-instance-id", config.Cluster.InstanceID, "ID of the replica")
+	flags.StringVar(&config.Cluster.Topic, "cluster-topic", config.Cluster.Topic, "prefix of registry and forwarding topics")
+	flags.DurationVar(&config.Cluster.AnnounceInterval, "cluster-announce-interval", config.Cluster.AnnounceInterval, "how often devices are announced to other replicas")
+	flags.DurationVar(&config.Cluster.RegistryTTL, "cluster-registry-ttl", config.Cluster.RegistryTTL, "how long device stays in registry without being announced")
+	flags.StringVar(&config.Monitoring.MetricsEndpoint, "metrics-endpoint", config.Monitoring.MetricsEndpoint, "path of prometheus metrics, empty disables them")
+	flags.DurationVar(&config.Monitoring.AcceptLoopTimeout, "accept-loop-timeout", config.Monitoring.AcceptLoopTimeout, "liveness fails when accept loop is stuck for that long")
+	flags.StringVar(&config.Admin.Port, "admin-port", config.Admin.Port, "port of admin API, empty disables it")
+	flags.StringVar(&config.Admin.Token, "admin-token", config.Admin.Token, "bearer token of admin API")
+}
+
+// stringList is flag of comma separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+
+	for _, value := range strings.Split(v, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			*l = append(*l, value)
+		}
+	}
+
+	return nil
+}
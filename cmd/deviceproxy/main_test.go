@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionIsPrinted(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	assert.Equal(t, 0, run([]string{"version"}, stdout, stderr))
+	assert.Equal(t, "DeviceProxy dev\n", stdout.String())
+}
+
+func TestUnknownCommandIsUsageError(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	assert.Equal(t, 2, run([]string{"start"}, stdout, stderr))
+	assert.Contains(t, stderr.String(), "Unknown command")
+}
+
+func TestCheckConfigUsesFlags(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Equal(t, 1, run([]string{"check-config", "-nats-url", "nats://localhost:4222", "-auth-mode", "jwt"}, stdout, stderr))
+	assert.Contains(t, stderr.String(), "JWT secret is required")
+
+	stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Equal(t, 0, run([]string{"check-config", "-nats-url", "nats://localhost:4222", "-auth-mode", "none"}, stdout, stderr))
+}
+
+func TestFlagsOverrideConfigFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "deviceproxy-*.yaml")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString("service:\n  port: \"4000\"\nnats:\n  url: nats://file:4222\nconnection:\n  pingInterval: 5s\n")
+	file.Close()
+
+	config, err := loadConfig("serve", []string{"-config", file.Name(), "-port", "5000"}, &bytes.Buffer{})
+	assert.Nil(t, err)
+	assert.Equal(t, "5000", config.Service.Port)
+	assert.Equal(t, "nats://file:4222", config.NATS.URL)
+	assert.Equal(t, 5*time.Second, config.Connection.PingInterval)
+}
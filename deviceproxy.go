@@ -1,48 +1,312 @@
 package deviceproxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 
+	"deviceproxy/admin"
 	"deviceproxy/api"
+	"deviceproxy/mailbox"
+	"deviceproxy/metrics"
+	"deviceproxy/queue"
 	"deviceproxy/resources"
 	"deviceproxy/server"
 )
 
 // DeviceProxy ...
 type DeviceProxy struct {
-	server *server.Server
+	// Authenticator overrides authenticator selected by auth mode from config when set before Run
+	Authenticator server.Authenticator
+	// MsgQueue overrides queue selected by queue mode from config when set before Run
+	MsgQueue api.Broker
+	config   *resources.Config
+	server   *server.Server
+	admin    *admin.Admin
+	stopped  bool
+	mutex    sync.Mutex //NOTE: guards server, admin and stopped which are shared by Run and Shutdown
 }
 
 // NewDeviceProxy ...
-func NewDeviceProxy() *DeviceProxy {
-	return &DeviceProxy{}
+func NewDeviceProxy(config *resources.Config) *DeviceProxy {
+	return &DeviceProxy{config: config}
 }
 
-// Run ...
-func (p *DeviceProxy) Run() {
+// CheckConfig validates the config and loads files it refers to without connecting to the queue or opening any port
+func (p *DeviceProxy) CheckConfig() error {
+	if err := p.config.Validate(); err != nil {
+		return err
+	}
+
+	authenticator, err := p.newAuthenticator()
+	if err != nil {
+		return fmt.Errorf("invalid authentication config: %v", err)
+	}
+
+	if _, err := p.newTLSConfig(); err != nil {
+		return fmt.Errorf("invalid TLS config: %v", err)
+	}
+
+	if _, err := p.newTenantResolver(authenticator); err != nil {
+		return fmt.Errorf("invalid tenancy config: %v", err)
+	}
+
+	return nil
+}
+
+// Run serves devices until Shutdown is called, error is returned when proxy can not be configured or started
+func (p *DeviceProxy) Run() error {
+	if err := p.config.Validate(); err != nil {
+		return fmt.Errorf("DeviceProxy error when validating config:%v", err)
+	}
+
+	authenticator, err := p.newAuthenticator()
+	if err != nil {
+		return fmt.Errorf("DeviceProxy error when configuring authentication:%v", err)
+	}
+
+	tlsConfig, err := p.newTLSConfig()
+	if err != nil {
+		return fmt.Errorf("DeviceProxy error when configuring TLS:%v", err)
+	}
+
+	mailbox, err := p.newMailbox()
+	if err != nil {
+		return fmt.Errorf("DeviceProxy error when configuring mailbox:%v", err)
+	}
+
+	tenantResolver, err := p.newTenantResolver(authenticator)
+	if err != nil {
+		return fmt.Errorf("DeviceProxy error when configuring tenancy:%v", err)
+	}
+
+	if p.isStopped() {
+		return nil
+	}
+
+	//NOTE: connecting may take long, Shutdown must not wait for it
+	msgQueue, checkQueueConnection, err := p.newMsgQueue()
+
+	p.mutex.Lock()
+
+	if p.stopped {
+		p.mutex.Unlock()
+		if err == nil {
+			msgQueue.ShutDown()
+		}
+		return nil
+	}
+
+	if err != nil {
+		p.mutex.Unlock()
+		return fmt.Errorf("DeviceProxy error when connecting to queue:%v", err)
+	}
 
-	p.server = server.NewServer()
-	msgQueue := resources.NewServiceMsgQueue()
-	api := api.NewAPI(p.server, msgQueue)
+	p.server = server.NewServer(p.config)
+	p.server.Authenticator = authenticator
+	p.server.TLSConfig = tlsConfig
+	p.server.TenantResolver = tenantResolver
+	p.server.AddReadinessCheck("queue", checkQueueConnection)
+	api := api.NewAPI(p.server, msgQueue, p.config)
+	api.Mailbox = mailbox
 	p.server.Listener = api
 
-	log.Printf("Starting DeviceProxy %v on port %v\n", resources.ServiceName, resources.ServicePort)
+	if err = api.JoinCluster(); err != nil {
+		p.server = nil
+		p.mutex.Unlock()
+		msgQueue.ShutDown()
+		return fmt.Errorf("DeviceProxy error when joining cluster:%v", err)
+	}
+
+	if p.config.Monitoring.MetricsEndpoint != "" {
+		p.server.Metrics = metrics.NewMetrics()
+		p.server.Metrics.ObserveSubscriptions(api.SubscriptionCount)
+		p.server.Metrics.ObserveDroppedMessages(p.server.DroppedMessages)
+		api.Metrics = p.server.Metrics
+	}
+
+	if p.config.Admin.Port != "" {
+		p.admin = admin.NewAdmin(p.server, p.config.Admin.Token)
+		go p.serveAdmin(p.admin)
+	}
+
+	serviceServer := p.server
+	p.mutex.Unlock()
 
-	err := p.server.Serve(resources.ServicePort)
+	log.Printf("Starting DeviceProxy %v on port %v\n", resources.ServiceName, p.config.Service.Port)
+
+	err = serviceServer.Serve(p.config.Service.Port)
 
 	if err == http.ErrServerClosed {
 		log.Println("DeviceProxy stopped")
-		return
+		return nil
 	}
 
 	if err != nil {
-		panic(fmt.Sprintf("DeviceProxy error when serving:%v", err))
+		return fmt.Errorf("DeviceProxy error when serving:%v", err)
 	}
+
+	return nil
 }
 
-// Shutdown ...
+// Shutdown drains device connections and stops the proxy, Run returns once the queue is shut down
 func (p *DeviceProxy) Shutdown() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.stopped = true
+
+	if p.admin != nil {
+		if err := p.admin.Shutdown(); err != nil {
+			log.Printf("DeviceProxy error when stopping admin API:%v\n", err)
+		}
+	}
+
+	if p.server == nil {
+		return nil
+	}
+
 	return p.server.Shutdown()
 }
+
+func (p *DeviceProxy) isStopped() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.stopped
+}
+
+func (p *DeviceProxy) serveAdmin(admin *admin.Admin) {
+	err := admin.Serve(p.config.Admin.Port)
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("DeviceProxy error when serving admin API:%v\n", err)
+	}
+}
+
+func (p *DeviceProxy) newAuthenticator() (server.Authenticator, error) {
+	if p.Authenticator != nil {
+		return p.Authenticator, nil
+	}
+
+	auth := p.config.Auth
+
+	switch auth.Mode {
+	case "", "none":
+		if p.config.TLS.Mode == "mtls" {
+			identity, err := server.ParseCertIdentity(p.config.TLS.CertIdentity)
+			if err != nil {
+				return nil, err
+			}
+			return server.NewClientCertAuthenticator(identity), nil
+		}
+		return nil, nil
+	case "jwt":
+		if auth.JWTSecret == "" {
+			return nil, fmt.Errorf("%v is required in jwt auth mode", resources.EnvJWTSecret)
+		}
+		return server.NewJWTAuthenticator([]byte(auth.JWTSecret)), nil
+	case "psk":
+		return server.NewPSKAuthenticatorFromFile(auth.PSKFile)
+	}
+
+	return nil, fmt.Errorf("unknown auth mode %v", auth.Mode)
+}
+
+func (p *DeviceProxy) newTLSConfig() (*tls.Config, error) {
+	tlsConfig := p.config.TLS
+
+	switch tlsConfig.Mode {
+	case "", "none":
+		return nil, nil
+	case "tls":
+		return server.NewTLSConfig(tlsConfig.CertFile, tlsConfig.KeyFile, "", "")
+	case "mtls":
+		if tlsConfig.ClientCAFile == "" {
+			return nil, fmt.Errorf("%v is required in mtls mode", resources.EnvTLSClientCAFile)
+		}
+		return server.NewTLSConfig(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.ClientCAFile, tlsConfig.CRLFile)
+	}
+
+	return nil, fmt.Errorf("unknown TLS mode %v", tlsConfig.Mode)
+}
+
+func (p *DeviceProxy) newMsgQueue() (api.Broker, server.ReadinessCheck, error) {
+	if p.MsgQueue != nil {
+		return p.MsgQueue, func() error { return nil }, nil
+	}
+
+	queueConfig := p.config.Queue
+	natsConfig := p.config.NATS
+
+	switch queueConfig.Mode {
+	case "nats-streaming":
+		q, err := queue.NewNATSStreamingQueue(natsConfig.URL, natsConfig.Cluster, queueConfig.ClientID, natsConfig.Username, natsConfig.Password,
+			queueConfig.RedeliveryDelay, queueConfig.ReconnectDelay, queueConfig.ReconnectMaxDelay)
+		if err != nil {
+			return nil, nil, err
+		}
+		return q, q.Check, nil
+	case "nats":
+		q, err := queue.NewNATSQueue(natsConfig.URL, queueConfig.ClientID, natsConfig.Username, natsConfig.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		return q, q.Check, nil
+	case "mqtt":
+		mqttConfig := p.config.MQTT
+		q, err := queue.NewMQTTQueue(mqttConfig.URL, queueConfig.ClientID, mqttConfig.Username, mqttConfig.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		return q, q.Check, nil
+	case "memory":
+		log.Println("DeviceProxy uses in-memory queue, messages are not shared with other services")
+		return queue.NewMemoryQueue(queueConfig.RedeliveryDelay), func() error { return nil }, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown queue mode %v", queueConfig.Mode)
+}
+
+func (p *DeviceProxy) newMailbox() (mailbox.Store, error) {
+	mailboxConfig := p.config.Mailbox
+
+	switch mailboxConfig.Mode {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return mailbox.NewMemoryStore(mailboxConfig.Size, mailboxConfig.TTL), nil
+	case "file":
+		return mailbox.NewFileStore(mailboxConfig.Dir, mailboxConfig.Size, mailboxConfig.TTL)
+	}
+
+	return nil, fmt.Errorf("unknown mailbox mode %v", mailboxConfig.Mode)
+}
+
+func (p *DeviceProxy) newTenantResolver(authenticator server.Authenticator) (server.TenantResolver, error) {
+	tenancy := p.config.Tenancy
+
+	if !tenancy.Enabled() {
+		return nil, nil
+	}
+
+	if _, ok := authenticator.(server.TenantAuthenticator); authenticator != nil && !ok {
+		return nil, fmt.Errorf("authenticator can not bind credentials to tenant")
+	}
+
+	switch tenancy.Source {
+	case "claim":
+		if resolver, ok := authenticator.(server.TenantResolver); ok {
+			return resolver, nil
+		}
+		return nil, fmt.Errorf("authenticator can not resolve tenant claim")
+	case "subdomain":
+		return server.NewSubdomainTenantResolver(tenancy.Domain), nil
+	case "path":
+		return server.NewPathTenantResolver(p.config.Service.Endpoint), nil
+	}
+
+	return nil, fmt.Errorf("unknown tenant source %v", tenancy.Source)
+}
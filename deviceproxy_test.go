@@ -0,0 +1,179 @@
+package deviceproxy_test
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy"
+	"deviceproxy/model"
+	"deviceproxy/queue"
+	"deviceproxy/resources"
+)
+
+// queueRecorder is queue subscriber which passes received messages to the test
+type queueRecorder chan string
+
+func (r queueRecorder) ParseMsg(topic, msg string) error {
+	r <- msg
+	return nil
+}
+
+type DeviceProxyTestSuite struct {
+	suite.Suite
+
+	proxy    *deviceproxy.DeviceProxy
+	msgQueue *queue.MemoryQueue
+	url      string
+	stopped  chan error
+}
+
+func TestExecuteDeviceProxyTestSuite(t *testing.T) {
+	suite.Run(t, new(DeviceProxyTestSuite))
+}
+
+func (suite *DeviceProxyTestSuite) SetupTest() {
+	listener, err := net.Listen("tcp", "localhost:0")
+	suite.Require().Nil(err)
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	config := resources.DefaultConfig()
+	config.Queue.Mode = "memory"
+	config.Service.Port = port
+	config.Mailbox.Mode = "memory"
+	config.Connection.SendQueueSize = 8
+
+	suite.msgQueue = queue.NewMemoryQueue(10 * time.Millisecond)
+	suite.proxy = deviceproxy.NewDeviceProxy(config)
+	suite.proxy.MsgQueue = suite.msgQueue
+	suite.url = "ws://localhost:" + port + config.Service.Endpoint
+
+	suite.stopped = make(chan error, 1)
+	go func() {
+		suite.stopped <- suite.proxy.Run()
+	}()
+}
+
+func (suite *DeviceProxyTestSuite) TearDownTest() {
+	suite.Nil(suite.proxy.Shutdown())
+	suite.Nil(<-suite.stopped)
+}
+
+func (suite *DeviceProxyTestSuite) Test_MessagesFlowBetweenDeviceAndMemoryQueue() {
+	published := make(queueRecorder, 1)
+	suite.Nil(suite.msgQueue.AddSubscription("cloud.msg.device", published, true))
+
+	device := suite.connect("device")
+	defer device.Close()
+
+	suite.Nil(device.WriteMessage(websocket.TextMessage, []byte(`{"temperature":21}`)))
+	suite.expectResponse(device, model.CodeSuccess)
+
+	select {
+	case msg := <-published:
+		envelope := model.Envelope{}
+		suite.Nil(json.Unmarshal([]byte(msg), &envelope))
+		suite.Equal("device", envelope.DeviceTag)
+		suite.Equal(`{"temperature":21}`, envelope.Payload)
+	case <-time.After(time.Second):
+		suite.Fail("message of device was not published")
+	}
+
+	suite.Nil(suite.msgQueue.PublishMessage("edge.msg.device", "hello device"))
+
+	device.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := device.ReadMessage()
+	suite.Nil(err)
+	suite.Equal("hello device", string(msg))
+}
+
+func (suite *DeviceProxyTestSuite) Test_MailboxLargerThanSendQueueIsReplayedInOrder() {
+	device := suite.connect("device")
+	suite.Nil(device.Close())
+	time.Sleep(100 * time.Millisecond) // NOTE: gives proxy a time to notice the device is gone
+
+	for i := 0; i < 100; i++ {
+		suite.Nil(suite.msgQueue.PublishMessage("edge.msg.device", "m"+strconv.Itoa(i)))
+	}
+	time.Sleep(100 * time.Millisecond) // NOTE: gives proxy a time to store the messages in the mailbox
+
+	device = suite.connect("device")
+	defer device.Close()
+
+	for i := 0; i < 100; i++ {
+		device.SetReadDeadline(time.Now().Add(time.Second))
+		_, msg, err := device.ReadMessage()
+		suite.Require().Nil(err)
+		suite.Require().Equal("m"+strconv.Itoa(i), string(msg))
+	}
+}
+
+// connect retries until the proxy started in SetupTest accepts connections
+func (suite *DeviceProxyTestSuite) connect(deviceTag string) *websocket.Conn {
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		device, _, err := websocket.DefaultDialer.Dial(suite.url+"?deviceTag="+deviceTag, nil)
+		if err == nil {
+			suite.expectResponse(device, model.CodeSuccess)
+			return device
+		}
+
+		suite.Require().True(time.Now().Before(deadline), "proxy is not accepting connections: %v", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (suite *DeviceProxyTestSuite) expectResponse(device *websocket.Conn, code int) {
+	responseMsg := model.ResponseMsg{}
+	suite.Nil(device.ReadJSON(&responseMsg))
+	suite.Equal(code, responseMsg.Code)
+}
+
+func TestShutdownDoesNotWaitForQueueConnection(t *testing.T) {
+	broker, err := net.Listen("tcp", "localhost:0")
+	require.Nil(t, err)
+	defer broker.Close()
+	go func() {
+		for {
+			conn, err := broker.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // NOTE: broker never answers, so connecting to it takes until client timeout
+		}
+	}()
+
+	config := resources.DefaultConfig()
+	config.Queue.Mode = "nats"
+	config.NATS.URL = "nats://" + broker.Addr().String()
+	proxy := deviceproxy.NewDeviceProxy(config)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- proxy.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- proxy.Shutdown()
+	}()
+
+	select {
+	case err := <-shutdown:
+		assert.Nil(t, err)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "shutdown waited for queue connection")
+	}
+
+	assert.Nil(t, <-stopped)
+}
@@ -3,14 +3,15 @@ module deviceproxy
 go 1.12
 
 require (
-	git.krk.awesome-ind.com/GoUtils/QueueWrapper v0.0.0-20200128081528-31d2baafa1e1
 	github.com/bxcodec/faker v2.0.1+incompatible
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gorilla/websocket v1.4.2
-	github.com/nats-io/gnatsd v1.4.1 // indirect
-	github.com/nats-io/go-nats v1.7.2 // indirect
-	github.com/nats-io/go-nats-streaming v0.4.4
-	github.com/nats-io/nats-server v1.4.1 // indirect
-	github.com/nats-io/nats-streaming-server v0.17.0 // indirect
+	github.com/nats-io/nats-server/v2 v2.1.4
+	github.com/nats-io/nats-streaming-server v0.17.0
+	github.com/nats-io/nats.go v1.9.1
+	github.com/nats-io/stan.go v0.6.0
+	github.com/prometheus/client_golang v1.5.1
 	github.com/satori/go.uuid v1.2.0
 	github.com/stretchr/testify v1.5.1
+	gopkg.in/yaml.v2 v2.2.5
 )
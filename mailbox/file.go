@@ -0,0 +1,234 @@
+package mailbox
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore keeps messages in append-only files, one per device, so they survive restarts of the service
+type FileStore struct {
+	dir     string
+	maxSize int
+	ttl     time.Duration
+	counts  map[string]int // number of records in the file of device, loaded lazily
+	mutex   sync.Mutex
+}
+
+// NewFileStore ...
+func NewFileStore(dir string, maxSize int, ttl time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not create mailbox directory %v: %v", dir, err)
+	}
+
+	return &FileStore{
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+		counts:  map[string]int{},
+	}, nil
+}
+
+// Put ...
+func (s *FileStore) Put(deviceTag string, payload string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count, err := s.count(deviceTag)
+	if err != nil {
+		return err
+	}
+
+	if s.maxSize > 0 && count >= s.maxSize {
+		if count, err = s.compact(deviceTag, s.maxSize-1); err != nil {
+			return err
+		}
+	}
+
+	record, err := json.Marshal(Message{Payload: payload, StoredAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path(deviceTag), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(record, '\n')); err != nil {
+		return err
+	}
+
+	s.counts[deviceTag] = count + 1
+
+	return nil
+}
+
+// Drain ...
+func (s *FileStore) Drain(deviceTag string) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages, err := s.read(deviceTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Remove(s.path(deviceTag)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	delete(s.counts, deviceTag)
+
+	return fresh(messages, s.ttl, s.maxSize, time.Now()), nil
+}
+
+// Peek ...
+func (s *FileStore) Peek(deviceTag string, limit int) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages, err := s.read(deviceTag)
+	if err != nil {
+		return nil, err
+	}
+
+	return oldest(fresh(messages, s.ttl, s.maxSize, time.Now()), limit), nil
+}
+
+// Remove ...
+func (s *FileStore) Remove(deviceTag string, delivered []Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages, err := s.read(deviceTag)
+	if err != nil {
+		return err
+	}
+
+	messages = fresh(without(messages, delivered), s.ttl, s.maxSize, time.Now())
+
+	if len(messages) == 0 {
+		delete(s.counts, deviceTag)
+
+		if err = os.Remove(s.path(deviceTag)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	return s.rewrite(deviceTag, messages)
+}
+
+// Close ...
+func (s *FileStore) Close() error {
+	return nil
+}
+
+func (s *FileStore) count(deviceTag string) (int, error) {
+	if count, ok := s.counts[deviceTag]; ok {
+		return count, nil
+	}
+
+	messages, err := s.read(deviceTag)
+	if err != nil {
+		return 0, err
+	}
+
+	s.counts[deviceTag] = len(messages)
+
+	return len(messages), nil
+}
+
+// compact rewrites file of the device keeping at most limit fresh messages
+func (s *FileStore) compact(deviceTag string, limit int) (int, error) {
+	messages, err := s.read(deviceTag)
+	if err != nil {
+		return 0, err
+	}
+
+	messages = fresh(messages, s.ttl, limit, time.Now())
+
+	if err = s.rewrite(deviceTag, messages); err != nil {
+		return 0, err
+	}
+
+	return len(messages), nil
+}
+
+// rewrite replaces file of the device with messages
+func (s *FileStore) rewrite(deviceTag string, messages []Message) error {
+	tmp, err := ioutil.TempFile(s.dir, ".compact")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+
+	for _, msg := range messages {
+		if err = encoder.Encode(msg); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), s.path(deviceTag)); err != nil {
+		return err
+	}
+
+	s.counts[deviceTag] = len(messages)
+
+	return nil
+}
+
+func (s *FileStore) read(deviceTag string) ([]Message, error) {
+	file, err := os.Open(s.path(deviceTag))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	messages := []Message{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for scanner.Scan() {
+		msg := Message{}
+
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf(logPrefix+"Skipping corrupted record in mailbox of device %v: %v\n", deviceTag, err)
+			continue
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, scanner.Err()
+}
+
+func (s *FileStore) path(deviceTag string) string {
+	return filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(deviceTag))+".log")
+}
@@ -0,0 +1,88 @@
+package mailbox
+
+import (
+	"time"
+)
+
+const (
+	logPrefix = "DeviceProxyMailbox "
+)
+
+// Message is a message stored for a device which was offline when it arrived
+type Message struct {
+	Payload  string    `json:"payload"`
+	StoredAt time.Time `json:"storedAt"`
+}
+
+// Store keeps undelivered messages per device tag.
+// Stores hold at most maxSize messages per device, the oldest are dropped first, and forget messages older than ttl.
+type Store interface {
+	// Put appends message to mailbox of the device
+	Put(deviceTag string, payload string) error
+	// Drain removes and returns messages of the device which have not expired, oldest first
+	Drain(deviceTag string) ([]Message, error)
+	// Peek returns up to limit oldest messages of the device which have not expired without removing them
+	Peek(deviceTag string, limit int) ([]Message, error)
+	// Remove deletes messages returned by Peek once they have been delivered, messages which have been dropped
+	// from the mailbox in the meantime are skipped
+	Remove(deviceTag string, delivered []Message) error
+	// Close releases resources held by the store
+	Close() error
+}
+
+func expired(msg Message, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(msg.StoredAt) >= ttl
+}
+
+// fresh filters out expired messages and keeps at most limit newest ones
+func fresh(messages []Message, ttl time.Duration, limit int, now time.Time) []Message {
+	result := make([]Message, 0, len(messages))
+
+	for _, msg := range messages {
+		if !expired(msg, ttl, now) {
+			result = append(result, msg)
+		}
+	}
+
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+
+	return result
+}
+
+// oldest returns at most limit first messages, all of them when limit is not positive
+func oldest(messages []Message, limit int) []Message {
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+
+	return append([]Message{}, messages...)
+}
+
+type messageKey struct {
+	storedAt int64
+	payload  string
+}
+
+// without returns messages except the delivered ones
+func without(messages, delivered []Message) []Message {
+	removed := map[messageKey]int{}
+	for _, msg := range delivered {
+		removed[messageKey{msg.StoredAt.UnixNano(), msg.Payload}]++
+	}
+
+	result := make([]Message, 0, len(messages))
+
+	for _, msg := range messages {
+		key := messageKey{msg.StoredAt.UnixNano(), msg.Payload}
+		if removed[key] > 0 {
+			removed[key]--
+			continue
+		}
+
+		result = append(result, msg)
+	}
+
+	return result
+}
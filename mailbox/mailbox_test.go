@@ -0,0 +1,110 @@
+package mailbox_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/mailbox"
+)
+
+type MailboxTestSuite struct {
+	suite.Suite
+
+	dir      string
+	newStore func(maxSize int, ttl time.Duration) mailbox.Store
+}
+
+func TestExecuteMemoryMailboxTestSuite(t *testing.T) {
+	suite.Run(t, &MailboxTestSuite{
+		newStore: func(maxSize int, ttl time.Duration) mailbox.Store {
+			return mailbox.NewMemoryStore(maxSize, ttl)
+		},
+	})
+}
+
+func TestExecuteFileMailboxTestSuite(t *testing.T) {
+	fileSuite := &MailboxTestSuite{}
+	fileSuite.newStore = func(maxSize int, ttl time.Duration) mailbox.Store {
+		store, err := mailbox.NewFileStore(fileSuite.dir, maxSize, ttl)
+		fileSuite.Require().Nil(err)
+		return store
+	}
+
+	suite.Run(t, fileSuite)
+}
+
+func (suite *MailboxTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "deviceproxy-mailbox")
+	suite.Require().Nil(err)
+	suite.dir = dir
+}
+
+func (suite *MailboxTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *MailboxTestSuite) Test_MessagesAreDrainedInOrder() {
+	store := suite.newStore(10, time.Hour)
+
+	suite.Nil(store.Put("device1", "msg1"))
+	suite.Nil(store.Put("device2", "other"))
+	suite.Nil(store.Put("device1", "msg2"))
+
+	suite.Equal([]string{"msg1", "msg2"}, drain(suite, store, "device1"))
+	suite.Empty(drain(suite, store, "device1"))
+	suite.Equal([]string{"other"}, drain(suite, store, "device2"))
+}
+
+func (suite *MailboxTestSuite) Test_OldestMessagesAreDroppedWhenMailboxIsFull() {
+	store := suite.newStore(2, time.Hour)
+
+	suite.Nil(store.Put("device1", "msg1"))
+	suite.Nil(store.Put("device1", "msg2"))
+	suite.Nil(store.Put("device1", "msg3"))
+
+	suite.Equal([]string{"msg2", "msg3"}, drain(suite, store, "device1"))
+}
+
+func (suite *MailboxTestSuite) Test_ExpiredMessagesAreNotDelivered() {
+	store := suite.newStore(10, 20*time.Millisecond)
+
+	suite.Nil(store.Put("device1", "msg1"))
+	time.Sleep(30 * time.Millisecond)
+	suite.Nil(store.Put("device1", "msg2"))
+
+	suite.Equal([]string{"msg2"}, drain(suite, store, "device1"))
+}
+
+func (suite *MailboxTestSuite) Test_OnlyDeliveredMessagesAreRemoved() {
+	store := suite.newStore(10, time.Hour)
+
+	suite.Nil(store.Put("device1", "msg1"))
+	suite.Nil(store.Put("device1", "msg2"))
+	suite.Nil(store.Put("device1", "msg3"))
+
+	peeked, err := store.Peek("device1", 2)
+	suite.Require().Nil(err)
+	suite.Require().Len(peeked, 2)
+	suite.Equal("msg1", peeked[0].Payload)
+
+	suite.Nil(store.Put("device1", "msg4"))
+	suite.Nil(store.Remove("device1", peeked[:1]))
+
+	suite.Equal([]string{"msg2", "msg3", "msg4"}, drain(suite, store, "device1"))
+}
+
+func drain(suite *MailboxTestSuite, store mailbox.Store, deviceTag string) []string {
+	messages, err := store.Drain(deviceTag)
+	suite.Nil(err)
+
+	payloads := []string{}
+	for _, msg := range messages {
+		payloads = append(payloads, msg.Payload)
+	}
+
+	return payloads
+}
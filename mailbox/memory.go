@@ -0,0 +1,77 @@
+package mailbox
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps messages in memory, they are lost when the service is restarted
+type MemoryStore struct {
+	maxSize  int
+	ttl      time.Duration
+	messages map[string][]Message
+	mutex    sync.Mutex
+}
+
+// NewMemoryStore ...
+func NewMemoryStore(maxSize int, ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		maxSize:  maxSize,
+		ttl:      ttl,
+		messages: map[string][]Message{},
+	}
+}
+
+// Put ...
+func (s *MemoryStore) Put(deviceTag string, payload string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	messages := append(s.messages[deviceTag], Message{Payload: payload, StoredAt: now})
+
+	s.messages[deviceTag] = fresh(messages, s.ttl, s.maxSize, now)
+
+	return nil
+}
+
+// Drain ...
+func (s *MemoryStore) Drain(deviceTag string) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := fresh(s.messages[deviceTag], s.ttl, s.maxSize, time.Now())
+	delete(s.messages, deviceTag)
+
+	return messages, nil
+}
+
+// Peek ...
+func (s *MemoryStore) Peek(deviceTag string, limit int) ([]Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return oldest(fresh(s.messages[deviceTag], s.ttl, s.maxSize, time.Now()), limit), nil
+}
+
+// Remove ...
+func (s *MemoryStore) Remove(deviceTag string, delivered []Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := without(s.messages[deviceTag], delivered)
+
+	if len(messages) == 0 {
+		delete(s.messages, deviceTag)
+		return nil
+	}
+
+	s.messages[deviceTag] = messages
+
+	return nil
+}
+
+// Close ...
+func (s *MemoryStore) Close() error {
+	return nil
+}
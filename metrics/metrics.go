@@ -0,0 +1,277 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "deviceproxy"
+
+const (
+	maxConnections      = 5
+	maxConnectionsLabel = "5+"
+)
+
+// Results of websocket upgrade attempts
+const (
+	UpgradeAccepted          = "accepted"
+	UpgradeRejectedAuth      = "unauthorized"
+	UpgradeRejectedNoTag     = "missing_device_tag"
+	UpgradeRejectedBadTag    = "invalid_device_tag"
+	UpgradeRejectedHandshake = "handshake_error"
+	UpgradeRejectedDraining  = "draining"
+	UpgradeRejectedTenant    = "unknown_tenant"
+	UpgradeRejectedQuota     = "tenant_quota_exceeded"
+	UpgradeRejectedOrigin    = "forbidden_origin"
+)
+
+// Limits devices can exceed
+const (
+	LimitMessageSize    = "message_size"
+	LimitConnectionRate = "connection_rate"
+	LimitDeviceRate     = "device_rate"
+)
+
+// Metrics keeps prometheus collectors of a single proxy in its own registry.
+// All methods can be called on nil *Metrics which makes metrics optional for server and API.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	upgrades         *prometheus.CounterVec
+	connections      prometheus.Gauge
+	connectedDevices prometheus.Gauge
+	deviceConns      *prometheus.GaugeVec
+	messagesIn       prometheus.Counter
+	messagesOut      prometheus.Counter
+	publishFailures  prometheus.Counter
+	sendFailures     prometheus.Counter
+	writeDuration    prometheus.Histogram
+	compressedBytes  *prometheus.CounterVec
+	compressionRatio prometheus.Histogram
+	limitViolations  *prometheus.CounterVec
+}
+
+// NewMetrics ...
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		upgrades: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upgrades_total",
+			Help:      "Websocket upgrade attempts by result.",
+		}, []string{"result"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_connections",
+			Help:      "Number of open device websocket connections.",
+		}),
+		connectedDevices: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connected_devices",
+			Help:      "Number of device tags with at least one open connection.",
+		}),
+		deviceConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "device_connections",
+			Help:      "Number of device tags by count of their open connections, counts from " + maxConnectionsLabel + " up are summed.",
+		}, []string{"connections"}),
+		messagesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_received_total",
+			Help:      "Messages received from devices.",
+		}),
+		messagesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages written to device connections.",
+		}),
+		publishFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "publish_failures_total",
+			Help:      "Device messages which could not be published to the queue.",
+		}),
+		sendFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "send_failures_total",
+			Help:      "Cloud messages which could not be queued for a device connection.",
+		}),
+		writeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "write_duration_seconds",
+			Help:      "Time of writing a single message to device websocket.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 9),
+		}),
+		compressedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compressed_message_bytes_total",
+			Help:      "Bytes of compressed outbound messages before (payload) and after (wire) compression, frame headers included.",
+		}, []string{"stage"}),
+		compressionRatio: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "compression_ratio",
+			Help:      "Wire size of compressed outbound message divided by its payload size.",
+			Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+		}),
+		limitViolations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "limit_violations_total",
+			Help:      "Inbound messages which exceeded size or rate limit by limit.",
+		}, []string{"limit"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.upgrades,
+		m.connections,
+		m.connectedDevices,
+		m.deviceConns,
+		m.messagesIn,
+		m.messagesOut,
+		m.publishFailures,
+		m.sendFailures,
+		m.writeDuration,
+		m.compressedBytes,
+		m.compressionRatio,
+		m.limitViolations,
+	)
+
+	return m
+}
+
+// Handler serves collected metrics in prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry ...
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// ObserveSubscriptions exposes number of queue subscriptions, count is called on every scrape
+func (m *Metrics) ObserveSubscriptions(count func() int) {
+	if m == nil {
+		return
+	}
+
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_subscriptions",
+		Help:      "Number of queue topics the proxy is subscribed to for connected devices.",
+	}, func() float64 {
+		return float64(count())
+	}))
+}
+
+// ObserveDroppedMessages exposes number of messages dropped because of full outbound queues, count is called on every scrape
+func (m *Metrics) ObserveDroppedMessages(count func() uint64) {
+	if m == nil {
+		return
+	}
+
+	m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_messages_total",
+		Help:      "Outbound messages dropped because connection queue was full.",
+	}, func() float64 {
+		return float64(count())
+	}))
+}
+
+// Upgrade ...
+func (m *Metrics) Upgrade(result string) {
+	if m == nil {
+		return
+	}
+
+	m.upgrades.WithLabelValues(result).Inc()
+}
+
+// ConnectionsChanged updates totals and moves the device which connected or disconnected from the count of its
+// previous connections to the current one
+func (m *Metrics) ConnectionsChanged(connections, devices, previous, current int) {
+	if m == nil {
+		return
+	}
+
+	m.connections.Set(float64(connections))
+	m.connectedDevices.Set(float64(devices))
+
+	if previous > 0 {
+		m.deviceConns.WithLabelValues(connectionsLabel(previous)).Dec()
+	}
+	if current > 0 {
+		m.deviceConns.WithLabelValues(connectionsLabel(current)).Inc()
+	}
+}
+
+// connectionsLabel keeps number of label values small when a device opens many connections
+func connectionsLabel(connections int) string {
+	if connections >= maxConnections {
+		return maxConnectionsLabel
+	}
+
+	return strconv.Itoa(connections)
+}
+
+// MessageReceived ...
+func (m *Metrics) MessageReceived() {
+	if m == nil {
+		return
+	}
+
+	m.messagesIn.Inc()
+}
+
+// MessageSent records successful write of a message which took duration
+func (m *Metrics) MessageSent(duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.messagesOut.Inc()
+	m.writeDuration.Observe(duration.Seconds())
+}
+
+// MessageCompressed records sizes of compressed message before and after compression
+func (m *Metrics) MessageCompressed(payloadBytes, wireBytes int) {
+	if m == nil || payloadBytes == 0 {
+		return
+	}
+
+	m.compressedBytes.WithLabelValues("payload").Add(float64(payloadBytes))
+	m.compressedBytes.WithLabelValues("wire").Add(float64(wireBytes))
+	m.compressionRatio.Observe(float64(wireBytes) / float64(payloadBytes))
+}
+
+// PublishFailed ...
+func (m *Metrics) PublishFailed() {
+	if m == nil {
+		return
+	}
+
+	m.publishFailures.Inc()
+}
+
+// SendFailed ...
+func (m *Metrics) SendFailed() {
+	if m == nil {
+		return
+	}
+
+	m.sendFailures.Inc()
+}
+
+// LimitExceeded records inbound message which exceeded one of the limits
+func (m *Metrics) LimitExceeded(limit string) {
+	if m == nil {
+		return
+	}
+
+	m.limitViolations.WithLabelValues(limit).Inc()
+}
@@ -0,0 +1,113 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/metrics"
+)
+
+type MetricsTestSuite struct {
+	suite.Suite
+
+	metrics *metrics.Metrics
+}
+
+func TestExecuteMetricsTestSuite(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
+
+func (suite *MetricsTestSuite) SetupTest() {
+	suite.metrics = metrics.NewMetrics()
+}
+
+func (suite *MetricsTestSuite) Test_NilMetricsCanBeUsed() {
+	var nilMetrics *metrics.Metrics
+
+	suite.NotPanics(func() {
+		nilMetrics.Upgrade(metrics.UpgradeAccepted)
+		nilMetrics.ConnectionsChanged(1, 1, 0, 1)
+		nilMetrics.MessageReceived()
+		nilMetrics.MessageSent(time.Millisecond)
+		nilMetrics.PublishFailed()
+		nilMetrics.SendFailed()
+		nilMetrics.LimitExceeded(metrics.LimitMessageSize)
+		nilMetrics.ObserveSubscriptions(func() int { return 0 })
+	})
+}
+
+func (suite *MetricsTestSuite) Test_TrafficIsExposed() {
+	suite.metrics.Upgrade(metrics.UpgradeAccepted)
+	suite.metrics.Upgrade(metrics.UpgradeRejectedAuth)
+	suite.metrics.Upgrade(metrics.UpgradeRejectedAuth)
+	suite.metrics.ConnectionsChanged(3, 2, 1, 2)
+	suite.metrics.ObserveSubscriptions(func() int { return 2 })
+
+	expected := `
+# HELP deviceproxy_upgrades_total Websocket upgrade attempts by result.
+# TYPE deviceproxy_upgrades_total counter
+deviceproxy_upgrades_total{result="accepted"} 1
+deviceproxy_upgrades_total{result="unauthorized"} 2
+# HELP deviceproxy_active_connections Number of open device websocket connections.
+# TYPE deviceproxy_active_connections gauge
+deviceproxy_active_connections 3
+# HELP deviceproxy_queue_subscriptions Number of queue topics the proxy is subscribed to for connected devices.
+# TYPE deviceproxy_queue_subscriptions gauge
+deviceproxy_queue_subscriptions 2
+`
+
+	err := testutil.GatherAndCompare(suite.metrics.Registry(), strings.NewReader(expected),
+		"deviceproxy_upgrades_total", "deviceproxy_active_connections", "deviceproxy_queue_subscriptions")
+	suite.Nil(err)
+}
+
+func (suite *MetricsTestSuite) Test_DevicesAreCountedByNumberOfTheirConnections() {
+	connect := func(connections, devices, previous int) {
+		suite.metrics.ConnectionsChanged(connections, devices, previous, previous+1)
+	}
+
+	connect(1, 1, 0) // device a
+	connect(2, 2, 0) // device b
+	connect(3, 2, 1) // device b
+	for previous := 0; previous < 6; previous++ {
+		connect(4+previous, 3, previous) // device c
+	}
+	suite.metrics.ConnectionsChanged(8, 3, 2, 1) // device b
+
+	expected := `
+# HELP deviceproxy_active_connections Number of open device websocket connections.
+# TYPE deviceproxy_active_connections gauge
+deviceproxy_active_connections 8
+# HELP deviceproxy_connected_devices Number of device tags with at least one open connection.
+# TYPE deviceproxy_connected_devices gauge
+deviceproxy_connected_devices 3
+# HELP deviceproxy_device_connections Number of device tags by count of their open connections, counts from 5+ up are summed.
+# TYPE deviceproxy_device_connections gauge
+deviceproxy_device_connections{connections="1"} 2
+deviceproxy_device_connections{connections="2"} 0
+deviceproxy_device_connections{connections="3"} 0
+deviceproxy_device_connections{connections="4"} 0
+deviceproxy_device_connections{connections="5+"} 1
+`
+
+	err := testutil.GatherAndCompare(suite.metrics.Registry(), strings.NewReader(expected),
+		"deviceproxy_active_connections", "deviceproxy_connected_devices", "deviceproxy_device_connections")
+	suite.Nil(err)
+}
+
+func (suite *MetricsTestSuite) Test_WriteLatencyIsServedByHandler() {
+	suite.metrics.MessageSent(2 * time.Millisecond)
+
+	response := httptest.NewRecorder()
+	suite.metrics.Handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	suite.Equal(http.StatusOK, response.Code)
+	suite.Contains(response.Body.String(), "deviceproxy_messages_sent_total 1")
+	suite.Contains(response.Body.String(), "deviceproxy_write_duration_seconds_count 1")
+}
@@ -0,0 +1,75 @@
+package mocks_test
+
+import (
+	"sync"
+
+	mock "github.com/stretchr/testify/mock"
+
+	"deviceproxy/api"
+)
+
+// Broker is a mock type for the api.Broker type. Subscriptions are not mocked, they are kept
+// so tests can deliver messages to subscribed parsers with Deliver.
+type Broker struct {
+	mock.Mock
+
+	parsers map[string]api.MsgParser
+	mutex   sync.Mutex
+}
+
+// NewBroker ...
+func NewBroker() *Broker {
+	return &Broker{parsers: map[string]api.MsgParser{}}
+}
+
+// AddSubscription ...
+func (_m *Broker) AddSubscription(topic string, parser api.MsgParser, durable bool) error {
+	_m.mutex.Lock()
+	defer _m.mutex.Unlock()
+
+	_m.parsers[topic] = parser
+
+	return nil
+}
+
+// RemoveSubscription ...
+func (_m *Broker) RemoveSubscription(topic string) error {
+	_m.mutex.Lock()
+	defer _m.mutex.Unlock()
+
+	delete(_m.parsers, topic)
+
+	return nil
+}
+
+// PublishMessage provides a mock function with given fields: topic, msg
+func (_m *Broker) PublishMessage(topic string, msg string) error {
+	ret := _m.Called(topic, msg)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string) error); ok {
+		r0 = rf(topic, msg)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ShutDown provides a mock function with given fields:
+func (_m *Broker) ShutDown() {
+	_m.Called()
+}
+
+// Deliver hands message to parser subscribed to the topic, it is dropped when there is no subscription
+func (_m *Broker) Deliver(topic string, msg string) error {
+	_m.mutex.Lock()
+	parser, ok := _m.parsers[topic]
+	_m.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return parser.ParseMsg(topic, msg)
+}
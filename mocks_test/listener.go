@@ -9,13 +9,27 @@ type Listener struct {
 	mock.Mock
 }
 
-// OnClientDisconnected provides a mock function with given fields: connectionID, deviceTag
-func (_m *Listener) OnClientDisconnected(connectionID string, deviceTag *string) error {
-	ret := _m.Called(connectionID, deviceTag)
+// OnBinaryMessageReceivedFromClient provides a mock function with given fields: connectionID, msg, deviceTag
+func (_m *Listener) OnBinaryMessageReceivedFromClient(connectionID string, msg []byte, deviceTag *string) error {
+	ret := _m.Called(connectionID, msg, deviceTag)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, []byte, *string) error); ok {
+		r0 = rf(connectionID, msg, deviceTag)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// OnClientDisconnected provides a mock function with given fields: connectionID, deviceTag, reason
+func (_m *Listener) OnClientDisconnected(connectionID string, deviceTag *string, reason string) error {
+	ret := _m.Called(connectionID, deviceTag, reason)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, *string) error); ok {
-		r0 = rf(connectionID, deviceTag)
+	if rf, ok := ret.Get(0).(func(string, *string, string) error); ok {
+		r0 = rf(connectionID, deviceTag, reason)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -23,13 +37,13 @@ func (_m *Listener) OnClientDisconnected(connectionID string, deviceTag *string)
 	return r0
 }
 
-// OnConnectionEstabilishedFromClient provides a mock function with given fields: connectionID, deviceTag
-func (_m *Listener) OnConnectionEstabilishedFromClient(connectionID string, deviceTag *string) error {
-	ret := _m.Called(connectionID, deviceTag)
+// OnConnectionEstabilishedFromClient provides a mock function with given fields: connectionID, deviceTag, remoteAddr
+func (_m *Listener) OnConnectionEstabilishedFromClient(connectionID string, deviceTag *string, remoteAddr string) error {
+	ret := _m.Called(connectionID, deviceTag, remoteAddr)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, *string) error); ok {
-		r0 = rf(connectionID, deviceTag)
+	if rf, ok := ret.Get(0).(func(string, *string, string) error); ok {
+		r0 = rf(connectionID, deviceTag, remoteAddr)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -9,6 +9,20 @@ type MessageSender struct {
 	mock.Mock
 }
 
+// SendBinaryMsg provides a mock function with given fields: msg, deviceTag
+func (_m *MessageSender) SendBinaryMsg(msg []byte, deviceTag string) error {
+	ret := _m.Called(msg, deviceTag)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func([]byte, string) error); ok {
+		r0 = rf(msg, deviceTag)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SendMsg provides a mock function with given fields: msg, deviceTag
 func (_m *MessageSender) SendMsg(msg string, deviceTag string) error {
 	ret := _m.Called(msg, deviceTag)
@@ -1,7 +1,207 @@
 package model
 
+import (
+	"strings"
+	"time"
+)
+
+// Codes sent to clients in ResponseMsg
+const (
+	// CodeSuccess ...
+	CodeSuccess = 0
+	// CodeError ...
+	CodeError = -1
+	// CodeUnauthorized is sent when client could not be authenticated as the device it claims to be
+	CodeUnauthorized = -2
+	// CodeQueueUnavailable is sent when message can not be published because the proxy lost connection to the queue, it can be retried later
+	CodeQueueUnavailable = -3
+	// CodeRateLimited is sent when message exceeds rate limit of the connection or device and was not sent to platform
+	CodeRateLimited = -4
+)
+
+// TenantSeparator separates tenant from device tag in scoped device tags
+const TenantSeparator = "/"
+
+// ScopeDeviceTag qualifies device tag with tenant so devices of different tenants with the same tag do not collide.
+// Device tag is returned unchanged when tenant is empty.
+func ScopeDeviceTag(tenant, deviceTag string) string {
+	if tenant == "" {
+		return deviceTag
+	}
+
+	return tenant + TenantSeparator + deviceTag
+}
+
+// SplitScopedDeviceTag reverses ScopeDeviceTag, tenant can not contain TenantSeparator so the device tag may contain
+// it and only the first separator splits
+func SplitScopedDeviceTag(scopedDeviceTag string) (tenant, deviceTag string) {
+	parts := strings.SplitN(scopedDeviceTag, TenantSeparator, 2)
+	if len(parts) < 2 {
+		return "", scopedDeviceTag
+	}
+
+	return parts[0], parts[1]
+}
+
 // ResponseMsg ...
 type ResponseMsg struct {
 	Code    int    `json:"code" bson:"code"`
 	Message string `json:"message" bson:"message"`
 }
+
+// Error lets listener return ResponseMsg with its own code instead of generic CodeError
+func (r ResponseMsg) Error() string {
+	return r.Message
+}
+
+// DeliveryMsg wraps message sent to device which has to be acknowledged with DeliveryAck
+type DeliveryMsg struct {
+	ID      string `json:"id" bson:"id"`
+	Payload string `json:"payload" bson:"payload"`
+}
+
+// DeliveryAck is sent by device after it processed DeliveryMsg, OK set to false rejects the message
+type DeliveryAck struct {
+	ID     string `json:"id" bson:"id"`
+	OK     bool   `json:"ok" bson:"ok"`
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+// DeviceFrame is a control frame device sends instead of a regular message
+type DeviceFrame struct {
+	Ack         *DeliveryAck `json:"ack,omitempty" bson:"ack,omitempty"`
+	RPCResponse *RPCResponse `json:"rpcResponse,omitempty" bson:"rpcResponse,omitempty"`
+}
+
+// ProxyFrame is a control frame sent to device
+type ProxyFrame struct {
+	RPC *RPCCall `json:"rpc,omitempty" bson:"rpc,omitempty"`
+}
+
+// RPCRequest is published by the platform on RPC request topic of the device.
+// Response of the device is published to ReplyTo topic.
+type RPCRequest struct {
+	CorrelationID string `json:"correlationId" bson:"correlationId"`
+	ReplyTo       string `json:"replyTo" bson:"replyTo"`
+	Payload       string `json:"payload" bson:"payload"`
+	TimeoutMillis int64  `json:"timeoutMillis,omitempty" bson:"timeoutMillis,omitempty"`
+}
+
+// RPCCall is RPCRequest forwarded to device
+type RPCCall struct {
+	CorrelationID string `json:"correlationId" bson:"correlationId"`
+	Payload       string `json:"payload" bson:"payload"`
+}
+
+// RPCResponse is sent by device as answer to RPCCall and published to ReplyTo topic of the request.
+// Error is set when device failed to handle the call or did not answer in time.
+type RPCResponse struct {
+	CorrelationID string `json:"correlationId" bson:"correlationId"`
+	DeviceTag     string `json:"deviceTag,omitempty" bson:"deviceTag,omitempty"`
+	Payload       string `json:"payload,omitempty" bson:"payload,omitempty"`
+	Error         string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// Statuses of AckEvent
+const (
+	AckStatusAck  = "ack"
+	AckStatusNack = "nack"
+)
+
+// AckEvent is published to the queue when device acknowledges or fails to acknowledge DeliveryMsg
+type AckEvent struct {
+	ID        string    `json:"id" bson:"id"`
+	Tenant    string    `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	DeviceTag string    `json:"deviceTag" bson:"deviceTag"`
+	Status    string    `json:"status" bson:"status"`
+	Reason    string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// EnvelopeVersion is version of Envelope format published to the queue
+const EnvelopeVersion = 1
+
+// Content types of Envelope payload
+const (
+	ContentTypeJSON   = "application/json"
+	ContentTypeText   = "text/plain"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// Envelope wraps message received from device with metadata when it is published to the queue.
+// Payload of binary frame has ContentTypeBinary and is base64 encoded. Headers are taken from the upgrade request
+// of the connection, see DeliveryConfig.EnvelopeHeaders.
+type Envelope struct {
+	Version      int               `json:"version" bson:"version"`
+	ID           string            `json:"id" bson:"id"`
+	Tenant       string            `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	DeviceTag    string            `json:"deviceTag" bson:"deviceTag"`
+	ConnectionID string            `json:"connectionId" bson:"connectionId"`
+	ReceivedAt   time.Time         `json:"receivedAt" bson:"receivedAt"`
+	ContentType  string            `json:"contentType" bson:"contentType"`
+	Headers      map[string]string `json:"headers,omitempty" bson:"headers,omitempty"`
+	Payload      string            `json:"payload" bson:"payload"`
+}
+
+// BinaryMsg is published by the platform on event topic of the device to have the payload delivered as binary frame,
+// proxy publishes binary frames of the device in the same form when envelope is disabled by raw payloads
+type BinaryMsg struct {
+	Binary []byte `json:"$binary" bson:"$binary"`
+}
+
+// Statuses of PresenceEvent
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// PresenceEvent is published whenever a connection of the device is opened or closed.
+// Status is offline when the last connection of the device has been closed.
+type PresenceEvent struct {
+	Status          string    `json:"status" bson:"status"`
+	Tenant          string    `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	DeviceTag       string    `json:"deviceTag" bson:"deviceTag"`
+	ConnectionID    string    `json:"connectionId" bson:"connectionId"`
+	RemoteAddr      string    `json:"remoteAddr" bson:"remoteAddr"`
+	Timestamp       time.Time `json:"timestamp" bson:"timestamp"`
+	Reason          string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	ConnectionCount int       `json:"connectionCount" bson:"connectionCount"`
+}
+
+// Kinds of RegistryEvent
+const (
+	// RegistryOnline is sent when the first connection of the device is opened on the instance
+	RegistryOnline = "online"
+	// RegistryOffline is sent when the last connection of the device on the instance is closed
+	RegistryOffline = "offline"
+	// RegistryHello is sent by starting instance, other instances answer with online events of their devices
+	RegistryHello = "hello"
+	// RegistryBye is sent by stopping instance, its devices are removed from the registry
+	RegistryBye = "bye"
+)
+
+// RegistryEvent is exchanged between proxy instances to share which instance holds which device.
+// DeviceTag is scoped with tenant when tenancy is enabled.
+type RegistryEvent struct {
+	Kind      string `json:"kind" bson:"kind"`
+	Instance  string `json:"instance" bson:"instance"`
+	DeviceTag string `json:"deviceTag,omitempty" bson:"deviceTag,omitempty"`
+}
+
+// ForwardedMsg carries message for device from instance which received it to instance holding the device
+type ForwardedMsg struct {
+	DeviceTag string `json:"deviceTag" bson:"deviceTag"`
+	Payload   string `json:"payload" bson:"payload"`
+}
+
+// ConnectionInfo describes live websocket connection of a device
+type ConnectionInfo struct {
+	ConnectionID    string    `json:"connectionId" bson:"connectionId"`
+	Tenant          string    `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	DeviceTag       string    `json:"deviceTag" bson:"deviceTag"`
+	RemoteAddr      string    `json:"remoteAddr" bson:"remoteAddr"`
+	ConnectedAt     time.Time `json:"connectedAt" bson:"connectedAt"`
+	MessagesIn      uint64    `json:"messagesIn" bson:"messagesIn"`
+	MessagesOut     uint64    `json:"messagesOut" bson:"messagesOut"`
+	DroppedMessages uint64    `json:"droppedMessages" bson:"droppedMessages"`
+}
@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"deviceproxy/api"
+)
+
+const (
+	logPrefix = "DeviceProxyQueue "
+	// memorySubscriptionSize is the number of messages waiting for delivery per subscription
+	memorySubscriptionSize = 1024
+)
+
+// ErrQueueShutDown is returned by queue which has been shut down
+var ErrQueueShutDown = errors.New(logPrefix + "Queue has been shut down")
+
+// MemoryQueue is in-process api.Broker for local development and tests, no broker is needed.
+// Every subscription delivers its messages in order from its own goroutine and a message the parser
+// returns error for is redelivered after redelivery delay until it is parsed or the subscription is removed.
+// Messages published to topics without subscription are discarded.
+type MemoryQueue struct {
+	redeliveryDelay time.Duration
+	subscriptions   map[string]*memorySubscription
+	shutDown        bool
+	mutex           sync.Mutex
+}
+
+type memorySubscription struct {
+	topic    string
+	parser   api.MsgParser
+	messages chan string
+	closed   chan struct{}
+}
+
+// NewMemoryQueue ...
+func NewMemoryQueue(redeliveryDelay time.Duration) *MemoryQueue {
+	return &MemoryQueue{
+		redeliveryDelay: redeliveryDelay,
+		subscriptions:   map[string]*memorySubscription{},
+	}
+}
+
+// AddSubscription delivers messages published to the topic to the parser, durable flag is ignored
+func (q *MemoryQueue) AddSubscription(topic string, parser api.MsgParser, durable bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.shutDown {
+		return ErrQueueShutDown
+	}
+
+	if _, ok := q.subscriptions[topic]; ok {
+		return fmt.Errorf(logPrefix+"Already subscribed to topic %v", topic)
+	}
+
+	subscription := &memorySubscription{
+		topic:    topic,
+		parser:   parser,
+		messages: make(chan string, memorySubscriptionSize),
+		closed:   make(chan struct{}),
+	}
+
+	q.subscriptions[topic] = subscription
+	go subscription.deliver(q.redeliveryDelay)
+
+	return nil
+}
+
+// RemoveSubscription stops delivery of the topic, undelivered messages are discarded
+func (q *MemoryQueue) RemoveSubscription(topic string) error {
+	q.mutex.Lock()
+	subscription, ok := q.subscriptions[topic]
+	delete(q.subscriptions, topic)
+	q.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf(logPrefix+"Not subscribed to topic %v", topic)
+	}
+
+	subscription.close()
+
+	return nil
+}
+
+// PublishMessage ...
+func (q *MemoryQueue) PublishMessage(topic, msg string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.shutDown {
+		return ErrQueueShutDown
+	}
+
+	subscription, ok := q.subscriptions[topic]
+	if !ok {
+		log.Printf(logPrefix+"No subscription for topic %v, message discarded\n", topic)
+		return nil
+	}
+
+	select {
+	case subscription.messages <- msg:
+		return nil
+	default:
+		return fmt.Errorf(logPrefix+"Subscription of topic %v is full", topic)
+	}
+}
+
+// ShutDown removes all subscriptions, queue can not be used afterwards
+func (q *MemoryQueue) ShutDown() {
+	q.mutex.Lock()
+	subscriptions := q.subscriptions
+	q.subscriptions = map[string]*memorySubscription{}
+	q.shutDown = true
+	q.mutex.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.close()
+	}
+}
+
+func (s *memorySubscription) deliver(redeliveryDelay time.Duration) {
+	for {
+		select {
+		case msg := <-s.messages:
+			if !s.parse(msg, redeliveryDelay) {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// parse hands message to the parser until it succeeds, false is returned when subscription is closed in the meantime
+func (s *memorySubscription) parse(msg string, redeliveryDelay time.Duration) bool {
+	for {
+		err := s.parser.ParseMsg(s.topic, msg)
+		if err == nil {
+			return true
+		}
+
+		log.Printf(logPrefix+"Redelivering message of topic %v in %v, parser returned error: %v\n", s.topic, redeliveryDelay, err)
+
+		select {
+		case <-time.After(redeliveryDelay):
+		case <-s.closed:
+			return false
+		}
+	}
+}
+
+// close stops delivery. It does not wait for message being parsed because parsers may remove subscriptions
+// themselves, like NATS the parser can be called once more after its subscription has been removed.
+func (s *memorySubscription) close() {
+	close(s.closed)
+}
@@ -0,0 +1,103 @@
+package queue_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/queue"
+)
+
+// parserFunc adapts function to api.MsgParser
+type parserFunc func(topic, msg string) error
+
+func (f parserFunc) ParseMsg(topic, msg string) error {
+	return f(topic, msg)
+}
+
+type MemoryQueueTestSuite struct {
+	suite.Suite
+
+	queue    *queue.MemoryQueue
+	received chan string
+}
+
+func TestExecuteMemoryQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(MemoryQueueTestSuite))
+}
+
+func (suite *MemoryQueueTestSuite) SetupTest() {
+	suite.queue = queue.NewMemoryQueue(10 * time.Millisecond)
+	suite.received = make(chan string, 10)
+}
+
+func (suite *MemoryQueueTestSuite) TearDownTest() {
+	suite.queue.ShutDown()
+}
+
+func (suite *MemoryQueueTestSuite) parser(failures int) parserFunc {
+	return func(topic, msg string) error {
+		if failures > 0 {
+			failures--
+			return errors.New("not now")
+		}
+
+		suite.received <- topic + ":" + msg
+		return nil
+	}
+}
+
+func (suite *MemoryQueueTestSuite) expectReceived(expected ...string) {
+	for _, e := range expected {
+		select {
+		case msg := <-suite.received:
+			suite.Equal(e, msg)
+		case <-time.After(time.Second):
+			suite.Fail("message not delivered", e)
+		}
+	}
+}
+
+func (suite *MemoryQueueTestSuite) Test_MessagesAreDeliveredInOrderToSubscribedTopic() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+	suite.NotNil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+	suite.Nil(suite.queue.PublishMessage("other", "lost"))
+	suite.Nil(suite.queue.PublishMessage("topic", "2"))
+
+	suite.expectReceived("topic:1", "topic:2")
+}
+
+func (suite *MemoryQueueTestSuite) Test_MessageIsRedeliveredWhenParserFails() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(2), true))
+
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+	suite.Nil(suite.queue.PublishMessage("topic", "2"))
+
+	suite.expectReceived("topic:1", "topic:2")
+}
+
+func (suite *MemoryQueueTestSuite) Test_RemovedSubscriptionDoesNotGetMessages() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+	suite.Nil(suite.queue.RemoveSubscription("topic"))
+	suite.NotNil(suite.queue.RemoveSubscription("topic"))
+
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+
+	select {
+	case msg := <-suite.received:
+		suite.Fail("unexpected delivery", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (suite *MemoryQueueTestSuite) Test_QueueCanNotBeUsedAfterShutDown() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+	suite.queue.ShutDown()
+
+	suite.Equal(queue.ErrQueueShutDown, suite.queue.PublishMessage("topic", "1"))
+	suite.Equal(queue.ErrQueueShutDown, suite.queue.AddSubscription("topic", suite.parser(0), true))
+}
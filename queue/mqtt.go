@@ -0,0 +1,129 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"deviceproxy/api"
+)
+
+const (
+	mqttTimeout = 10 * time.Second
+	// mqttQuiesce is how long in milliseconds in-flight work is given to complete on disconnect
+	mqttQuiesce = 250
+)
+
+// MQTTQueue is api.Broker backed by MQTT 3.1.1 broker. Durable subscriptions use QoS 1 and the session
+// is kept by the broker, so they get messages published while the proxy was disconnected.
+// Messages are acknowledged when the parser returns, so parser errors can not trigger redelivery.
+// Messages are parsed one by one in order they came in, topics can not contain MQTT wildcards.
+type MQTTQueue struct {
+	client        mqtt.Client
+	subscriptions map[string]bool
+	mutex         sync.Mutex
+}
+
+// NewMQTTQueue connects to MQTT broker at url like tcp://localhost:1883, the connection is restored automatically
+func NewMQTTQueue(url, clientID, username, password string) (*MQTTQueue, error) {
+	options := mqtt.NewClientOptions().
+		AddBroker(url).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf(logPrefix+"MQTT connection lost, reconnecting: %v\n", err)
+		})
+
+	client := mqtt.NewClient(options)
+
+	if err := wait(client.Connect()); err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not connect to MQTT broker at %v: %v", url, err)
+	}
+
+	return &MQTTQueue{
+		client:        client,
+		subscriptions: map[string]bool{},
+	}, nil
+}
+
+// AddSubscription ...
+func (q *MQTTQueue) AddSubscription(topic string, parser api.MsgParser, durable bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.subscriptions[topic] {
+		return fmt.Errorf(logPrefix+"Already subscribed to topic %v", topic)
+	}
+
+	var qos byte
+	if durable {
+		qos = 1
+	}
+
+	err := wait(q.client.Subscribe(topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		if err := parser.ParseMsg(msg.Topic(), string(msg.Payload())); err != nil {
+			log.Printf(logPrefix+"Message of topic %v is lost, parser returned error: %v\n", topic, err)
+		}
+	}))
+
+	if err != nil {
+		return err
+	}
+
+	q.subscriptions[topic] = true
+
+	return nil
+}
+
+// RemoveSubscription ...
+func (q *MQTTQueue) RemoveSubscription(topic string) error {
+	q.mutex.Lock()
+	subscribed := q.subscriptions[topic]
+	delete(q.subscriptions, topic)
+	q.mutex.Unlock()
+
+	if !subscribed {
+		return fmt.Errorf(logPrefix+"Not subscribed to topic %v", topic)
+	}
+
+	return wait(q.client.Unsubscribe(topic))
+}
+
+// PublishMessage waits until the broker acknowledges the message, it fails with api.ErrBrokerUnavailable while reconnecting
+func (q *MQTTQueue) PublishMessage(topic, msg string) error {
+	if !q.client.IsConnectionOpen() {
+		return api.ErrBrokerUnavailable
+	}
+
+	return wait(q.client.Publish(topic, 1, false, msg))
+}
+
+// ShutDown ...
+func (q *MQTTQueue) ShutDown() {
+	q.client.Disconnect(mqttQuiesce)
+}
+
+// Check reports error while the connection is down
+func (q *MQTTQueue) Check() error {
+	if !q.client.IsConnectionOpen() {
+		return errors.New("MQTT connection is down")
+	}
+
+	return nil
+}
+
+func wait(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New(logPrefix + "MQTT broker did not answer in time")
+	}
+
+	return token.Error()
+}
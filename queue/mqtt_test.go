@@ -0,0 +1,295 @@
+package queue_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/queue"
+)
+
+// mqttBroker is a minimal MQTT 3.1.1 stand-in which routes messages by exact topic, it keeps no sessions
+type mqttBroker struct {
+	listener      net.Listener
+	subscriptions map[string]map[*mqttClient]byte
+	mutex         sync.Mutex
+}
+
+type mqttClient struct {
+	conn     net.Conn
+	packetID uint16
+	mutex    sync.Mutex
+}
+
+func newMQTTBroker() (*mqttBroker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	broker := &mqttBroker{
+		listener:      listener,
+		subscriptions: map[string]map[*mqttClient]byte{},
+	}
+
+	go broker.accept()
+
+	return broker, nil
+}
+
+func (b *mqttBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *mqttBroker) close() {
+	b.listener.Close()
+}
+
+func (b *mqttBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go b.serve(&mqttClient{conn: conn})
+	}
+}
+
+func (b *mqttBroker) serve(client *mqttClient) {
+	defer b.drop(client)
+
+	reader := bufio.NewReader(client.conn)
+
+	for {
+		header, body, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			client.write(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			b.publish(client, header, body)
+		case 8: // SUBSCRIBE
+			b.subscribe(client, body)
+		case 10: // UNSUBSCRIBE
+			b.unsubscribe(client, body)
+		case 12: // PINGREQ
+			client.write(0xD0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *mqttBroker) publish(client *mqttClient, header byte, body []byte) {
+	topic, rest := readString(body)
+	qos := (header >> 1) & 3
+
+	if qos > 0 {
+		client.write(0x40, rest[:2])
+		rest = rest[2:]
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for subscriber, subscribedQoS := range b.subscriptions[topic] {
+		deliveredQoS := qos
+		if subscribedQoS < deliveredQoS {
+			deliveredQoS = subscribedQoS
+		}
+		subscriber.deliver(topic, rest, deliveredQoS)
+	}
+}
+
+func (b *mqttBroker) subscribe(client *mqttClient, body []byte) {
+	packetID, filters := body[:2], body[2:]
+	granted := []byte{}
+
+	b.mutex.Lock()
+	for len(filters) > 0 {
+		var topic string
+		topic, filters = readString(filters)
+		qos := filters[0] & 1
+		filters = filters[1:]
+
+		if b.subscriptions[topic] == nil {
+			b.subscriptions[topic] = map[*mqttClient]byte{}
+		}
+		b.subscriptions[topic][client] = qos
+		granted = append(granted, qos)
+	}
+	b.mutex.Unlock()
+
+	client.write(0x90, append(append([]byte{}, packetID...), granted...))
+}
+
+func (b *mqttBroker) unsubscribe(client *mqttClient, body []byte) {
+	packetID, filters := body[:2], body[2:]
+
+	b.mutex.Lock()
+	for len(filters) > 0 {
+		var topic string
+		topic, filters = readString(filters)
+		delete(b.subscriptions[topic], client)
+	}
+	b.mutex.Unlock()
+
+	client.write(0xB0, packetID)
+}
+
+func (b *mqttBroker) drop(client *mqttClient) {
+	client.conn.Close()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, subscribers := range b.subscriptions {
+		delete(subscribers, client)
+	}
+}
+
+func (c *mqttClient) deliver(topic string, payload []byte, qos byte) {
+	body := make([]byte, 2, 4+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	body = append(body, topic...)
+
+	c.mutex.Lock()
+	if qos > 0 {
+		c.packetID++
+		body = append(body, byte(c.packetID>>8), byte(c.packetID))
+	}
+	c.mutex.Unlock()
+
+	c.write(0x30|qos<<1, append(body, payload...))
+}
+
+func (c *mqttClient) write(header byte, body []byte) {
+	packet := []byte{header}
+	length := len(body)
+
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn.Write(append(packet, body...))
+}
+
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+
+	return header, body, err
+}
+
+func readString(data []byte) (string, []byte) {
+	length := int(binary.BigEndian.Uint16(data))
+	return string(data[2 : 2+length]), data[2+length:]
+}
+
+type MQTTQueueTestSuite struct {
+	suite.Suite
+
+	broker   *mqttBroker
+	queue    *queue.MQTTQueue
+	received chan string
+}
+
+func TestExecuteMQTTQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(MQTTQueueTestSuite))
+}
+
+func (suite *MQTTQueueTestSuite) SetupTest() {
+	var err error
+	suite.broker, err = newMQTTBroker()
+	suite.Require().Nil(err)
+
+	suite.queue, err = queue.NewMQTTQueue(suite.broker.url(), "test", "", "")
+	suite.Require().Nil(err)
+
+	suite.received = make(chan string, 10)
+}
+
+func (suite *MQTTQueueTestSuite) TearDownTest() {
+	suite.queue.ShutDown()
+	suite.broker.close()
+}
+
+func (suite *MQTTQueueTestSuite) parser() parserFunc {
+	return func(topic, msg string) error {
+		suite.received <- topic + ":" + msg
+		return nil
+	}
+}
+
+func (suite *MQTTQueueTestSuite) Test_MessagesAreDeliveredToSubscribedTopic() {
+	suite.Nil(suite.queue.Check())
+	suite.Nil(suite.queue.AddSubscription("durable", suite.parser(), true))
+	suite.Nil(suite.queue.AddSubscription("volatile", suite.parser(), false))
+	suite.NotNil(suite.queue.AddSubscription("durable", suite.parser(), true))
+
+	suite.Nil(suite.queue.PublishMessage("other", "lost"))
+	suite.Nil(suite.queue.PublishMessage("durable", "1"))
+	suite.Nil(suite.queue.PublishMessage("volatile", "2"))
+
+	for _, expected := range []string{"durable:1", "volatile:2"} {
+		select {
+		case msg := <-suite.received:
+			suite.Equal(expected, msg)
+		case <-time.After(time.Second):
+			suite.Fail("message not delivered", expected)
+		}
+	}
+}
+
+func (suite *MQTTQueueTestSuite) Test_RemovedSubscriptionGetsNoMessages() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(), true))
+	suite.Nil(suite.queue.RemoveSubscription("topic"))
+	suite.NotNil(suite.queue.RemoveSubscription("topic"))
+
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+
+	select {
+	case msg := <-suite.received:
+		suite.Fail("message delivered after unsubscribe", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
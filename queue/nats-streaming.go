@@ -0,0 +1,275 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	stan "github.com/nats-io/stan.go"
+
+	"deviceproxy/api"
+)
+
+const (
+	// natsStreamingPingInterval is in seconds, the connection is lost after natsStreamingPingMaxOut pings are not answered
+	natsStreamingPingInterval = 1
+	natsStreamingPingMaxOut   = 5
+)
+
+// NATSStreamingQueue is api.Broker backed by NATS Streaming. Messages are acknowledged once the parser
+// handled them, so a message the parser returns error for is redelivered after ack wait.
+// Durable subscriptions are closed instead of unsubscribed, so they get messages published in the meantime when resubscribed.
+// Lost connection is reestablished with backoff and subscriptions are restored, publishing fails with
+// api.ErrBrokerUnavailable until then.
+type NATSStreamingQueue struct {
+	natsConn          *nats.Conn
+	conn              stan.Conn //NOTE: nil while reconnecting
+	cluster           string
+	clientID          string
+	ackWait           time.Duration
+	reconnectDelay    time.Duration
+	reconnectMaxDelay time.Duration
+	subscriptions     map[string]*natsStreamingSubscription
+	closed            chan struct{}
+	mutex             sync.Mutex //NOTE: guards conn and subscriptions
+}
+
+type natsStreamingSubscription struct {
+	subscription stan.Subscription //NOTE: nil until subscribed on restored connection
+	parser       api.MsgParser
+	durable      bool
+}
+
+// NewNATSStreamingQueue connects to NATS Streaming cluster, reconnecting starts after reconnectDelay
+// which doubles after every failed attempt up to reconnectMaxDelay
+func NewNATSStreamingQueue(url, cluster, clientID, username, password string, ackWait, reconnectDelay, reconnectMaxDelay time.Duration) (*NATSStreamingQueue, error) {
+	natsConn, err := nats.Connect(url, nats.Name(clientID), nats.UserInfo(username, password), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not connect to NATS at %v: %v", url, err)
+	}
+
+	q := &NATSStreamingQueue{
+		natsConn:          natsConn,
+		cluster:           cluster,
+		clientID:          clientID,
+		ackWait:           ackWait,
+		reconnectDelay:    reconnectDelay,
+		reconnectMaxDelay: reconnectMaxDelay,
+		subscriptions:     map[string]*natsStreamingSubscription{},
+		closed:            make(chan struct{}),
+	}
+
+	q.conn, err = q.connect()
+	if err != nil {
+		natsConn.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// AddSubscription subscribes once the connection is restored when it is lost
+func (q *NATSStreamingQueue) AddSubscription(topic string, parser api.MsgParser, durable bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.subscriptions[topic]; ok {
+		return fmt.Errorf(logPrefix+"Already subscribed to topic %v", topic)
+	}
+
+	subscription := &natsStreamingSubscription{parser: parser, durable: durable}
+
+	if q.conn != nil {
+		if err := q.subscribe(q.conn, topic, subscription); err != nil {
+			return err
+		}
+	}
+
+	q.subscriptions[topic] = subscription
+
+	return nil
+}
+
+// RemoveSubscription ...
+func (q *NATSStreamingQueue) RemoveSubscription(topic string) error {
+	q.mutex.Lock()
+	subscription, ok := q.subscriptions[topic]
+	delete(q.subscriptions, topic)
+	q.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf(logPrefix+"Not subscribed to topic %v", topic)
+	}
+
+	if subscription.subscription == nil {
+		return nil
+	}
+
+	if subscription.durable {
+		return subscription.subscription.Close()
+	}
+
+	return subscription.subscription.Unsubscribe()
+}
+
+// PublishMessage waits until NATS Streaming acknowledges the message
+func (q *NATSStreamingQueue) PublishMessage(topic, msg string) error {
+	q.mutex.Lock()
+	conn := q.conn
+	q.mutex.Unlock()
+
+	if conn == nil {
+		return api.ErrBrokerUnavailable
+	}
+
+	err := conn.Publish(topic, []byte(msg))
+	if err == stan.ErrConnectionClosed {
+		return api.ErrBrokerUnavailable
+	}
+
+	return err
+}
+
+// ShutDown closes the connection, durable subscriptions are kept by NATS Streaming
+func (q *NATSStreamingQueue) ShutDown() {
+	q.mutex.Lock()
+	close(q.closed)
+	conn := q.conn
+	q.conn = nil
+	q.mutex.Unlock()
+
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			log.Printf(logPrefix+"Error closing NATS Streaming connection: %v\n", err)
+		}
+	}
+
+	q.natsConn.Close()
+}
+
+// Check reports error while the connection is lost
+func (q *NATSStreamingQueue) Check() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.conn == nil {
+		return errors.New("NATS Streaming connection is lost")
+	}
+
+	return nil
+}
+
+func (q *NATSStreamingQueue) connect() (stan.Conn, error) {
+	conn, err := stan.Connect(q.cluster, q.clientID, stan.NatsConn(q.natsConn),
+		stan.Pings(natsStreamingPingInterval, natsStreamingPingMaxOut),
+		stan.SetConnectionLostHandler(q.onConnectionLost))
+
+	if err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not connect to NATS Streaming cluster %v: %v", q.cluster, err)
+	}
+
+	return conn, nil
+}
+
+func (q *NATSStreamingQueue) subscribe(conn stan.Conn, topic string, subscription *natsStreamingSubscription) error {
+	options := []stan.SubscriptionOption{stan.SetManualAckMode(), stan.AckWait(q.ackWait)}
+	if subscription.durable {
+		options = append(options, stan.DurableName(topic))
+	}
+
+	parser := subscription.parser
+
+	stanSubscription, err := conn.Subscribe(topic, func(msg *stan.Msg) {
+		if err := parser.ParseMsg(msg.Subject, string(msg.Data)); err != nil {
+			log.Printf(logPrefix+"Message of topic %v will be redelivered, parser returned error: %v\n", topic, err)
+			return
+		}
+
+		if err := msg.Ack(); err != nil {
+			log.Printf(logPrefix+"Could not acknowledge message of topic %v: %v\n", topic, err)
+		}
+	}, options...)
+
+	if err != nil {
+		return err
+	}
+
+	subscription.subscription = stanSubscription
+
+	return nil
+}
+
+func (q *NATSStreamingQueue) onConnectionLost(lost stan.Conn, reason error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.conn != lost {
+		return
+	}
+
+	log.Printf(logPrefix+"NATS Streaming connection lost, reconnecting: %v\n", reason)
+
+	q.conn = nil
+	for _, subscription := range q.subscriptions {
+		subscription.subscription = nil
+	}
+
+	go q.reconnect()
+}
+
+func (q *NATSStreamingQueue) reconnect() {
+	delay := q.reconnectDelay
+
+	for {
+		select {
+		case <-q.closed:
+			return
+		case <-time.After(delay):
+		}
+
+		conn, err := q.connect()
+		if err == nil && q.restore(conn) {
+			log.Printf(logPrefix + "NATS Streaming connection restored\n")
+			return
+		}
+
+		if delay *= 2; delay > q.reconnectMaxDelay {
+			delay = q.reconnectMaxDelay
+		}
+
+		if err != nil {
+			log.Printf("%v, retrying in %v\n", err, delay)
+		}
+	}
+}
+
+// restore subscribes all topics on new connection, the connection is closed when it fails or the queue has been shut down
+func (q *NATSStreamingQueue) restore(conn stan.Conn) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	select {
+	case <-q.closed:
+		conn.Close()
+		return true
+	default:
+	}
+
+	for topic, subscription := range q.subscriptions {
+		if err := q.subscribe(conn, topic, subscription); err != nil {
+			log.Printf(logPrefix+"Could not restore subscription of topic %v, retrying: %v\n", topic, err)
+			for _, subscription := range q.subscriptions {
+				subscription.subscription = nil
+			}
+			conn.Close()
+			return false
+		}
+	}
+
+	q.conn = conn
+
+	return true
+}
@@ -0,0 +1,127 @@
+package queue_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	stanserver "github.com/nats-io/nats-streaming-server/server"
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/api"
+	"deviceproxy/queue"
+)
+
+const testCluster = "test-cluster"
+
+type NATSStreamingQueueTestSuite struct {
+	suite.Suite
+
+	natsServer  *natsserver.Server
+	stanOptions *stanserver.Options
+	server      *stanserver.StanServer
+	queue       *queue.NATSStreamingQueue
+	received    chan string
+}
+
+func TestExecuteNATSStreamingQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(NATSStreamingQueueTestSuite))
+}
+
+func (suite *NATSStreamingQueueTestSuite) SetupTest() {
+	options := natstest.DefaultTestOptions
+	options.Port = -1
+	suite.natsServer = natstest.RunServer(&options)
+
+	suite.stanOptions = stanserver.GetDefaultOptions()
+	suite.stanOptions.ID = testCluster
+	suite.stanOptions.NATSServerURL = suite.natsServer.ClientURL()
+
+	var err error
+	suite.server, err = stanserver.RunServerWithOpts(suite.stanOptions, nil)
+	suite.Require().Nil(err)
+
+	suite.queue, err = queue.NewNATSStreamingQueue(suite.natsServer.ClientURL(), testCluster, "test", "", "", time.Second, 100*time.Millisecond, time.Second)
+	suite.Require().Nil(err)
+
+	suite.received = make(chan string, 10)
+}
+
+func (suite *NATSStreamingQueueTestSuite) TearDownTest() {
+	suite.queue.ShutDown()
+	suite.server.Shutdown()
+	suite.natsServer.Shutdown()
+}
+
+func (suite *NATSStreamingQueueTestSuite) parser(failures int) parserFunc {
+	return func(topic, msg string) error {
+		if failures > 0 {
+			failures--
+			return errors.New("not now")
+		}
+
+		suite.received <- topic + ":" + msg
+		return nil
+	}
+}
+
+func (suite *NATSStreamingQueueTestSuite) expectReceived(expected string, timeout time.Duration) {
+	select {
+	case msg := <-suite.received:
+		suite.Equal(expected, msg)
+	case <-time.After(timeout):
+		suite.Fail("message not delivered", expected)
+	}
+}
+
+func (suite *NATSStreamingQueueTestSuite) Test_MessagesAreDeliveredToSubscribedTopic() {
+	suite.Nil(suite.queue.Check())
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+	suite.NotNil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+
+	suite.Nil(suite.queue.PublishMessage("other", "lost"))
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+
+	suite.expectReceived("topic:1", time.Second)
+}
+
+func (suite *NATSStreamingQueueTestSuite) Test_MessageIsRedeliveredWhenParserFails() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(1), false))
+
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+
+	suite.expectReceived("topic:1", 3*time.Second)
+}
+
+func (suite *NATSStreamingQueueTestSuite) Test_DurableSubscriptionGetsMessagesPublishedWhileRemoved() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+	suite.Nil(suite.queue.RemoveSubscription("topic"))
+
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(0), true))
+
+	suite.expectReceived("topic:1", time.Second)
+}
+
+func (suite *NATSStreamingQueueTestSuite) Test_LostConnectionIsRestoredWithSubscriptions() {
+	suite.Nil(suite.queue.AddSubscription("before", suite.parser(0), false))
+
+	suite.server.Shutdown()
+	suite.Eventually(func() bool { return suite.queue.Check() != nil }, 10*time.Second, 100*time.Millisecond)
+
+	suite.Equal(api.ErrBrokerUnavailable, suite.queue.PublishMessage("before", "lost"))
+	suite.Nil(suite.queue.AddSubscription("during", suite.parser(0), false))
+
+	var err error
+	suite.server, err = stanserver.RunServerWithOpts(suite.stanOptions, nil)
+	suite.Require().Nil(err)
+	suite.Eventually(func() bool { return suite.queue.Check() == nil }, 10*time.Second, 100*time.Millisecond)
+
+	suite.Nil(suite.queue.PublishMessage("before", "1"))
+	suite.expectReceived("before:1", time.Second)
+
+	suite.Nil(suite.queue.PublishMessage("during", "2"))
+	suite.expectReceived("during:2", time.Second)
+}
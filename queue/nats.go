@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	nats "github.com/nats-io/nats.go"
+
+	"deviceproxy/api"
+)
+
+// NATSQueue is api.Broker backed by core NATS. Core NATS does not keep messages, so durable flag
+// is ignored and messages the parser returns error for are lost. The connection and its subscriptions are restored
+// automatically, publishing fails with api.ErrBrokerUnavailable until then.
+type NATSQueue struct {
+	conn          *nats.Conn
+	subscriptions map[string]*nats.Subscription
+	mutex         sync.Mutex
+}
+
+// NewNATSQueue ...
+func NewNATSQueue(url, clientID, username, password string) (*NATSQueue, error) {
+	conn, err := nats.Connect(url, nats.Name(clientID), nats.UserInfo(username, password), nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf(logPrefix+"NATS connection lost, reconnecting: %v\n", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Printf(logPrefix+"NATS connection restored to %v\n", conn.ConnectedUrl())
+		}))
+
+	if err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not connect to NATS at %v: %v", url, err)
+	}
+
+	return &NATSQueue{
+		conn:          conn,
+		subscriptions: map[string]*nats.Subscription{},
+	}, nil
+}
+
+// AddSubscription ...
+func (q *NATSQueue) AddSubscription(topic string, parser api.MsgParser, durable bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.subscriptions[topic]; ok {
+		return fmt.Errorf(logPrefix+"Already subscribed to topic %v", topic)
+	}
+
+	subscription, err := q.conn.Subscribe(topic, func(msg *nats.Msg) {
+		if err := parser.ParseMsg(msg.Subject, string(msg.Data)); err != nil {
+			log.Printf(logPrefix+"Message of topic %v is lost, parser returned error: %v\n", topic, err)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	q.subscriptions[topic] = subscription
+
+	return nil
+}
+
+// RemoveSubscription ...
+func (q *NATSQueue) RemoveSubscription(topic string) error {
+	q.mutex.Lock()
+	subscription, ok := q.subscriptions[topic]
+	delete(q.subscriptions, topic)
+	q.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf(logPrefix+"Not subscribed to topic %v", topic)
+	}
+
+	return subscription.Unsubscribe()
+}
+
+// PublishMessage ...
+func (q *NATSQueue) PublishMessage(topic, msg string) error {
+	if !q.conn.IsConnected() {
+		return api.ErrBrokerUnavailable
+	}
+
+	return q.conn.Publish(topic, []byte(msg))
+}
+
+// ShutDown ...
+func (q *NATSQueue) ShutDown() {
+	q.conn.Close()
+}
+
+// Check reports error while the connection is down
+func (q *NATSQueue) Check() error {
+	if !q.conn.IsConnected() {
+		return errors.New("NATS connection is down")
+	}
+
+	return nil
+}
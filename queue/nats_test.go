@@ -0,0 +1,91 @@
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/queue"
+)
+
+type NATSQueueTestSuite struct {
+	suite.Suite
+
+	server   *natsserver.Server
+	queue    *queue.NATSQueue
+	received chan string
+}
+
+func TestExecuteNATSQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(NATSQueueTestSuite))
+}
+
+func (suite *NATSQueueTestSuite) SetupTest() {
+	options := natstest.DefaultTestOptions
+	options.Port = -1
+	suite.server = natstest.RunServer(&options)
+
+	var err error
+	suite.queue, err = queue.NewNATSQueue(suite.server.ClientURL(), "test", "", "")
+	suite.Require().Nil(err)
+
+	suite.received = make(chan string, 10)
+}
+
+func (suite *NATSQueueTestSuite) TearDownTest() {
+	suite.queue.ShutDown()
+	suite.server.Shutdown()
+}
+
+func (suite *NATSQueueTestSuite) parser() parserFunc {
+	return func(topic, msg string) error {
+		suite.received <- topic + ":" + msg
+		return nil
+	}
+}
+
+func (suite *NATSQueueTestSuite) Test_MessagesAreDeliveredToSubscribedTopic() {
+	suite.Nil(suite.queue.Check())
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(), true))
+	suite.NotNil(suite.queue.AddSubscription("topic", suite.parser(), true))
+
+	suite.Nil(suite.queue.PublishMessage("other", "lost"))
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+
+	select {
+	case msg := <-suite.received:
+		suite.Equal("topic:1", msg)
+	case <-time.After(time.Second):
+		suite.Fail("message not delivered")
+	}
+}
+
+func (suite *NATSQueueTestSuite) Test_ParserGetsSubjectOfMessage() {
+	suite.Nil(suite.queue.AddSubscription("devices.*", suite.parser(), false))
+
+	suite.Nil(suite.queue.PublishMessage("devices.device1", "1"))
+
+	select {
+	case msg := <-suite.received:
+		suite.Equal("devices.device1:1", msg)
+	case <-time.After(time.Second):
+		suite.Fail("message not delivered")
+	}
+}
+
+func (suite *NATSQueueTestSuite) Test_RemovedSubscriptionGetsNoMessages() {
+	suite.Nil(suite.queue.AddSubscription("topic", suite.parser(), false))
+	suite.Nil(suite.queue.RemoveSubscription("topic"))
+	suite.NotNil(suite.queue.RemoveSubscription("topic"))
+
+	suite.Nil(suite.queue.PublishMessage("topic", "1"))
+
+	select {
+	case msg := <-suite.received:
+		suite.Fail("message delivered after unsubscribe", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,661 @@
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"deviceproxy/topics"
+)
+
+// Config holds all settings of the proxy. LoadConfig reads it from optional YAML or JSON file
+// and environment variables, Validate has to pass before the config is used.
+type Config struct {
+	Service    ServiceConfig    `yaml:"service"`
+	Queue      QueueConfig      `yaml:"queue"`
+	NATS       NATSConfig       `yaml:"nats"`
+	MQTT       MQTTConfig       `yaml:"mqtt"`
+	Connection ConnectionConfig `yaml:"connection"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	Auth       AuthConfig       `yaml:"auth"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Mailbox    MailboxConfig    `yaml:"mailbox"`
+	Delivery   DeliveryConfig   `yaml:"delivery"`
+	Topics     TopicsConfig     `yaml:"topics"`
+	Tenancy    TenancyConfig    `yaml:"tenancy"`
+	Cluster    ClusterConfig    `yaml:"cluster"`
+	Monitoring MonitoringConfig `yaml:"monitoring"`
+	Admin      AdminConfig      `yaml:"admin"`
+}
+
+// ServiceConfig ...
+type ServiceConfig struct {
+	// Port devices connect to
+	Port string `yaml:"port"`
+	// Endpoint is path of websocket endpoint
+	Endpoint string `yaml:"endpoint"`
+	// LogDebug logs every message passing through the proxy
+	LogDebug bool `yaml:"logDebug"`
+	// DrainTimeout is how long shutdown waits for device connections to finish in-flight publishes
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+}
+
+// QueueConfig ...
+type QueueConfig struct {
+	// Mode selects message broker: nats-streaming, nats (core NATS), mqtt or memory (in-process queue for local development)
+	Mode string `yaml:"mode"`
+	// ClientID identifies the proxy to NATS Streaming and MQTT broker which keep its durable subscriptions
+	ClientID string `yaml:"clientID"`
+	// RedeliveryDelay is how long nats-streaming and memory queues wait before they redeliver message which could not be handled
+	RedeliveryDelay time.Duration `yaml:"redeliveryDelay"`
+	// ReconnectDelay is how long nats-streaming queue waits before reconnecting, it doubles after every failed attempt
+	ReconnectDelay time.Duration `yaml:"reconnectDelay"`
+	// ReconnectMaxDelay caps ReconnectDelay
+	ReconnectMaxDelay time.Duration `yaml:"reconnectMaxDelay"`
+}
+
+// NATSConfig says where to connect in nats-streaming and nats queue modes
+type NATSConfig struct {
+	URL      string `yaml:"url"`
+	Cluster  string `yaml:"cluster"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// MQTTConfig says where to connect in mqtt queue mode
+type MQTTConfig struct {
+	// URL of MQTT 3.1.1 broker, e.g. tcp://localhost:1883
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ConnectionConfig ...
+type ConnectionConfig struct {
+	// SendQueueSize is the number of outbound messages buffered per websocket connection
+	SendQueueSize int `yaml:"sendQueueSize"`
+	// SendQueueOverflow says what to do when outbound queue is full: drop-oldest, drop-newest or disconnect
+	SendQueueOverflow string `yaml:"sendQueueOverflow"`
+	// PingInterval says how often websocket pings are sent to devices, 0 disables pings
+	PingInterval time.Duration `yaml:"pingInterval"`
+	// PongWait is how long to wait for pong (or any other frame) before connection is considered dead, 0 disables it
+	PongWait time.Duration `yaml:"pongWait"`
+	// ReadIdleTimeout closes connections which have not sent any message for that long, 0 disables it
+	ReadIdleTimeout time.Duration `yaml:"readIdleTimeout"`
+	// Compression accepts permessage-deflate offered by devices
+	Compression bool `yaml:"compression"`
+	// CompressionLevel is flate level from -2 (huffman only) to 9 (best compression)
+	CompressionLevel int `yaml:"compressionLevel"`
+	// CompressionThreshold is the smallest outbound message in bytes which is compressed, shorter ones do not pay off
+	CompressionThreshold int `yaml:"compressionThreshold"`
+	// AllowedOrigins lists browser origins allowed to connect: exact (https://app.example.com), wildcard subdomain
+	// (https://*.example.com), regular expression prefixed with re: matching whole origin or * for any origin.
+	// Empty list allows no browser origin.
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// AllowEmptyOrigin lets in requests without Origin header, native devices do not send it
+	AllowEmptyOrigin bool `yaml:"allowEmptyOrigin"`
+}
+
+// LimitsConfig protects the queue from devices sending too much. Rate limits are token buckets refilled
+// with rate messages per second which hold up to burst messages, rate 0 disables the limit.
+type LimitsConfig struct {
+	DeviceLimits `yaml:",inline"`
+	// Violation says what happens with message over rate limit: reject (with ResponseMsg error), delay or disconnect.
+	// Connection sending message larger than MaxMessageSize is always closed.
+	Violation string `yaml:"violation"`
+	// Devices override limits of particular device tags, tags are scoped with tenant when tenancy is enabled (acme/sensor-1)
+	Devices map[string]DeviceLimits `yaml:"devices"`
+}
+
+// DeviceLimits ...
+type DeviceLimits struct {
+	// MaxMessageSize is the largest frame in bytes device may send, 0 means no limit
+	MaxMessageSize int `yaml:"maxMessageSize"`
+	// ConnectionRate limits messages per second of every connection
+	ConnectionRate  float64 `yaml:"connectionRate"`
+	ConnectionBurst int     `yaml:"connectionBurst"`
+	// DeviceRate limits messages per second of all connections of the device tag together
+	DeviceRate  float64 `yaml:"deviceRate"`
+	DeviceBurst int     `yaml:"deviceBurst"`
+}
+
+// For returns limits of the device tag, override replaces all default limits
+func (c LimitsConfig) For(deviceTag string) DeviceLimits {
+	if limits, ok := c.Devices[deviceTag]; ok {
+		return limits
+	}
+
+	return c.DeviceLimits
+}
+
+// AuthConfig ...
+type AuthConfig struct {
+	// Mode selects how devices are authenticated on upgrade: none, jwt or psk
+	Mode string `yaml:"mode"`
+	// JWTSecret is HMAC secret used to verify device tokens in jwt mode
+	JWTSecret string `yaml:"jwtSecret"`
+	// PSKFile is path to file with pre-shared keys of devices in psk mode, device tags are prefixed with
+	// tenant ("acme/sensor-1:key") when tenancy is enabled
+	PSKFile string `yaml:"pskFile"`
+}
+
+// TLSConfig ...
+type TLSConfig struct {
+	// Mode selects transport security: none, tls or mtls
+	Mode string `yaml:"mode"`
+	// CertFile is path to PEM encoded server certificate
+	CertFile string `yaml:"certFile"`
+	// KeyFile is path to PEM encoded server private key
+	KeyFile string `yaml:"keyFile"`
+	// ClientCAFile is path to PEM bundle of CAs allowed to sign device certificates in mtls mode
+	ClientCAFile string `yaml:"clientCAFile"`
+	// CRLFile is optional path to revocation list of device certificates in mtls mode
+	CRLFile string `yaml:"crlFile"`
+	// CertIdentity says where device tag is taken from in mtls mode: cn or san-uri
+	CertIdentity string `yaml:"certIdentity"`
+}
+
+// MailboxConfig ...
+type MailboxConfig struct {
+	// Mode selects where messages for offline devices are kept: none, memory or file
+	Mode string `yaml:"mode"`
+	// Dir is directory of mailbox files in file mode
+	Dir string `yaml:"dir"`
+	// Size is the maximum number of messages kept per device
+	Size int `yaml:"size"`
+	// TTL is how long messages are kept for offline device
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// DeliveryConfig ...
+type DeliveryConfig struct {
+	// Acks makes devices acknowledge every cloud message, it needs queue which redelivers unacknowledged messages
+	// and dispatches topics independently: nats-streaming or memory
+	Acks bool `yaml:"acks"`
+	// AckTimeout is how long to wait for device ack before the message is redelivered
+	AckTimeout time.Duration `yaml:"ackTimeout"`
+	// RawPayloads publishes device messages without envelope for legacy consumers,
+	// binary frames are published as {"$binary":"<base64>"} then
+	RawPayloads bool `yaml:"rawPayloads"`
+	// EnvelopeHeaders lists headers of the upgrade request copied to envelope of every message of the connection,
+	// e.g. X-Correlation-ID
+	EnvelopeHeaders []string `yaml:"envelopeHeaders"`
+	// RPCEnabled makes proxy forward RPC requests from rpc.req.<tag> topics to devices
+	RPCEnabled bool `yaml:"rpcEnabled"`
+	// RPCTimeout is default time to wait for device response to RPC request
+	RPCTimeout time.Duration `yaml:"rpcTimeout"`
+	// RPCReplyPrefix is prefix reply-to topics of RPC requests have to start with, e.g. "rpc.reply.".
+	// Topics of devices, presence and cluster topics are refused as reply-to even when it is empty.
+	RPCReplyPrefix string `yaml:"rpcReplyPrefix"`
+	// PresenceTopic is queue topic for device online/offline events, empty disables them
+	PresenceTopic string `yaml:"presenceTopic"`
+}
+
+// TopicsConfig holds templates of per device queue topics. {tag} is replaced with device tag
+// and {tenant} with Tenant, e.g. "{tenant}.devices.{tag}.up"
+type TopicsConfig struct {
+	// Tenant is namespace of this deployment, required when any template contains {tenant}
+	Tenant string `yaml:"tenant"`
+	// Publish is template of topics messages from devices are published to
+	Publish string `yaml:"publish"`
+	// Event is template of topics messages for devices come from
+	Event string `yaml:"event"`
+	// Ack is template of topics delivery acks are published to
+	Ack string `yaml:"ack"`
+	// RPC is template of topics RPC requests for devices come from
+	RPC string `yaml:"rpc"`
+}
+
+// TenancyConfig lets tenants share the deployment. Tenant of every connection is resolved on upgrade
+// and scopes its device tag and topics, so devices of different tenants may use the same tag.
+type TenancyConfig struct {
+	// Source of tenant: none, claim (tenant claim of device JWT), subdomain or path (segment before service endpoint).
+	// Credentials of devices have to belong to the tenant, so client certificates alone can not be used.
+	Source string `yaml:"source"`
+	// Domain is parent domain of tenant subdomains in subdomain source, e.g. devices.example.com
+	Domain string `yaml:"domain"`
+	// MaxConnections limits connections of every tenant, 0 means no limit
+	MaxConnections int `yaml:"maxConnections"`
+	// Quotas override MaxConnections of particular tenants
+	Quotas map[string]int `yaml:"quotas"`
+}
+
+// Enabled says whether tenant is resolved per connection instead of using topics tenant of the deployment
+func (c TenancyConfig) Enabled() bool {
+	return c.Source != "" && c.Source != "none"
+}
+
+// Quota returns connection limit of the tenant, 0 means no limit
+func (c TenancyConfig) Quota(tenant string) int {
+	if quota, ok := c.Quotas[tenant]; ok {
+		return quota
+	}
+
+	return c.MaxConnections
+}
+
+// ClusterConfig lets several replicas of the proxy run behind a load balancer. Replicas share which devices
+// they hold through the queue and forward messages of devices connected to another replica.
+// Every replica needs its own queue client ID.
+type ClusterConfig struct {
+	// Enabled turns the device registry and forwarding on
+	Enabled bool `yaml:"enabled"`
+	// InstanceID identifies the replica, hostname by default
+	InstanceID string `yaml:"instanceID"`
+	// Topic is prefix of registry and forwarding topics, it has to be the same for all replicas
+	Topic string `yaml:"topic"`
+	// AnnounceInterval is how often replicas announce their devices again
+	AnnounceInterval time.Duration `yaml:"announceInterval"`
+	// RegistryTTL is how long a device stays in the registry without being announced, so devices of replica
+	// which went away without saying bye are not forwarded to it forever. It has to be longer than AnnounceInterval.
+	RegistryTTL time.Duration `yaml:"registryTTL"`
+}
+
+// MonitoringConfig ...
+type MonitoringConfig struct {
+	// MetricsEndpoint is path of prometheus metrics on service port, empty disables metrics
+	MetricsEndpoint string `yaml:"metricsEndpoint"`
+	// AcceptLoopTimeout is how long accept loop may not accept connections before liveness check fails
+	AcceptLoopTimeout time.Duration `yaml:"acceptLoopTimeout"`
+}
+
+// AdminConfig ...
+type AdminConfig struct {
+	// Port of admin HTTP API, empty disables it
+	Port string `yaml:"port"`
+	// Token is bearer token required by admin HTTP API, empty disables authentication
+	Token string `yaml:"token"`
+}
+
+// DefaultConfig ...
+func DefaultConfig() *Config {
+	return &Config{
+		Service: ServiceConfig{
+			Port:         "3001",
+			Endpoint:     "/deviceproxy",
+			DrainTimeout: 10 * time.Second,
+		},
+		Queue: QueueConfig{
+			Mode:              "nats-streaming",
+			ClientID:          ServiceName,
+			RedeliveryDelay:   30 * time.Second,
+			ReconnectDelay:    time.Second,
+			ReconnectMaxDelay: 30 * time.Second,
+		},
+		NATS: NATSConfig{
+			Cluster:  "FitStationCluster",
+			Username: "nats",
+			Password: "nats",
+		},
+		Connection: ConnectionConfig{
+			SendQueueSize:        64,
+			SendQueueOverflow:    "drop-oldest",
+			PingInterval:         30 * time.Second,
+			PongWait:             60 * time.Second,
+			CompressionLevel:     1,
+			CompressionThreshold: 256,
+			AllowEmptyOrigin:     true,
+		},
+		Limits: LimitsConfig{
+			DeviceLimits: DeviceLimits{
+				MaxMessageSize: 1 << 20,
+			},
+			Violation: "reject",
+		},
+		Auth: AuthConfig{
+			Mode: "none",
+		},
+		TLS: TLSConfig{
+			Mode:         "none",
+			CertIdentity: "cn",
+		},
+		Mailbox: MailboxConfig{
+			Mode: "none",
+			Dir:  "mailbox",
+			Size: 100,
+			TTL:  time.Hour,
+		},
+		Delivery: DeliveryConfig{
+			AckTimeout: 10 * time.Second,
+			RPCTimeout: 30 * time.Second,
+		},
+		Topics: TopicsConfig{
+			Publish: topics.DefaultPublish,
+			Event:   topics.DefaultEvent,
+			Ack:     topics.DefaultAck,
+			RPC:     topics.DefaultRPC,
+		},
+		Tenancy: TenancyConfig{
+			Source: "none",
+		},
+		Cluster: ClusterConfig{
+			InstanceID:       hostname(),
+			Topic:            "deviceproxy.cluster",
+			AnnounceInterval: 30 * time.Second,
+			RegistryTTL:      90 * time.Second,
+		},
+		Monitoring: MonitoringConfig{
+			MetricsEndpoint:   "/metrics",
+			AcceptLoopTimeout: 30 * time.Second,
+		},
+	}
+}
+
+// LoadConfig reads defaults overridden by file at path (YAML, or JSON as its subset) and then by
+// environment variables. Empty path skips the file.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can not read config file: %v", err)
+		}
+
+		if err = yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("can not parse config file %v: %v", path, err)
+		}
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (c *Config) applyEnv() error {
+	env := &envReader{}
+
+	env.string(EnvQueueMode, &c.Queue.Mode)
+	env.string(EnvQueueClientID, &c.Queue.ClientID)
+	env.duration(EnvQueueRedeliveryDelay, &c.Queue.RedeliveryDelay)
+	env.duration(EnvQueueReconnectDelay, &c.Queue.ReconnectDelay)
+	env.duration(EnvQueueReconnectMaxDelay, &c.Queue.ReconnectMaxDelay)
+
+	env.string(NATSEnvURLName, &c.NATS.URL)
+	env.string(NATSEnvClusterName, &c.NATS.Cluster)
+	env.string(NATSEnvUserName, &c.NATS.Username)
+	env.string(NATSEnvPassName, &c.NATS.Password)
+
+	env.string(EnvMQTTURL, &c.MQTT.URL)
+	env.string(EnvMQTTUsername, &c.MQTT.Username)
+	env.string(EnvMQTTPassword, &c.MQTT.Password)
+
+	env.string(EnvServicePort, &c.Service.Port)
+	env.string(EnvDeviceProxyEndpoint, &c.Service.Endpoint)
+	env.bool(EnvDeviceProxyLogDebug, &c.Service.LogDebug)
+	env.duration(EnvDrainTimeout, &c.Service.DrainTimeout)
+
+	env.int(EnvSendQueueSize, &c.Connection.SendQueueSize)
+	env.string(EnvSendQueueOverflow, &c.Connection.SendQueueOverflow)
+	env.duration(EnvPingInterval, &c.Connection.PingInterval)
+	env.duration(EnvPongWait, &c.Connection.PongWait)
+	env.duration(EnvReadIdleTimeout, &c.Connection.ReadIdleTimeout)
+	env.bool(EnvCompression, &c.Connection.Compression)
+	env.int(EnvCompressionLevel, &c.Connection.CompressionLevel)
+	env.int(EnvCompressionThreshold, &c.Connection.CompressionThreshold)
+	env.list(EnvAllowedOrigins, &c.Connection.AllowedOrigins)
+	env.bool(EnvAllowEmptyOrigin, &c.Connection.AllowEmptyOrigin)
+
+	env.int(EnvMaxMessageSize, &c.Limits.MaxMessageSize)
+	env.float(EnvConnectionRate, &c.Limits.ConnectionRate)
+	env.int(EnvConnectionBurst, &c.Limits.ConnectionBurst)
+	env.float(EnvDeviceRate, &c.Limits.DeviceRate)
+	env.int(EnvDeviceBurst, &c.Limits.DeviceBurst)
+	env.string(EnvLimitViolation, &c.Limits.Violation)
+
+	env.string(EnvAuthMode, &c.Auth.Mode)
+	env.string(EnvJWTSecret, &c.Auth.JWTSecret)
+	env.string(EnvPSKFile, &c.Auth.PSKFile)
+
+	env.string(EnvTLSMode, &c.TLS.Mode)
+	env.string(EnvTLSCertFile, &c.TLS.CertFile)
+	env.string(EnvTLSKeyFile, &c.TLS.KeyFile)
+	env.string(EnvTLSClientCAFile, &c.TLS.ClientCAFile)
+	env.string(EnvTLSCRLFile, &c.TLS.CRLFile)
+	env.string(EnvTLSCertIdentity, &c.TLS.CertIdentity)
+
+	env.string(EnvMailboxMode, &c.Mailbox.Mode)
+	env.string(EnvMailboxDir, &c.Mailbox.Dir)
+	env.int(EnvMailboxSize, &c.Mailbox.Size)
+	env.duration(EnvMailboxTTL, &c.Mailbox.TTL)
+
+	env.bool(EnvDeliveryAcks, &c.Delivery.Acks)
+	env.duration(EnvAckTimeout, &c.Delivery.AckTimeout)
+	env.bool(EnvRawPayloads, &c.Delivery.RawPayloads)
+	env.list(EnvEnvelopeHeaders, &c.Delivery.EnvelopeHeaders)
+	env.bool(EnvRPCEnabled, &c.Delivery.RPCEnabled)
+	env.duration(EnvRPCTimeout, &c.Delivery.RPCTimeout)
+	env.string(EnvRPCReplyPrefix, &c.Delivery.RPCReplyPrefix)
+	env.string(EnvPresenceTopic, &c.Delivery.PresenceTopic)
+
+	env.string(EnvTopicTenant, &c.Topics.Tenant)
+	env.string(EnvTopicPublish, &c.Topics.Publish)
+	env.string(EnvTopicEvent, &c.Topics.Event)
+	env.string(EnvTopicAck, &c.Topics.Ack)
+	env.string(EnvTopicRPC, &c.Topics.RPC)
+
+	env.string(EnvTenantSource, &c.Tenancy.Source)
+	env.string(EnvTenantDomain, &c.Tenancy.Domain)
+	env.int(EnvTenantMaxConnections, &c.Tenancy.MaxConnections)
+
+	env.bool(EnvClusterEnabled, &c.Cluster.Enabled)
+	env.string(EnvClusterInstanceID, &c.Cluster.InstanceID)
+	env.string(EnvClusterTopic, &c.Cluster.Topic)
+	env.duration(EnvClusterAnnounce, &c.Cluster.AnnounceInterval)
+	env.duration(EnvClusterRegistryTTL, &c.Cluster.RegistryTTL)
+
+	// NOTE: metrics endpoint can be set to empty value to disable metrics
+	if metricsEndpoint, ok := os.LookupEnv(EnvMetricsEndpoint); ok {
+		c.Monitoring.MetricsEndpoint = metricsEndpoint
+	}
+	env.duration(EnvAcceptLoopTimeout, &c.Monitoring.AcceptLoopTimeout)
+
+	env.string(EnvAdminPort, &c.Admin.Port)
+	env.string(EnvAdminToken, &c.Admin.Token)
+
+	return env.err
+}
+
+// Validate checks the whole config up front and reports every problem found
+func (c *Config) Validate() error {
+	problems := []string{}
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Service.Port != "", "service port is required")
+	check(strings.HasPrefix(c.Service.Endpoint, "/"), "service endpoint %q has to start with /", c.Service.Endpoint)
+	check(c.Service.DrainTimeout >= 0, "drain timeout can not be negative")
+
+	check(oneOf(c.Queue.Mode, "nats-streaming", "nats", "mqtt", "memory"), "unknown queue mode %q", c.Queue.Mode)
+	check(!oneOf(c.Queue.Mode, "nats-streaming", "nats") || c.NATS.URL != "", "NATS URL is required (%v)", NATSEnvURLName)
+	check(c.Queue.Mode != "nats-streaming" || c.Queue.ReconnectDelay > 0, "queue reconnect delay has to be positive in nats-streaming mode")
+	check(c.Queue.ReconnectMaxDelay >= c.Queue.ReconnectDelay, "queue reconnect max delay can not be shorter than reconnect delay")
+	check(c.Queue.Mode != "mqtt" || c.MQTT.URL != "", "MQTT URL is required (%v)", EnvMQTTURL)
+	check(!oneOf(c.Queue.Mode, "nats-streaming", "mqtt") || c.Queue.ClientID != "", "queue client ID is required in %v mode", c.Queue.Mode)
+	check(!oneOf(c.Queue.Mode, "nats-streaming", "memory") || c.Queue.RedeliveryDelay > 0, "queue redelivery delay has to be positive in %v mode", c.Queue.Mode)
+
+	check(c.Connection.SendQueueSize > 0, "send queue size has to be positive")
+	check(oneOf(c.Connection.SendQueueOverflow, "drop-oldest", "drop-newest", "disconnect"), "unknown send queue overflow policy %q", c.Connection.SendQueueOverflow)
+	check(c.Connection.PingInterval >= 0 && c.Connection.PongWait >= 0 && c.Connection.ReadIdleTimeout >= 0, "heartbeat durations can not be negative")
+	check(c.Connection.PongWait == 0 || (c.Connection.PingInterval > 0 && c.Connection.PingInterval < c.Connection.PongWait),
+		"ping interval has to be positive and shorter than pong wait, otherwise idle devices miss pong deadline")
+	check(c.Connection.CompressionLevel >= -2 && c.Connection.CompressionLevel <= 9, "compression level has to be between -2 and 9")
+	check(c.Connection.CompressionThreshold >= 0, "compression threshold can not be negative")
+	for _, origin := range c.Connection.AllowedOrigins {
+		if strings.HasPrefix(origin, "re:") {
+			_, err := regexp.Compile(strings.TrimPrefix(origin, "re:"))
+			check(err == nil, "invalid allowed origin %q: %v", origin, err)
+		}
+	}
+
+	check(oneOf(c.Limits.Violation, "reject", "delay", "disconnect"), "unknown limit violation policy %q", c.Limits.Violation)
+	check(c.Limits.valid(), "limits can not be negative")
+	for deviceTag, limits := range c.Limits.Devices {
+		check(limits.valid(), "limits of device %q can not be negative", deviceTag)
+	}
+
+	check(oneOf(c.Auth.Mode, "none", "jwt", "psk"), "unknown auth mode %q", c.Auth.Mode)
+	check(c.Auth.Mode != "jwt" || c.Auth.JWTSecret != "", "JWT secret is required in jwt auth mode")
+	check(c.Auth.Mode != "psk" || c.Auth.PSKFile != "", "PSK file is required in psk auth mode")
+
+	check(oneOf(c.TLS.Mode, "none", "tls", "mtls"), "unknown TLS mode %q", c.TLS.Mode)
+	check(c.TLS.Mode == "none" || (c.TLS.CertFile != "" && c.TLS.KeyFile != ""), "TLS certificate and key files are required in %v mode", c.TLS.Mode)
+	check(c.TLS.Mode != "mtls" || c.TLS.ClientCAFile != "", "client CA file is required in mtls mode")
+	check(oneOf(c.TLS.CertIdentity, "cn", "san-uri"), "unknown certificate identity %q", c.TLS.CertIdentity)
+
+	check(oneOf(c.Mailbox.Mode, "none", "memory", "file"), "unknown mailbox mode %q", c.Mailbox.Mode)
+	check(c.Mailbox.Mode != "file" || c.Mailbox.Dir != "", "mailbox dir is required in file mailbox mode")
+	check(c.Mailbox.Mode == "none" || c.Mailbox.Size > 0, "mailbox size has to be positive")
+	check(c.Mailbox.TTL >= 0, "mailbox TTL can not be negative")
+
+	check(c.Delivery.AckTimeout > 0 || !c.Delivery.Acks, "ack timeout has to be positive when delivery acks are enabled")
+	check(!c.Delivery.Acks || oneOf(c.Queue.Mode, "nats-streaming", "memory"), "delivery acks need nats-streaming or memory queue, %v queue does not redeliver messages", c.Queue.Mode)
+	check(c.Delivery.RPCTimeout > 0 || !c.Delivery.RPCEnabled, "RPC timeout has to be positive when RPC is enabled")
+
+	if topicSet, err := c.Topics.Set(); err != nil {
+		check(false, "invalid topic templates: %v", err)
+	} else {
+		check(!topicSet.UsesTenant() || c.Topics.Tenant != "" || c.Tenancy.Enabled(), "topics tenant is required when templates contain %v", topics.VarTenant)
+		check(c.Topics.Tenant == "" || topics.ValidTenant(c.Topics.Tenant), "topics tenant can not contain whitespace or any of './*>+#'")
+		check(!c.Tenancy.Enabled() || topicSet.SeparatesTenants(), "every topic template has to contain %v when tenancy is enabled", topics.VarTenant)
+	}
+
+	check(oneOf(c.Tenancy.Source, "none", "claim", "subdomain", "path"), "unknown tenant source %q", c.Tenancy.Source)
+	check(c.Tenancy.Source != "claim" || c.Auth.Mode == "jwt", "tenant claim source requires jwt auth mode")
+	check(!c.Tenancy.Enabled() || c.Auth.Mode != "none" || c.TLS.Mode != "mtls", "client certificates do not tell tenant, use jwt or psk auth mode with tenancy")
+	check(c.Tenancy.Source != "subdomain" || c.Tenancy.Domain != "", "tenant domain is required in subdomain tenant source")
+	check(c.Tenancy.MaxConnections >= 0, "tenant max connections can not be negative")
+	for tenant, quota := range c.Tenancy.Quotas {
+		check(topics.ValidTenant(tenant) && quota >= 0, "invalid quota %v of tenant %q", quota, tenant)
+	}
+
+	if c.Cluster.Enabled {
+		check(c.Queue.Mode != "memory", "cluster can not be enabled in memory queue mode")
+		check(c.Cluster.InstanceID != "" && !strings.ContainsAny(c.Cluster.InstanceID, " .*>#+/"), "invalid cluster instance ID %q", c.Cluster.InstanceID)
+		check(c.Cluster.Topic != "", "cluster topic is required")
+		check(c.Cluster.AnnounceInterval > 0 && c.Cluster.RegistryTTL > c.Cluster.AnnounceInterval, "cluster registry TTL has to be longer than positive announce interval")
+	}
+
+	check(c.Monitoring.MetricsEndpoint == "" || strings.HasPrefix(c.Monitoring.MetricsEndpoint, "/"), "metrics endpoint %q has to start with /", c.Monitoring.MetricsEndpoint)
+	check(c.Admin.Port == "" || c.Admin.Port != c.Service.Port, "admin port has to differ from service port")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %v", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Set parses templates of the config
+func (c TopicsConfig) Set() (*topics.Set, error) {
+	return topics.NewSet(c.Publish, c.Event, c.Ack, c.RPC)
+}
+
+func (l DeviceLimits) valid() bool {
+	return l.MaxMessageSize >= 0 && l.ConnectionRate >= 0 && l.ConnectionBurst >= 0 && l.DeviceRate >= 0 && l.DeviceBurst >= 0
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// envReader overrides config values with environment variables which are set, remembering the first malformed one
+type envReader struct {
+	err error
+}
+
+func (r *envReader) string(name string, value *string) {
+	if v := os.Getenv(name); v != "" {
+		*value = v
+	}
+}
+
+// list reads comma separated values
+func (r *envReader) list(name string, value *[]string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+
+	*value = splitList(v)
+}
+
+func (r *envReader) bool(name string, value *bool) {
+	r.parse(name, func(v string) (err error) {
+		*value, err = strconv.ParseBool(v)
+		return err
+	})
+}
+
+func (r *envReader) int(name string, value *int) {
+	r.parse(name, func(v string) (err error) {
+		*value, err = strconv.Atoi(v)
+		return err
+	})
+}
+
+func (r *envReader) float(name string, value *float64) {
+	r.parse(name, func(v string) (err error) {
+		*value, err = strconv.ParseFloat(v, 64)
+		return err
+	})
+}
+
+func (r *envReader) duration(name string, value *time.Duration) {
+	r.parse(name, func(v string) (err error) {
+		*value, err = time.ParseDuration(v)
+		return err
+	})
+}
+
+func (r *envReader) parse(name string, parse func(string) error) {
+	v := os.Getenv(name)
+	if v == "" || r.err != nil {
+		return
+	}
+
+	if err := parse(v); err != nil {
+		r.err = fmt.Errorf("environment variable '%s' has invalid value %q: %v", name, v, err)
+	}
+}
+
+// hostname is default instance ID of the replica, dots are replaced as they separate topic tokens
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ServiceName
+	}
+
+	return strings.Replace(name, ".", "-", -1)
+}
+
+// splitList splits comma separated values, empty values are skipped
+func splitList(v string) []string {
+	values := []string{}
+
+	for _, value := range strings.Split(v, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
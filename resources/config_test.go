@@ -0,0 +1,217 @@
+package resources_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/resources"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+
+	dir string
+}
+
+func TestExecuteConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
+
+func (suite *ConfigTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "deviceproxy-config")
+	suite.Require().Nil(err)
+	suite.dir = dir
+}
+
+func (suite *ConfigTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+	os.Unsetenv(resources.EnvServicePort)
+	os.Unsetenv(resources.EnvPingInterval)
+}
+
+func (suite *ConfigTestSuite) Test_YAMLFileOverridesDefaults() {
+	config, err := resources.LoadConfig(suite.write("config.yaml", `
+nats:
+  url: nats://localhost:4222
+connection:
+  pingInterval: 15s
+mailbox:
+  mode: memory
+`))
+	suite.Require().Nil(err)
+
+	suite.Equal("nats://localhost:4222", config.NATS.URL)
+	suite.Equal(15*time.Second, config.Connection.PingInterval)
+	suite.Equal("memory", config.Mailbox.Mode)
+	suite.Equal("3001", config.Service.Port)
+	suite.Nil(config.Validate())
+}
+
+func (suite *ConfigTestSuite) Test_JSONFileIsAccepted() {
+	config, err := resources.LoadConfig(suite.write("config.json", `{
+	"service": {"port": "4000"},
+	"delivery": {"acks": true, "ackTimeout": "2s"}
+}`))
+	suite.Require().Nil(err)
+
+	suite.Equal("4000", config.Service.Port)
+	suite.True(config.Delivery.Acks)
+	suite.Equal(2*time.Second, config.Delivery.AckTimeout)
+}
+
+func (suite *ConfigTestSuite) Test_EnvironmentOverridesFile() {
+	os.Setenv(resources.EnvServicePort, "5000")
+
+	config, err := resources.LoadConfig(suite.write("config.yaml", "service:\n  port: \"4000\"\n"))
+	suite.Require().Nil(err)
+	suite.Equal("5000", config.Service.Port)
+}
+
+func (suite *ConfigTestSuite) Test_MalformedInputIsRejected() {
+	_, err := resources.LoadConfig(suite.write("config.yaml", "service:\n  prot: \"4000\"\n"))
+	suite.NotNil(err)
+
+	os.Setenv(resources.EnvPingInterval, "often")
+	_, err = resources.LoadConfig("")
+	suite.NotNil(err)
+}
+
+func (suite *ConfigTestSuite) Test_ValidateReportsEveryProblem() {
+	config := resources.DefaultConfig()
+	config.Auth.Mode = "jwt"
+	config.TLS.Mode = "mtls"
+
+	err := config.Validate()
+	suite.Require().NotNil(err)
+	suite.Contains(err.Error(), "NATS URL is required")
+	suite.Contains(err.Error(), "JWT secret is required")
+	suite.Contains(err.Error(), "client CA file is required")
+}
+
+func (suite *ConfigTestSuite) Test_PingsHaveToBeSentBeforePongWaitElapses() {
+	config := resources.DefaultConfig()
+	config.Queue.Mode = "memory"
+
+	config.Connection.PingInterval = 0
+	err := config.Validate()
+	suite.Require().NotNil(err)
+	suite.Contains(err.Error(), "ping interval has to be positive and shorter than pong wait")
+
+	config.Connection.PingInterval = config.Connection.PongWait
+	suite.NotNil(config.Validate())
+
+	config.Connection.PongWait = 0
+	suite.Nil(config.Validate())
+}
+
+func (suite *ConfigTestSuite) Test_DeliveryAcksNeedQueueWhichRedelivers() {
+	config := resources.DefaultConfig()
+	config.Queue.Mode = "mqtt"
+	config.MQTT.URL = "tcp://localhost:1883"
+	config.Delivery.Acks = true
+
+	err := config.Validate()
+	suite.Require().NotNil(err)
+	suite.Contains(err.Error(), "delivery acks need nats-streaming or memory queue")
+
+	config.Queue.Mode = "memory"
+	suite.Nil(config.Validate())
+}
+
+func (suite *ConfigTestSuite) Test_MemoryQueueDoesNotNeedNATS() {
+	config := resources.DefaultConfig()
+	config.Queue.Mode = "memory"
+
+	suite.Nil(config.Validate())
+}
+
+func (suite *ConfigTestSuite) Test_ClusterRequiresSharedQueueAndValidInstanceID() {
+	config := resources.DefaultConfig()
+	config.Queue.Mode = "memory"
+	config.Cluster.Enabled = true
+	config.Cluster.InstanceID = "proxy.1"
+	config.Cluster.RegistryTTL = config.Cluster.AnnounceInterval
+
+	err := config.Validate()
+	suite.Require().NotNil(err)
+	suite.Contains(err.Error(), "cluster can not be enabled in memory queue mode")
+	suite.Contains(err.Error(), `invalid cluster instance ID "proxy.1"`)
+	suite.Contains(err.Error(), "cluster registry TTL has to be longer than positive announce interval")
+}
+
+func (suite *ConfigTestSuite) Test_TenancyRequiresTenantInEveryTopic() {
+	config, err := resources.LoadConfig(suite.write("config.yaml", `
+nats:
+  url: nats://localhost:4222
+topics:
+  publish: "{tenant}.devices.{tag}.up"
+  event: "{tenant}.devices.{tag}.down"
+tenancy:
+  source: subdomain
+  domain: devices.example.com
+  maxConnections: 100
+  quotas:
+    acme: 5
+`))
+	suite.Require().Nil(err)
+
+	suite.Equal(5, config.Tenancy.Quota("acme"))
+	suite.Equal(100, config.Tenancy.Quota("other"))
+
+	err = config.Validate()
+	suite.Require().NotNil(err)
+	suite.Contains(err.Error(), "every topic template has to contain {tenant}")
+
+	config.Topics.Ack = "{tenant}.devices.{tag}.ack"
+	config.Topics.RPC = "{tenant}.devices.{tag}.rpc"
+	suite.Nil(config.Validate())
+
+	config.TLS = resources.TLSConfig{Mode: "mtls", CertFile: "cert.pem", KeyFile: "key.pem", ClientCAFile: "ca.pem", CertIdentity: "cn"}
+	err = config.Validate()
+	suite.Require().NotNil(err)
+	suite.Contains(err.Error(), "client certificates do not tell tenant")
+
+	config.Auth.Mode = "psk"
+	config.Auth.PSKFile = "keys"
+	suite.Nil(config.Validate())
+}
+
+func (suite *ConfigTestSuite) Test_DeviceLimitsOverrideDefaultLimits() {
+	config, err := resources.LoadConfig(suite.write("config.yaml", `
+nats:
+  url: nats://localhost:4222
+limits:
+  maxMessageSize: 4096
+  connectionRate: 5
+  connectionBurst: 10
+  violation: delay
+  devices:
+    gateway:
+      maxMessageSize: 65536
+      deviceRate: 50
+`))
+	suite.Require().Nil(err)
+	suite.Nil(config.Validate())
+
+	suite.Equal(resources.DeviceLimits{MaxMessageSize: 4096, ConnectionRate: 5, ConnectionBurst: 10}, config.Limits.For("sensor"))
+	suite.Equal(resources.DeviceLimits{MaxMessageSize: 65536, DeviceRate: 50}, config.Limits.For("gateway"))
+
+	config.Limits.Violation = "ignore"
+	config.Limits.Devices["gateway"] = resources.DeviceLimits{DeviceRate: -1}
+
+	err = config.Validate()
+	suite.Require().NotNil(err)
+	suite.Contains(err.Error(), "unknown limit violation policy")
+	suite.Contains(err.Error(), `limits of device "gateway" can not be negative`)
+}
+
+func (suite *ConfigTestSuite) write(name, content string) string {
+	path := filepath.Join(suite.dir, name)
+	suite.Require().Nil(ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
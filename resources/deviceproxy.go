@@ -1,89 +1,78 @@
 package resources
 
-import (
-	"fmt"
-	"log"
-	"os"
-	"strconv"
-
-	queuewrapper "git.krk.awesome-ind.com/GoUtils/QueueWrapper"
-	stan "github.com/nats-io/go-nats-streaming"
-)
-
 const (
 	ServiceName = "DeviceProxy"
 
-	EnvDeviceProxyEndpoint = "DeviceProxyEndpoint"
-	EnvServicePort         = "DeviceProxyServicePort"
-	EnvDeviceProxyLogDebug = "DeviceProxyLogDebug"
+	EnvConfigFile             = "DeviceProxyConfigFile"
+	EnvDeviceProxyEndpoint    = "DeviceProxyEndpoint"
+	EnvServicePort            = "DeviceProxyServicePort"
+	EnvDeviceProxyLogDebug    = "DeviceProxyLogDebug"
+	EnvSendQueueSize          = "DeviceProxySendQueueSize"
+	EnvSendQueueOverflow      = "DeviceProxySendQueueOverflow"
+	EnvAuthMode               = "DeviceProxyAuthMode"
+	EnvJWTSecret              = "DeviceProxyJWTSecret"
+	EnvPSKFile                = "DeviceProxyPSKFile"
+	EnvPingInterval           = "DeviceProxyPingInterval"
+	EnvPongWait               = "DeviceProxyPongWait"
+	EnvReadIdleTimeout        = "DeviceProxyReadIdleTimeout"
+	EnvCompression            = "DeviceProxyCompression"
+	EnvCompressionLevel       = "DeviceProxyCompressionLevel"
+	EnvCompressionThreshold   = "DeviceProxyCompressionThreshold"
+	EnvAllowedOrigins         = "DeviceProxyAllowedOrigins"
+	EnvAllowEmptyOrigin       = "DeviceProxyAllowEmptyOrigin"
+	EnvMaxMessageSize         = "DeviceProxyMaxMessageSize"
+	EnvConnectionRate         = "DeviceProxyConnectionRate"
+	EnvConnectionBurst        = "DeviceProxyConnectionBurst"
+	EnvDeviceRate             = "DeviceProxyDeviceRate"
+	EnvDeviceBurst            = "DeviceProxyDeviceBurst"
+	EnvLimitViolation         = "DeviceProxyLimitViolation"
+	EnvMailboxMode            = "DeviceProxyMailboxMode"
+	EnvMailboxDir             = "DeviceProxyMailboxDir"
+	EnvMailboxSize            = "DeviceProxyMailboxSize"
+	EnvMailboxTTL             = "DeviceProxyMailboxTTL"
+	EnvDeliveryAcks           = "DeviceProxyDeliveryAcks"
+	EnvAckTimeout             = "DeviceProxyAckTimeout"
+	EnvRawPayloads            = "DeviceProxyRawPayloads"
+	EnvEnvelopeHeaders        = "DeviceProxyEnvelopeHeaders"
+	EnvRPCEnabled             = "DeviceProxyRPCEnabled"
+	EnvRPCTimeout             = "DeviceProxyRPCTimeout"
+	EnvRPCReplyPrefix         = "DeviceProxyRPCReplyPrefix"
+	EnvPresenceTopic          = "DeviceProxyPresenceTopic"
+	EnvTopicTenant            = "DeviceProxyTopicTenant"
+	EnvTopicPublish           = "DeviceProxyTopicPublish"
+	EnvTopicEvent             = "DeviceProxyTopicEvent"
+	EnvTopicAck               = "DeviceProxyTopicAck"
+	EnvTopicRPC               = "DeviceProxyTopicRPC"
+	EnvTenantSource           = "DeviceProxyTenantSource"
+	EnvTenantDomain           = "DeviceProxyTenantDomain"
+	EnvTenantMaxConnections   = "DeviceProxyTenantMaxConnections"
+	EnvClusterEnabled         = "DeviceProxyClusterEnabled"
+	EnvClusterInstanceID      = "DeviceProxyClusterInstanceID"
+	EnvClusterTopic           = "DeviceProxyClusterTopic"
+	EnvClusterAnnounce        = "DeviceProxyClusterAnnounceInterval"
+	EnvClusterRegistryTTL     = "DeviceProxyClusterRegistryTTL"
+	EnvTLSMode                = "DeviceProxyTLSMode"
+	EnvTLSCertFile            = "DeviceProxyTLSCertFile"
+	EnvTLSKeyFile             = "DeviceProxyTLSKeyFile"
+	EnvTLSClientCAFile        = "DeviceProxyTLSClientCAFile"
+	EnvTLSCRLFile             = "DeviceProxyTLSCRLFile"
+	EnvTLSCertIdentity        = "DeviceProxyTLSCertIdentity"
+	EnvDrainTimeout           = "DeviceProxyDrainTimeout"
+	EnvAcceptLoopTimeout      = "DeviceProxyAcceptLoopTimeout"
+	EnvMetricsEndpoint        = "DeviceProxyMetricsEndpoint"
+	EnvAdminPort              = "DeviceProxyAdminPort"
+	EnvAdminToken             = "DeviceProxyAdminToken"
+	EnvQueueMode              = "DeviceProxyQueueMode"
+	EnvQueueRedeliveryDelay   = "DeviceProxyQueueRedeliveryDelay"
+	EnvQueueClientID          = "DeviceProxyQueueClientID"
+	EnvQueueReconnectDelay    = "DeviceProxyQueueReconnectDelay"
+	EnvQueueReconnectMaxDelay = "DeviceProxyQueueReconnectMaxDelay"
+	EnvMQTTURL                = "DeviceProxyMQTTURL"
+	EnvMQTTUsername           = "DeviceProxyMQTTUsername"
+	EnvMQTTPassword           = "DeviceProxyMQTTPassword"
 
 	NATSEnvURLName     = "nats_URL_deviceproxy"
 	NATSEnvClusterName = "nats_cluster_deviceproxy"
 	NATSEnvUserName    = "nats_username_deviceproxy"
 	NATSEnvPassName    = "nats_password_deviceproxy"
 )
-
-var (
-	// DeviceProxyEndpoint ...
-	DeviceProxyEndpoint = "/deviceproxy"
-	// ServicePort ...
-	ServicePort = "3001"
-	// NATSURL says where to connects for NATS queueing
-	NATSURL = ""
-	// NATSClusterName holds NATS cluster name to connect to
-	NATSClusterName = "FitStationCluster"
-	// NATSUsername keeps username for NATS cluser
-	NATSUsername = "nats"
-	// NATSPassword keeps username for NATS cluser
-	NATSPassword = "nats"
-	// DeviceProxyLogDebug ...
-	DeviceProxyLogDebug = false
-)
-
-func init() {
-	initNATSEnvs()
-	initServiceEnvs()
-}
-
-func connectionLostHandler(_ stan.Conn, reason error) {
-	log.Fatalf("[FATAL] NATS connection lost and reconnection failed, reason: %v", reason)
-}
-
-// NewServiceMsgQueue ...
-func NewServiceMsgQueue() queuewrapper.IMsgQueue {
-	if NATSURL == "" {
-		panic(fmt.Sprintf("[ERROR] Environment variable '%s' is empty or not set. NATS is required for this service, please make sure all enviroement variables (%s, %s, %s, %s) are set",
-			NATSEnvURLName, NATSEnvURLName, NATSEnvClusterName, NATSEnvUserName, NATSEnvPassName))
-	}
-
-	return queuewrapper.NewMsgQueueNATS(NATSURL, NATSClusterName, ServiceName, NATSUsername, NATSPassword, connectionLostHandler)
-}
-
-func initNATSEnvs() {
-	if url := os.Getenv(NATSEnvURLName); url != "" {
-		NATSURL = url
-	}
-	if cluster := os.Getenv(NATSEnvClusterName); cluster != "" {
-		NATSClusterName = cluster
-	}
-	if user := os.Getenv(NATSEnvUserName); user != "" {
-		NATSUsername = user
-	}
-	if pwd := os.Getenv(NATSEnvPassName); pwd != "" {
-		NATSPassword = pwd
-	}
-}
-
-func initServiceEnvs() {
-	if servicePort := os.Getenv(EnvServicePort); servicePort != "" {
-		ServicePort = servicePort
-	}
-
-	if deviceEndpoint := os.Getenv(EnvDeviceProxyEndpoint); deviceEndpoint != "" {
-		DeviceProxyEndpoint = deviceEndpoint
-	}
-
-	if deviceLogDebug := os.Getenv(EnvDeviceProxyLogDebug); deviceLogDebug != "" {
-		DeviceProxyLogDebug, _ = strconv.ParseBool(deviceLogDebug)
-	}
-}
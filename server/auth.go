@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"deviceproxy/model"
+)
+
+var (
+	// ErrMissingCredentials ...
+	ErrMissingCredentials = errors.New(logPrefix + "Missing bearer token")
+	// ErrInvalidCredentials ...
+	ErrInvalidCredentials = errors.New(logPrefix + "Invalid credentials")
+	// ErrDeviceTagMismatch is returned when credentials belong to other device than the requested one
+	ErrDeviceTagMismatch = errors.New(logPrefix + "Credentials do not match requested device tag")
+	// ErrTenantMismatch is returned when credentials belong to other tenant than the one of the request
+	ErrTenantMismatch = errors.New(logPrefix + "Credentials do not belong to tenant of the request")
+	// ErrTenantsNotSupported is returned when tenants are enabled and authenticator can not tell tenant of credentials
+	ErrTenantsNotSupported = errors.New(logPrefix + "Authenticator can not bind credentials to tenant")
+)
+
+// Authenticator is consulted before the http request is upgraded to websocket.
+// It gets device tag requested in URL (may be empty) and returns the device tag the connection is allowed to use.
+type Authenticator interface {
+	Authenticate(req *http.Request, deviceTag string) (string, error)
+}
+
+// TenantAuthenticator is implemented by authenticators which know tenant of credentials. With tenants enabled it is
+// used instead of Authenticate with tenant resolved for the request, so credentials of one tenant can not be used
+// in another one. Authenticators which do not implement it reject all requests when tenants are enabled.
+type TenantAuthenticator interface {
+	AuthenticateInTenant(req *http.Request, tenant, deviceTag string) (string, error)
+}
+
+// AuthenticatorFunc allows to use custom callback as Authenticator
+type AuthenticatorFunc func(req *http.Request, deviceTag string) (string, error)
+
+// Authenticate ...
+func (f AuthenticatorFunc) Authenticate(req *http.Request, deviceTag string) (string, error) {
+	return f(req, deviceTag)
+}
+
+// JWTAuthenticator accepts HMAC signed JWT bearer tokens with deviceTag claim
+type JWTAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// NewJWTAuthenticator ...
+func NewJWTAuthenticator(secret []byte) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		secret: secret,
+		now:    time.Now,
+	}
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+type jwtClaims struct {
+	DeviceTag string `json:"deviceTag"`
+	Tenant    string `json:"tenant"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// Authenticate ...
+func (a *JWTAuthenticator) Authenticate(req *http.Request, deviceTag string) (string, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return "", ErrMissingCredentials
+	}
+
+	claims, err := a.parse(token)
+	if err != nil {
+		return "", err
+	}
+
+	return matchDeviceTag(deviceTag, claims.DeviceTag)
+}
+
+// AuthenticateInTenant accepts only tokens with tenant claim equal to the tenant
+func (a *JWTAuthenticator) AuthenticateInTenant(req *http.Request, tenant, deviceTag string) (string, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return "", ErrMissingCredentials
+	}
+
+	claims, err := a.parse(token)
+	if err != nil {
+		return "", err
+	}
+
+	if claims.Tenant != tenant {
+		return "", ErrTenantMismatch
+	}
+
+	return matchDeviceTag(deviceTag, claims.DeviceTag)
+}
+
+// ResolveTenant returns tenant claim of the token so JWTAuthenticator can be used as TenantResolver
+func (a *JWTAuthenticator) ResolveTenant(req *http.Request) (string, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return "", ErrMissingCredentials
+	}
+
+	claims, err := a.parse(token)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Tenant, nil
+}
+
+func (a *JWTAuthenticator) parse(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+
+	header := jwtHeader{}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	var newHash func() hash.Hash
+	switch header.Algorithm {
+	case "HS256":
+		newHash = sha256.New
+	case "HS384":
+		newHash = sha512.New384
+	case "HS512":
+		newHash = sha512.New
+	default:
+		return nil, fmt.Errorf(logPrefix+"Unsupported token algorithm:%v", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	mac := hmac.New(newHash, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	now := a.now().Unix()
+
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, fmt.Errorf(logPrefix + "Token expired")
+	}
+
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf(logPrefix + "Token not valid yet")
+	}
+
+	if claims.DeviceTag == "" {
+		return nil, fmt.Errorf(logPrefix + "Token does not contain deviceTag claim")
+	}
+
+	return &claims, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// PSKAuthenticator accepts bearer tokens equal to the key pre-shared with the device
+type PSKAuthenticator struct {
+	keys map[string]string
+}
+
+// NewPSKAuthenticator ...
+func NewPSKAuthenticator(keys map[string]string) *PSKAuthenticator {
+	return &PSKAuthenticator{keys: keys}
+}
+
+// NewPSKAuthenticatorFromFile reads keys from file with one "deviceTag:key" entry per line, device tags are scoped
+// with tenant when tenants are enabled ("acme/sensor-1:key"). Empty lines and lines starting with # are ignored.
+func NewPSKAuthenticatorFromFile(path string) (*PSKAuthenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(file)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.Index(line, ":")
+		if separator < 1 || separator == len(line)-1 {
+			return nil, fmt.Errorf(logPrefix+"Malformed pre-shared key file %v at line %v", path, lineNumber)
+		}
+
+		keys[line[:separator]] = line[separator+1:]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewPSKAuthenticator(keys), nil
+}
+
+// Authenticate ...
+func (a *PSKAuthenticator) Authenticate(req *http.Request, deviceTag string) (string, error) {
+	return a.AuthenticateInTenant(req, "", deviceTag)
+}
+
+// AuthenticateInTenant checks key of the device tag scoped with the tenant
+func (a *PSKAuthenticator) AuthenticateInTenant(req *http.Request, tenant, deviceTag string) (string, error) {
+	if deviceTag == "" {
+		return "", fmt.Errorf(logPrefix + "URL Param 'deviceTag' is missing")
+	}
+
+	token, ok := bearerToken(req)
+	if !ok {
+		return "", ErrMissingCredentials
+	}
+
+	key, ok := a.keys[model.ScopeDeviceTag(tenant, deviceTag)]
+	if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(token)) != 1 {
+		return "", ErrInvalidCredentials
+	}
+
+	return deviceTag, nil
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	const prefix = "Bearer "
+
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return "", false
+	}
+
+	token := strings.TrimSpace(authorization[len(prefix):])
+
+	return token, token != ""
+}
+
+// matchDeviceTag returns device tag the client is allowed to use or error if it asked for other one
+func matchDeviceTag(requested, authenticated string) (string, error) {
+	if requested != "" && requested != authenticated {
+		return "", ErrDeviceTagMismatch
+	}
+
+	return authenticated, nil
+}
@@ -0,0 +1,115 @@
+package server_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"deviceproxy/server"
+)
+
+func signJWT(secret, claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func requestWithToken(token string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/deviceproxy", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestJWTAuthenticatorTakesDeviceTagFromClaim(t *testing.T) {
+	authenticator := server.NewJWTAuthenticator([]byte("secret"))
+
+	deviceTag, err := authenticator.Authenticate(requestWithToken(signJWT("secret", `{"deviceTag":"device1"}`)), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "device1", deviceTag)
+
+	deviceTag, err = authenticator.Authenticate(requestWithToken(signJWT("secret", `{"deviceTag":"device1"}`)), "device1")
+	assert.Nil(t, err)
+	assert.Equal(t, "device1", deviceTag)
+}
+
+func TestJWTAuthenticatorRejectsInvalidTokens(t *testing.T) {
+	authenticator := server.NewJWTAuthenticator([]byte("secret"))
+
+	_, err := authenticator.Authenticate(requestWithToken(""), "device1")
+	assert.Equal(t, server.ErrMissingCredentials, err)
+
+	_, err = authenticator.Authenticate(requestWithToken(signJWT("other", `{"deviceTag":"device1"}`)), "device1")
+	assert.Equal(t, server.ErrInvalidCredentials, err)
+
+	_, err = authenticator.Authenticate(requestWithToken(signJWT("secret", `{"deviceTag":"device1"}`)), "device2")
+	assert.Equal(t, server.ErrDeviceTagMismatch, err)
+
+	expired := signJWT("secret", fmt.Sprintf(`{"deviceTag":"device1","exp":%v}`, time.Now().Add(-time.Minute).Unix()))
+	_, err = authenticator.Authenticate(requestWithToken(expired), "device1")
+	assert.NotNil(t, err)
+}
+
+func TestPSKAuthenticatorReadsKeysFromFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "psk")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString("# devices\ndevice1:key1\n\ndevice2:key2\n")
+	file.Close()
+
+	authenticator, err := server.NewPSKAuthenticatorFromFile(file.Name())
+	assert.Nil(t, err)
+
+	deviceTag, err := authenticator.Authenticate(requestWithToken("key2"), "device2")
+	assert.Nil(t, err)
+	assert.Equal(t, "device2", deviceTag)
+
+	_, err = authenticator.Authenticate(requestWithToken("key1"), "device2")
+	assert.Equal(t, server.ErrInvalidCredentials, err)
+}
+
+func TestAuthenticatorsBindCredentialsToTenant(t *testing.T) {
+	jwtAuthenticator := server.NewJWTAuthenticator([]byte("secret"))
+	token := signJWT("secret", `{"deviceTag":"device1","tenant":"acme"}`)
+
+	deviceTag, err := jwtAuthenticator.AuthenticateInTenant(requestWithToken(token), "acme", "device1")
+	assert.Nil(t, err)
+	assert.Equal(t, "device1", deviceTag)
+
+	_, err = jwtAuthenticator.AuthenticateInTenant(requestWithToken(token), "other", "device1")
+	assert.Equal(t, server.ErrTenantMismatch, err)
+
+	_, err = jwtAuthenticator.AuthenticateInTenant(requestWithToken(signJWT("secret", `{"deviceTag":"device1"}`)), "acme", "device1")
+	assert.Equal(t, server.ErrTenantMismatch, err)
+
+	file, err := ioutil.TempFile("", "psk")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString("acme/device1:key1\n")
+	file.Close()
+
+	pskAuthenticator, err := server.NewPSKAuthenticatorFromFile(file.Name())
+	assert.Nil(t, err)
+
+	deviceTag, err = pskAuthenticator.AuthenticateInTenant(requestWithToken("key1"), "acme", "device1")
+	assert.Nil(t, err)
+	assert.Equal(t, "device1", deviceTag)
+
+	_, err = pskAuthenticator.AuthenticateInTenant(requestWithToken("key1"), "other", "device1")
+	assert.Equal(t, server.ErrInvalidCredentials, err)
+}
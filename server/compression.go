@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// countingConn counts bytes written to the network so compression ratio of sent messages can be measured
+type countingConn struct {
+	net.Conn
+	written uint64 //NOTE: accessed atomically
+}
+
+func (c *countingConn) Write(data []byte) (int, error) {
+	n, err := c.Conn.Write(data)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesWritten() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
+
+// countingResponseWriter wraps connection hijacked by websocket upgrader in countingConn
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New(logPrefix + "Response does not implement http.Hijacker")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &countingConn{Conn: conn}
+
+	return w.conn, rw, nil
+}
+
+// offersCompression says whether the client offered permessage-deflate, the upgrader accepts it when compression is enabled
+func offersCompression(req *http.Request) bool {
+	for _, header := range req.Header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.SplitN(extension, ";", 2)[0])
+			if name == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
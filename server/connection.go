@@ -0,0 +1,372 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"deviceproxy/metrics"
+	"deviceproxy/model"
+)
+
+// OverflowPolicy says what happens with a message that does not fit into outbound queue of a connection
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest removes the oldest queued message to make room for the new one
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the message that does not fit into the queue
+	OverflowDropNewest
+	// OverflowDisconnect closes connection of the client which can not keep up with incoming messages
+	OverflowDisconnect
+)
+
+// Reasons passed to Listener.OnClientDisconnected
+const (
+	DisconnectReasonClosedByClient = "closed by client"
+	DisconnectReasonConnectionLost = "connection lost"
+	DisconnectReasonPongTimeout    = "pong timeout"
+	DisconnectReasonIdleTimeout    = "idle timeout"
+	DisconnectReasonSlowConsumer   = "slow consumer"
+	DisconnectReasonWriteError     = "write error"
+	DisconnectReasonKicked         = "disconnected by admin"
+	DisconnectReasonServerShutdown = "server shutdown"
+	DisconnectReasonMessageTooBig  = "message too big"
+	DisconnectReasonRateLimited    = "rate limit exceeded"
+)
+
+const writeWait = 10 * time.Second
+
+var (
+	errConnectionClosed  = errors.New(logPrefix + "Connection is closed")
+	errOutboundQueueFull = errors.New(logPrefix + "Outbound queue of the connection is full")
+)
+
+// ParseOverflowPolicy ...
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch policy {
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	case "disconnect":
+		return OverflowDisconnect, nil
+	}
+
+	return OverflowDropOldest, fmt.Errorf(logPrefix+"Unknown overflow policy:%v", policy)
+}
+
+type connectionSettings struct {
+	sendQueueSize   int
+	overflowPolicy  OverflowPolicy
+	pingInterval    time.Duration
+	pongWait        time.Duration
+	readIdleTimeout time.Duration
+	// compressionLevel and compressionThreshold apply to connections which negotiated permessage-deflate
+	compressionLevel     int
+	compressionThreshold int
+}
+
+type outboundMsg struct {
+	messageType int
+	data        []byte
+}
+
+// clientConnection wraps websocket of a single client. websocket.Conn supports only one concurrent writer
+// so every write has to go through the outbound queue drained by writeLoop
+type clientConnection struct {
+	//NOTE: counters are accessed atomically, they have to stay first in the struct for alignment
+	dropped     uint64
+	messagesIn  uint64
+	messagesOut uint64
+
+	id            string
+	tenant        string
+	deviceTag     string // scoped with tenant
+	remoteAddr    string
+	connectedAt   time.Time
+	ws            *websocket.Conn
+	settings      connectionSettings
+	metrics       *metrics.Metrics
+	outbound      chan outboundMsg
+	onDrop        func()
+	closed        chan struct{}
+	closeOnce     sync.Once
+	closeReason   string // written once under closeOnce, read only after closed channel is closed
+	lastMessageAt time.Time
+	wire          *countingConn // nil when compression has not been negotiated
+	rateLimit     *tokenBucket  // nil when connection rate is not limited
+	deviceLimit   *tokenBucket  // shared with other connections of the device tag, nil when device rate is not limited
+}
+
+func newClientConnection(id, deviceTag string, ws *websocket.Conn, settings connectionSettings, metrics *metrics.Metrics, onDrop func()) *clientConnection {
+	connection := &clientConnection{
+		id:          id,
+		deviceTag:   deviceTag,
+		connectedAt: time.Now().UTC(),
+		ws:          ws,
+		settings:    settings,
+		metrics:     metrics,
+		outbound:    make(chan outboundMsg, settings.sendQueueSize),
+		onDrop:      onDrop,
+		closed:      make(chan struct{}),
+	}
+
+	if ws != nil {
+		connection.remoteAddr = ws.RemoteAddr().String()
+	}
+
+	return connection
+}
+
+func (c *clientConnection) send(msg outboundMsg) error {
+	select {
+	case <-c.closed:
+		return errConnectionClosed
+	default:
+	}
+
+	for {
+		select {
+		case c.outbound <- msg:
+			return nil
+		default:
+		}
+
+		switch c.settings.overflowPolicy {
+		case OverflowDropNewest:
+			c.drop()
+			return errOutboundQueueFull
+		case OverflowDisconnect:
+			c.drop()
+			log.Printf(logPrefix+"Closing connection of slow consumer. Device tag:%v connection:%v\n", c.deviceTag, c.id)
+			c.close(DisconnectReasonSlowConsumer)
+			return errOutboundQueueFull
+		default:
+			select {
+			case <-c.outbound:
+				c.drop()
+			default:
+			}
+		}
+	}
+}
+
+// sendWait waits up to timeout for room in the outbound queue instead of applying overflow policy
+func (c *clientConnection) sendWait(msg outboundMsg, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.closed:
+		return errConnectionClosed
+	default:
+	}
+
+	select {
+	case c.outbound <- msg:
+		return nil
+	case <-c.closed:
+		return errConnectionClosed
+	case <-timer.C:
+		return errOutboundQueueFull
+	}
+}
+
+func (c *clientConnection) writeLoop() {
+	var ping <-chan time.Time
+
+	if c.settings.pingInterval > 0 {
+		ticker := time.NewTicker(c.settings.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case msg := <-c.outbound:
+			writeStart := time.Now()
+			compressed := c.wire != nil && len(msg.data) >= c.settings.compressionThreshold
+
+			var wireBefore uint64
+			if c.wire != nil {
+				c.ws.EnableWriteCompression(compressed)
+				wireBefore = c.wire.bytesWritten()
+			}
+
+			err := c.ws.WriteMessage(msg.messageType, msg.data)
+
+			if err != nil {
+				log.Printf(logPrefix+"Error writing message to connection. Device tag:%v Err:%v\n", c.deviceTag, err)
+				c.close(DisconnectReasonWriteError)
+				return
+			}
+
+			atomic.AddUint64(&c.messagesOut, 1)
+			c.metrics.MessageSent(time.Since(writeStart))
+
+			if compressed {
+				c.metrics.MessageCompressed(len(msg.data), int(c.wire.bytesWritten()-wireBefore))
+			}
+		case <-ping:
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+
+			if err != nil {
+				log.Printf(logPrefix+"Error sending ping to connection. Device tag:%v Err:%v\n", c.deviceTag, err)
+				c.close(DisconnectReasonWriteError)
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// enableCompression turns compression of outbound messages on for connection which negotiated permessage-deflate,
+// it has to be called before writeLoop starts
+func (c *clientConnection) enableCompression(wire *countingConn) {
+	if wire == nil {
+		return
+	}
+
+	if err := c.ws.SetCompressionLevel(c.settings.compressionLevel); err != nil {
+		log.Printf(logPrefix+"Invalid compression level %v, using default. Err:%v\n", c.settings.compressionLevel, err)
+	}
+
+	c.wire = wire
+}
+
+// startReading arms heartbeat deadlines, it has to be called from the reading goroutine before the first read
+func (c *clientConnection) startReading() {
+	c.lastMessageAt = time.Now()
+	c.refreshReadDeadline(c.lastMessageAt)
+
+	c.ws.SetPongHandler(func(string) error {
+		c.refreshReadDeadline(time.Now())
+		return nil
+	})
+}
+
+func (c *clientConnection) read() (int, []byte, error) {
+	messageType, data, err := c.ws.ReadMessage()
+
+	if err == nil {
+		atomic.AddUint64(&c.messagesIn, 1)
+		c.metrics.MessageReceived()
+		c.lastMessageAt = time.Now()
+		c.refreshReadDeadline(c.lastMessageAt)
+	}
+
+	return messageType, data, err
+}
+
+// refreshReadDeadline moves read deadline to whichever comes first: missing pong or being idle for too long
+func (c *clientConnection) refreshReadDeadline(now time.Time) {
+	var deadline time.Time
+
+	if c.settings.pongWait > 0 {
+		deadline = now.Add(c.settings.pongWait)
+	}
+
+	if c.settings.readIdleTimeout > 0 {
+		idleDeadline := c.lastMessageAt.Add(c.settings.readIdleTimeout)
+
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+
+	c.ws.SetReadDeadline(deadline)
+}
+
+// disconnectReason explains why reading from the connection failed with err
+func (c *clientConnection) disconnectReason(err error) string {
+	select {
+	case <-c.closed:
+		if c.closeReason != "" {
+			return c.closeReason
+		}
+	default:
+	}
+
+	if err == websocket.ErrReadLimit {
+		return DisconnectReasonMessageTooBig
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if c.settings.readIdleTimeout > 0 && time.Since(c.lastMessageAt) >= c.settings.readIdleTimeout {
+			return DisconnectReasonIdleTimeout
+		}
+
+		return DisconnectReasonPongTimeout
+	}
+
+	if _, ok := err.(*websocket.CloseError); ok {
+		return DisconnectReasonClosedByClient
+	}
+
+	return DisconnectReasonConnectionLost
+}
+
+func (c *clientConnection) drop() {
+	atomic.AddUint64(&c.dropped, 1)
+
+	if c.onDrop != nil {
+		c.onDrop()
+	}
+}
+
+func (c *clientConnection) droppedMessages() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (c *clientConnection) info() model.ConnectionInfo {
+	deviceTag := c.deviceTag
+	if c.tenant != "" {
+		_, deviceTag = model.SplitScopedDeviceTag(c.deviceTag)
+	}
+
+	return model.ConnectionInfo{
+		ConnectionID:    c.id,
+		Tenant:          c.tenant,
+		DeviceTag:       deviceTag,
+		RemoteAddr:      c.remoteAddr,
+		ConnectedAt:     c.connectedAt,
+		MessagesIn:      atomic.LoadUint64(&c.messagesIn),
+		MessagesOut:     atomic.LoadUint64(&c.messagesOut),
+		DroppedMessages: c.droppedMessages(),
+	}
+}
+
+// close stops the writer and closes the socket which also unblocks the reader
+func (c *clientConnection) close(reason string) {
+	c.shutdown(reason, nil)
+}
+
+// closeWithMessage tells the client why it is disconnected before the connection is closed
+func (c *clientConnection) closeWithMessage(closeCode int, text, reason string) {
+	c.shutdown(reason, websocket.FormatCloseMessage(closeCode, text))
+}
+
+func (c *clientConnection) shutdown(reason string, closeMessage []byte) {
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		close(c.closed)
+
+		if closeMessage != nil {
+			err := c.ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+
+			if err != nil {
+				log.Printf(logPrefix+"Error sending close message to connection. Device tag:%v Err:%v\n", c.deviceTag, err)
+			}
+		}
+
+		c.ws.Close()
+	})
+}
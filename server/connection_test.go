@@ -0,0 +1,46 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func textMsg(s string) outboundMsg {
+	return outboundMsg{messageType: websocket.TextMessage, data: []byte(s)}
+}
+
+func TestDropOldestKeepsNewestMessages(t *testing.T) {
+	drops := 0
+	connection := newClientConnection("id", "tag", nil, connectionSettings{sendQueueSize: 2, overflowPolicy: OverflowDropOldest}, nil, func() { drops++ })
+
+	assert.Nil(t, connection.send(textMsg("1")))
+	assert.Nil(t, connection.send(textMsg("2")))
+	assert.Nil(t, connection.send(textMsg("3")))
+
+	assert.EqualValues(t, 1, drops)
+	assert.EqualValues(t, 1, connection.droppedMessages())
+	assert.Equal(t, "2", string((<-connection.outbound).data))
+	assert.Equal(t, "3", string((<-connection.outbound).data))
+}
+
+func TestDropNewestRejectsMessageThatDoesNotFit(t *testing.T) {
+	drops := 0
+	connection := newClientConnection("id", "tag", nil, connectionSettings{sendQueueSize: 1, overflowPolicy: OverflowDropNewest}, nil, func() { drops++ })
+
+	assert.Nil(t, connection.send(textMsg("1")))
+	assert.Equal(t, errOutboundQueueFull, connection.send(textMsg("2")))
+
+	assert.EqualValues(t, 1, drops)
+	assert.Equal(t, "1", string((<-connection.outbound).data))
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	policy, err := ParseOverflowPolicy("disconnect")
+	assert.Nil(t, err)
+	assert.Equal(t, OverflowDisconnect, policy)
+
+	_, err = ParseOverflowPolicy("unknown")
+	assert.NotNil(t, err)
+}
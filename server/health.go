@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"deviceproxy/model"
+)
+
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+var errDraining = errors.New("server is draining")
+
+// ReadinessCheck reports error when a dependency of the proxy can not serve traffic
+type ReadinessCheck func() error
+
+type namedReadinessCheck struct {
+	name  string
+	check ReadinessCheck
+}
+
+// AddReadinessCheck registers check consulted by readiness endpoint, it has to be called before Serve
+func (s *Server) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.readinessChecks = append(s.readinessChecks, namedReadinessCheck{name: name, check: check})
+}
+
+// LivenessHandler fails when accept loop has not accepted connections for longer than accept loop timeout
+func (s *Server) LivenessHandler(wr http.ResponseWriter, req *http.Request) {
+	if s.listener != nil && s.acceptLoopTimeout > 0 {
+		if stuckFor := s.listener.stuckFor(); stuckFor > s.acceptLoopTimeout {
+			s.writeHTTPResponse(wr, http.StatusServiceUnavailable, model.CodeError, fmt.Sprintf("accept loop stuck for %v", stuckFor))
+			return
+		}
+	}
+
+	s.writeHTTPResponse(wr, http.StatusOK, model.CodeSuccess, "ok")
+}
+
+// ReadinessHandler fails when server is draining or any of readiness checks fails
+func (s *Server) ReadinessHandler(wr http.ResponseWriter, req *http.Request) {
+	failures := []string{}
+
+	if s.isDraining() {
+		failures = append(failures, errDraining.Error())
+	}
+
+	for _, readinessCheck := range s.readinessChecks {
+		if err := readinessCheck.check(); err != nil {
+			failures = append(failures, readinessCheck.name+": "+err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		s.writeHTTPResponse(wr, http.StatusServiceUnavailable, model.CodeError, strings.Join(failures, "; "))
+		return
+	}
+
+	s.writeHTTPResponse(wr, http.StatusOK, model.CodeSuccess, "ready")
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// watchedListener remembers when its accept loop last came back for next connection
+type watchedListener struct {
+	net.Listener
+
+	accepting  int32 // 1 while Accept is blocked waiting for connection
+	returnedAt int64 // unix nanoseconds of the last return from Accept
+}
+
+func newWatchedListener(listener net.Listener) *watchedListener {
+	return &watchedListener{Listener: listener, returnedAt: time.Now().UnixNano()}
+}
+
+func (l *watchedListener) Accept() (net.Conn, error) {
+	atomic.StoreInt32(&l.accepting, 1)
+	conn, err := l.Listener.Accept()
+	atomic.StoreInt64(&l.returnedAt, time.Now().UnixNano())
+	atomic.StoreInt32(&l.accepting, 0)
+
+	return conn, err
+}
+
+// stuckFor says how long accept loop has not been waiting for connections
+func (l *watchedListener) stuckFor() time.Duration {
+	if atomic.LoadInt32(&l.accepting) == 1 {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, atomic.LoadInt64(&l.returnedAt)))
+}
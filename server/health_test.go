@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"deviceproxy/resources"
+)
+
+func TestLivenessFailsWhenAcceptLoopIsStuck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	s := NewServer(resources.DefaultConfig())
+	s.acceptLoopTimeout = 50 * time.Millisecond
+	s.listener = newWatchedListener(listener)
+
+	response := httptest.NewRecorder()
+	s.LivenessHandler(response, httptest.NewRequest(http.MethodGet, livenessPath, nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	atomic.StoreInt64(&s.listener.returnedAt, time.Now().Add(-time.Second).UnixNano())
+
+	response = httptest.NewRecorder()
+	s.LivenessHandler(response, httptest.NewRequest(http.MethodGet, livenessPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+
+	go s.listener.Accept()
+	time.Sleep(20 * time.Millisecond)
+
+	response = httptest.NewRecorder()
+	s.LivenessHandler(response, httptest.NewRequest(http.MethodGet, livenessPath, nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func TestReadinessFailsWhenCheckFailsOrServerIsDraining(t *testing.T) {
+	var queueErr error
+
+	s := NewServer(resources.DefaultConfig())
+	s.AddReadinessCheck("queue", func() error { return queueErr })
+
+	response := httptest.NewRecorder()
+	s.ReadinessHandler(response, httptest.NewRequest(http.MethodGet, readinessPath, nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	queueErr = errors.New("NATS connection is down")
+
+	response = httptest.NewRecorder()
+	s.ReadinessHandler(response, httptest.NewRequest(http.MethodGet, readinessPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Contains(t, response.Body.String(), "queue: NATS connection is down")
+
+	queueErr = nil
+	atomic.StoreInt32(&s.draining, 1)
+
+	response = httptest.NewRecorder()
+	s.ReadinessHandler(response, httptest.NewRequest(http.MethodGet, readinessPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ViolationPolicy says what happens with a message that exceeds rate limit of its connection or device
+type ViolationPolicy int
+
+const (
+	// ViolationReject answers the message with model.CodeRateLimited instead of passing it to Listener
+	ViolationReject ViolationPolicy = iota
+	// ViolationDelay stops reading from the connection until the message fits into the limit
+	ViolationDelay
+	// ViolationDisconnect closes connection of the client which exceeded the limit
+	ViolationDisconnect
+)
+
+// ParseViolationPolicy ...
+func ParseViolationPolicy(policy string) (ViolationPolicy, error) {
+	switch policy {
+	case "reject":
+		return ViolationReject, nil
+	case "delay":
+		return ViolationDelay, nil
+	case "disconnect":
+		return ViolationDisconnect, nil
+	}
+
+	return ViolationReject, fmt.Errorf(logPrefix+"Unknown limit violation policy:%v", policy)
+}
+
+// tokenBucket is refilled with rate tokens per second up to burst, every message takes one token.
+// Methods can be called on nil *tokenBucket which means no limit.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// newTokenBucket returns full bucket or nil when rate is not positive, burst is at least one token
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token when there is one
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// reserve takes a token even when the bucket is empty and returns how long to wait until the token is refilled
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// giveBack returns token taken for message which was not let through because of another limit
+func (b *tokenBucket) giveBack() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tokens++; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// sharedBucket limits all connections of one device tag
+type sharedBucket struct {
+	bucket      *tokenBucket
+	connections int
+}
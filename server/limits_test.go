@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketIsRefilledWithRate(t *testing.T) {
+	bucket := newTokenBucket(2, 2)
+	now := bucket.last
+
+	assert.True(t, bucket.allow(now))
+	assert.True(t, bucket.allow(now))
+	assert.False(t, bucket.allow(now))
+
+	assert.True(t, bucket.allow(now.Add(500*time.Millisecond)))
+	assert.False(t, bucket.allow(now.Add(500*time.Millisecond)))
+
+	assert.True(t, bucket.allow(now.Add(time.Hour)))
+	assert.True(t, bucket.allow(now.Add(time.Hour)))
+	assert.False(t, bucket.allow(now.Add(time.Hour)), "bucket holds no more than burst")
+}
+
+func TestTokenBucketReserveReturnsWait(t *testing.T) {
+	bucket := newTokenBucket(10, 1)
+	now := bucket.last
+
+	assert.Equal(t, time.Duration(0), bucket.reserve(now))
+	assert.Equal(t, 100*time.Millisecond, bucket.reserve(now))
+	assert.Equal(t, 200*time.Millisecond, bucket.reserve(now))
+}
+
+func TestBucketWithoutRateDoesNotLimit(t *testing.T) {
+	bucket := newTokenBucket(0, 10)
+	assert.Nil(t, bucket)
+
+	assert.True(t, bucket.allow(time.Now()))
+	assert.Equal(t, time.Duration(0), bucket.reserve(time.Now()))
+}
+
+func TestParseViolationPolicy(t *testing.T) {
+	policy, err := ParseViolationPolicy("delay")
+	assert.Nil(t, err)
+	assert.Equal(t, ViolationDelay, policy)
+
+	_, err = ParseViolationPolicy("unknown")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// OriginRegexpPrefix marks allowed origin pattern which is a regular expression
+const OriginRegexpPrefix = "re:"
+
+// OriginAny is the allowed origin pattern which lets in every origin
+const OriginAny = "*"
+
+// OriginPolicy decides which browser origins may open device connections. Allowed origins are exact
+// (https://app.example.com), wildcard subdomains (https://*.example.com), regular expressions prefixed with re:
+// which have to match the whole origin, or * for any origin.
+// Native devices usually send no Origin header, such requests pass only when empty origins are allowed.
+type OriginPolicy struct {
+	allowAll   bool
+	allowEmpty bool
+	exact      map[string]bool
+	wildcards  [][2]string // prefix and suffix around the wildcard
+	regexps    []*regexp.Regexp
+}
+
+// NewOriginPolicy returns policy allowing no origin when there are no patterns
+func NewOriginPolicy(patterns []string, allowEmpty bool) (*OriginPolicy, error) {
+	policy := &OriginPolicy{
+		allowEmpty: allowEmpty,
+		exact:      map[string]bool{},
+	}
+
+	for _, pattern := range patterns {
+		switch {
+		case pattern == OriginAny:
+			policy.allowAll = true
+		case strings.HasPrefix(pattern, OriginRegexpPrefix):
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, OriginRegexpPrefix) + ")$")
+			if err != nil {
+				return nil, fmt.Errorf(logPrefix+"Invalid origin pattern %q: %v", pattern, err)
+			}
+			policy.regexps = append(policy.regexps, re)
+		case strings.Contains(pattern, "://*."):
+			parts := strings.SplitN(strings.ToLower(pattern), "*", 2)
+			policy.wildcards = append(policy.wildcards, [2]string{parts[0], parts[1]})
+		default:
+			policy.exact[strings.ToLower(pattern)] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// Allowed ...
+func (p *OriginPolicy) Allowed(origin string) bool {
+	if origin == "" {
+		return p.allowEmpty
+	}
+
+	if p.allowAll {
+		return true
+	}
+
+	lowerOrigin := strings.ToLower(origin)
+
+	if p.exact[lowerOrigin] {
+		return true
+	}
+
+	for _, wildcard := range p.wildcards {
+		prefix, suffix := wildcard[0], wildcard[1]
+		if len(lowerOrigin) <= len(prefix)+len(suffix) || !strings.HasPrefix(lowerOrigin, prefix) || !strings.HasSuffix(lowerOrigin, suffix) {
+			continue
+		}
+
+		subdomain := lowerOrigin[len(prefix) : len(lowerOrigin)-len(suffix)]
+		if !strings.ContainsAny(subdomain, "/:@") {
+			return true
+		}
+	}
+
+	for _, re := range p.regexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckOrigin can be used as websocket.Upgrader.CheckOrigin
+func (p *OriginPolicy) CheckOrigin(req *http.Request) bool {
+	return p.Allowed(req.Header.Get("Origin"))
+}
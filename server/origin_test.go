@@ -0,0 +1,57 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"deviceproxy/server"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	policy, err := server.NewOriginPolicy([]string{
+		"https://app.example.com",
+		"https://*.devices.example.com",
+		`re:https://[a-z]+\.example\.org`,
+		`re:https://example\.(com|net)`,
+	}, false)
+	assert.Nil(t, err)
+
+	for origin, expected := range map[string]bool{
+		"https://app.example.com":               true,
+		"HTTPS://APP.EXAMPLE.COM":               true,
+		"http://app.example.com":                false,
+		"https://acme.devices.example.com":      true,
+		"https://a.b.devices.example.com":       true,
+		"https://devices.example.com":           false,
+		"https://evil.com/.devices.example.com": false,
+		"https://shop.example.org":              true,
+		"https://shop.example.org.evil.com":     false,
+		"https://example.net":                   true,
+		"https://example.com.evil.net":          false,
+		"https://evil.com/https://example.com":  false,
+		"https://evil.com":                      false,
+		"":                                      false,
+	} {
+		assert.Equal(t, expected, policy.Allowed(origin), origin)
+	}
+}
+
+func TestOriginPolicyAllowsAnyOriginOnlyExplicitly(t *testing.T) {
+	policy, err := server.NewOriginPolicy(nil, true)
+	assert.Nil(t, err)
+	assert.False(t, policy.Allowed("https://evil.com"))
+	assert.True(t, policy.Allowed(""))
+
+	policy, err = server.NewOriginPolicy([]string{server.OriginAny}, false)
+	assert.Nil(t, err)
+	assert.True(t, policy.Allowed("https://evil.com"))
+	assert.False(t, policy.Allowed(""))
+
+	policy, err = server.NewOriginPolicy([]string{"https://app.example.com"}, true)
+	assert.Nil(t, err)
+	assert.True(t, policy.Allowed(""))
+
+	_, err = server.NewOriginPolicy([]string{"re:("}, true)
+	assert.NotNil(t, err)
+}
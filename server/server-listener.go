@@ -1,9 +1,28 @@
 package server
 
+import "net/http"
+
 // Listener ...
 type Listener interface {
-	OnConnectionEstabilishedFromClient(connectionID string, deviceTag *string) error
+	OnConnectionEstabilishedFromClient(connectionID string, deviceTag *string, remoteAddr string) error
 	OnMessageReceivedFromClient(connectionID string, msg *string, deviceTag *string) error
-	OnClientDisconnected(connectionID string, deviceTag *string) error
+	OnClientDisconnected(connectionID string, deviceTag *string, reason string) error
 	OnServerStopped()
 }
+
+// ReadyListener is implemented by listeners which need to know when the client has received the handshake response,
+// e.g. to start sending it stored messages
+type ReadyListener interface {
+	OnConnectionReady(connectionID string, deviceTag *string)
+}
+
+// HeadersListener is implemented by listeners which need headers of the upgrade request, they are passed
+// before OnConnectionEstabilishedFromClient
+type HeadersListener interface {
+	OnConnectionHeaders(connectionID string, headers http.Header)
+}
+
+// BinaryListener is implemented by listeners which accept binary frames, they are rejected otherwise
+type BinaryListener interface {
+	OnBinaryMessageReceivedFromClient(connectionID string, msg []byte, deviceTag *string) error
+}
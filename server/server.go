@@ -2,78 +2,375 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	uuid "github.com/satori/go.uuid"
 
+	"deviceproxy/metrics"
 	"deviceproxy/model"
 	"deviceproxy/resources"
+	"deviceproxy/topics"
 )
 
 const (
-	deviceTag = "deviceTag"
-	logPrefix = "DeviceProxyServer "
+	deviceTagParam = "deviceTag"
+	logPrefix      = "DeviceProxyServer "
 )
 
 // Server ...
 type Server struct {
-	Listener    Listener
-	connections map[string]map[string]*websocket.Conn //NOTE: access to this map has to be synchronized
-	httpServer  *http.Server
-	mutex       sync.RWMutex
+	droppedMessages uint64 //NOTE: accessed atomically, has to stay first in the struct for alignment
+	draining        int32  //NOTE: accessed atomically
+
+	Listener      Listener
+	Authenticator Authenticator
+	// TenantResolver enables tenants, device tags passed to Listener are scoped with model.ScopeDeviceTag when set
+	TenantResolver TenantResolver
+	TLSConfig      *tls.Config
+	// Metrics collects traffic statistics and is served on metrics endpoint from config when set
+	Metrics         *metrics.Metrics
+	connections     map[string]map[string]*clientConnection //NOTE: access to this map has to be synchronized
+	connectionCount int
+	httpServer      *http.Server
+	listener        *watchedListener
+	mutex           sync.RWMutex
+	originPolicy    *OriginPolicy
+	upgrader        websocket.Upgrader
+	settings        connectionSettings
+
+	limits          resources.LimitsConfig
+	violationPolicy ViolationPolicy
+	deviceBuckets   map[string]*sharedBucket //NOTE: guarded by mutex
+
+	defaultTenant     string
+	tenancy           resources.TenancyConfig
+	tenantConnections map[string]int //NOTE: reserved before upgrade, guarded by mutex
+
+	readinessChecks   []namedReadinessCheck
+	endpoint          string
+	metricsEndpoint   string
+	acceptLoopTimeout time.Duration
+	drainTimeout      time.Duration
 }
 
 // NewServer ...
-func NewServer() *Server {
+func NewServer(config *resources.Config) *Server {
+	overflowPolicy, err := ParseOverflowPolicy(config.Connection.SendQueueOverflow)
+	if err != nil {
+		log.Printf(logPrefix+"%v, falling back to drop-oldest\n", err)
+	}
+
+	violationPolicy, err := ParseViolationPolicy(config.Limits.Violation)
+	if err != nil {
+		log.Printf(logPrefix+"%v, falling back to reject\n", err)
+	}
+
+	originPolicy, err := NewOriginPolicy(config.Connection.AllowedOrigins, config.Connection.AllowEmptyOrigin)
+	if err != nil {
+		log.Printf(logPrefix+"%v, rejecting all origins\n", err)
+		originPolicy = &OriginPolicy{allowEmpty: config.Connection.AllowEmptyOrigin}
+	}
+
 	return &Server{
-		connections: map[string]map[string]*websocket.Conn{},
-		mutex:       sync.RWMutex{},
+		connections:       map[string]map[string]*clientConnection{},
+		mutex:             sync.RWMutex{},
+		endpoint:          config.Service.Endpoint,
+		metricsEndpoint:   config.Monitoring.MetricsEndpoint,
+		acceptLoopTimeout: config.Monitoring.AcceptLoopTimeout,
+		drainTimeout:      config.Service.DrainTimeout,
+		defaultTenant:     config.Topics.Tenant,
+		tenancy:           config.Tenancy,
+		tenantConnections: map[string]int{},
+		originPolicy:      originPolicy,
+		limits:            config.Limits,
+		violationPolicy:   violationPolicy,
+		deviceBuckets:     map[string]*sharedBucket{},
+		upgrader: websocket.Upgrader{
+			CheckOrigin:       originPolicy.CheckOrigin,
+			EnableCompression: config.Connection.Compression,
+		},
+		settings: connectionSettings{
+			sendQueueSize:        config.Connection.SendQueueSize,
+			overflowPolicy:       overflowPolicy,
+			pingInterval:         config.Connection.PingInterval,
+			pongWait:             config.Connection.PongWait,
+			readIdleTimeout:      config.Connection.ReadIdleTimeout,
+			compressionLevel:     config.Connection.CompressionLevel,
+			compressionThreshold: config.Connection.CompressionThreshold,
+		},
 	}
 }
 
 // Serve ...
 func (s *Server) Serve(port string) error {
-	http.HandleFunc(resources.DeviceProxyEndpoint, s.ProxyHandler)
+	mux := http.NewServeMux()
 
-	s.httpServer = &http.Server{Addr: ":" + port, Handler: nil}
-	err := s.httpServer.ListenAndServe()
+	if _, ok := s.TenantResolver.(*PathTenantResolver); ok {
+		//NOTE: endpoints of tenants are prefixed with tenant so all paths have to reach the proxy handler
+		mux.HandleFunc("/", s.ProxyHandler)
+	} else {
+		mux.HandleFunc(s.endpoint, s.ProxyHandler)
+	}
+
+	mux.HandleFunc(livenessPath, s.LivenessHandler)
+	mux.HandleFunc(readinessPath, s.ReadinessHandler)
+
+	if s.Metrics != nil && s.metricsEndpoint != "" {
+		mux.Handle(s.metricsEndpoint, s.Metrics.Handler())
+	}
+
+	httpServer := &http.Server{Addr: ":" + port, Handler: mux, TLSConfig: s.TLSConfig}
+
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		s.Listener.OnServerStopped()
+		return err
+	}
+
+	watchedListener := newWatchedListener(listener)
+
+	s.mutex.Lock()
+	if s.isDraining() {
+		s.mutex.Unlock()
+		listener.Close()
+		s.Listener.OnServerStopped()
+		return http.ErrServerClosed
+	}
+	s.httpServer = httpServer
+	s.listener = watchedListener
+	s.mutex.Unlock()
+
+	if s.TLSConfig != nil {
+		err = httpServer.ServeTLS(watchedListener, "", "")
+	} else {
+		err = httpServer.Serve(watchedListener)
+	}
 
 	s.Listener.OnServerStopped()
 
 	return err
 }
 
-// Shutdown ...
+// Shutdown drains the server: new upgrades are rejected, devices are asked to reconnect with going away
+// close frame and their connections get up to drain timeout to finish in-flight publishes before http server stops
 func (s *Server) Shutdown() error {
-	return s.httpServer.Shutdown(context.Background())
+	atomic.StoreInt32(&s.draining, 1)
+
+	for _, connection := range s.liveConnections() {
+		connection.closeWithMessage(websocket.CloseGoingAway, "server going away, reconnect", DisconnectReasonServerShutdown)
+	}
+
+	if !s.waitForConnections(s.drainTimeout) {
+		log.Printf(logPrefix+"Drain timeout %v exceeded, %v connections are still open\n", s.drainTimeout, len(s.liveConnections()))
+	}
+
+	s.mutex.RLock()
+	httpServer := s.httpServer
+	s.mutex.RUnlock()
+
+	if httpServer == nil {
+		return nil
+	}
+
+	return httpServer.Shutdown(context.Background())
 }
 
 // SendMsg ...
 func (s *Server) SendMsg(msg, deviceTag string) error {
+	return s.sendToDevice(websocket.TextMessage, []byte(msg), deviceTag)
+}
+
+// SendBinaryMsg sends msg to all connections of the device as binary frame
+func (s *Server) SendBinaryMsg(msg []byte, deviceTag string) error {
+	return s.sendToDevice(websocket.BinaryMessage, msg, deviceTag)
+}
+
+func (s *Server) sendToDevice(messageType int, data []byte, deviceTag string) error {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	connections, connectionExists := s.connections[deviceTag]
 
 	if !connectionExists {
+		s.Metrics.SendFailed()
 		return fmt.Errorf(logPrefix+"Can not send message to client because there is not any websocket connection. Device tag:%v", deviceTag)
 	}
 
 	for _, connection := range connections {
-		err := connection.WriteMessage(websocket.TextMessage, []byte(msg))
+		err := connection.send(outboundMsg{messageType: messageType, data: data})
 
 		if err != nil {
-			log.Printf(logPrefix+"Error sending message to connection. Device tag:%v\n", deviceTag)
+			s.Metrics.SendFailed()
+			log.Printf(logPrefix+"Error sending message to connection. Device tag:%v Err:%v\n", deviceTag, err)
 		}
 	}
 
 	return nil
 }
 
+// SendMsgQueued waits up to timeout for room in outbound queues of the device connections instead of applying
+// overflow policy. Message is accepted when at least one connection queued it.
+func (s *Server) SendMsgQueued(msg, deviceTag string, timeout time.Duration) error {
+	return s.sendToDeviceQueued(websocket.TextMessage, []byte(msg), deviceTag, timeout)
+}
+
+// SendBinaryMsgQueued is SendMsgQueued for binary frames
+func (s *Server) SendBinaryMsgQueued(msg []byte, deviceTag string, timeout time.Duration) error {
+	return s.sendToDeviceQueued(websocket.BinaryMessage, msg, deviceTag, timeout)
+}
+
+func (s *Server) sendToDeviceQueued(messageType int, data []byte, deviceTag string, timeout time.Duration) error {
+	s.mutex.RLock()
+	connections := make([]*clientConnection, 0, len(s.connections[deviceTag]))
+	for _, connection := range s.connections[deviceTag] {
+		connections = append(connections, connection)
+	}
+	s.mutex.RUnlock()
+
+	if len(connections) == 0 {
+		s.Metrics.SendFailed()
+		return fmt.Errorf(logPrefix+"Can not send message to client because there is not any websocket connection. Device tag:%v", deviceTag)
+	}
+
+	var err error
+	accepted := false
+
+	for _, connection := range connections {
+		if err = connection.sendWait(outboundMsg{messageType: messageType, data: data}, timeout); err != nil {
+			log.Printf(logPrefix+"Error sending message to connection. Device tag:%v Err:%v\n", deviceTag, err)
+			continue
+		}
+
+		accepted = true
+	}
+
+	if !accepted {
+		s.Metrics.SendFailed()
+		return err
+	}
+
+	return nil
+}
+
+// Connections lists live connections sorted by tenant, device tag and connect time
+func (s *Server) Connections() []model.ConnectionInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	infos := []model.ConnectionInfo{}
+
+	for _, connections := range s.connections {
+		for _, connection := range connections {
+			infos = append(infos, connection.info())
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Tenant != infos[j].Tenant {
+			return infos[i].Tenant < infos[j].Tenant
+		}
+		if infos[i].DeviceTag != infos[j].DeviceTag {
+			return infos[i].DeviceTag < infos[j].DeviceTag
+		}
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+
+	return infos
+}
+
+// Disconnect closes connection with given ID, false is returned if there is no such connection
+func (s *Server) Disconnect(connectionID string) bool {
+	var kicked *clientConnection
+
+	s.mutex.RLock()
+	for _, connections := range s.connections {
+		if connection, ok := connections[connectionID]; ok {
+			kicked = connection
+			break
+		}
+	}
+	s.mutex.RUnlock()
+
+	if kicked == nil {
+		return false
+	}
+
+	//NOTE: closing writes close frame which may take long for stalled peer, so it is done without holding the mutex
+	kicked.closeWithMessage(websocket.ClosePolicyViolation, DisconnectReasonKicked, DisconnectReasonKicked)
+
+	return true
+}
+
+// DisconnectDevice closes all connections of the device and returns how many of them were closed
+func (s *Server) DisconnectDevice(deviceTag string) int {
+	s.mutex.RLock()
+	kicked := make([]*clientConnection, 0, len(s.connections[deviceTag]))
+	for _, connection := range s.connections[deviceTag] {
+		kicked = append(kicked, connection)
+	}
+	s.mutex.RUnlock()
+
+	for _, connection := range kicked {
+		connection.closeWithMessage(websocket.ClosePolicyViolation, DisconnectReasonKicked, DisconnectReasonKicked)
+	}
+
+	return len(kicked)
+}
+
+func (s *Server) liveConnections() []*clientConnection {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	live := []*clientConnection{}
+
+	for _, connections := range s.connections {
+		for _, connection := range connections {
+			live = append(live, connection)
+		}
+	}
+
+	return live
+}
+
+// waitForConnections waits until handlers of all connections return, false is returned on timeout
+func (s *Server) waitForConnections(timeout time.Duration) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+
+	for {
+		s.mutex.RLock()
+		connectionCount := s.connectionCount
+		s.mutex.RUnlock()
+
+		if connectionCount == 0 {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// DroppedMessages returns how many outbound messages have been dropped because of full connection queues
+func (s *Server) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&s.droppedMessages)
+}
+
 // ProxyHandler ...
 func (s *Server) ProxyHandler(wr http.ResponseWriter, req *http.Request) {
 	log.Printf(logPrefix+"Incoming request from %s | %s %s\n", req.RemoteAddr, req.Method, req.URL)
@@ -84,94 +381,346 @@ func (s *Server) ProxyHandler(wr http.ResponseWriter, req *http.Request) {
 	}
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(*http.Request) bool {
-		return true
-	},
-}
-
 func (s *Server) serveWebSocket(wr http.ResponseWriter, req *http.Request) {
-	connection, err := upgrader.Upgrade(wr, req, nil)
+	deviceTag := req.URL.Query().Get(deviceTagParam)
+
+	if s.isDraining() {
+		log.Printf(logPrefix+"Rejecting %v, server is draining\n", req.RemoteAddr)
+		s.Metrics.Upgrade(metrics.UpgradeRejectedDraining)
+		s.writeHTTPResponse(wr, http.StatusServiceUnavailable, model.CodeError, "Server is shutting down, reconnect later")
+		return
+	}
+
+	if origin := req.Header.Get("Origin"); !s.originPolicy.Allowed(origin) {
+		log.Printf(logPrefix+"Rejecting %v, origin %q is not allowed\n", req.RemoteAddr, origin)
+		s.Metrics.Upgrade(metrics.UpgradeRejectedOrigin)
+		s.writeHTTPResponse(wr, http.StatusForbidden, model.CodeUnauthorized, "Origin is not allowed")
+		return
+	}
+
+	tenant, err := s.resolveTenant(req)
 	if err != nil {
-		log.Printf(logPrefix+"Error upgrading http request to websocket. Err:%v\n", err)
+		log.Printf(logPrefix+"Rejecting %v, tenant could not be resolved. Err:%v\n", req.RemoteAddr, err)
+		s.Metrics.Upgrade(metrics.UpgradeRejectedTenant)
+		s.writeHTTPResponse(wr, http.StatusForbidden, model.CodeUnauthorized, err.Error())
 		return
 	}
 
-	defer connection.Close()
+	if s.Authenticator != nil {
+		authenticatedDeviceTag, err := s.authenticate(req, tenant, deviceTag)
 
-	log.Printf(logPrefix+"%v upgraded to websocket\n", req.RemoteAddr)
+		if err != nil {
+			log.Printf(logPrefix+"Rejecting %v, authentication failed. Err:%v\n", req.RemoteAddr, err)
+			s.Metrics.Upgrade(metrics.UpgradeRejectedAuth)
+			s.writeHTTPResponse(wr, http.StatusUnauthorized, model.CodeUnauthorized, err.Error())
+			return
+		}
+
+		deviceTag = authenticatedDeviceTag
+	}
 
-	sDeviceTag, ok := req.URL.Query()[deviceTag]
+	if deviceTag != "" && !topics.ValidDeviceTag(deviceTag) {
+		log.Printf(logPrefix+"Rejecting %v, invalid device tag %q\n", req.RemoteAddr, deviceTag)
+		s.Metrics.Upgrade(metrics.UpgradeRejectedBadTag)
+		s.writeHTTPResponse(wr, http.StatusBadRequest, model.CodeError, "Device tag can not contain whitespace or any of '*>+#/'")
+		return
+	}
+
+	if s.TenantResolver != nil && tenant == "" {
+		tenant = s.defaultTenant
+	}
 
-	if !ok || len(sDeviceTag) < 1 {
-		s.sendResponseMsgToConnection(connection, -1, "URL Param 'deviceTag' is missing")
+	if !s.reserveTenantConnection(tenant) {
+		log.Printf(logPrefix+"Rejecting %v, connection quota of tenant %v exceeded\n", req.RemoteAddr, tenant)
+		s.Metrics.Upgrade(metrics.UpgradeRejectedQuota)
+		s.writeHTTPResponse(wr, http.StatusTooManyRequests, model.CodeError, "Connection quota of tenant "+tenant+" exceeded")
 		return
 	}
 
-	deviceTag := sDeviceTag[0]
+	defer s.releaseTenantConnection(tenant)
+
+	countingWriter := &countingResponseWriter{ResponseWriter: wr}
+
+	ws, err := s.upgrader.Upgrade(countingWriter, req, nil)
+	if err != nil {
+		log.Printf(logPrefix+"Error upgrading http request to websocket. Err:%v\n", err)
+		s.Metrics.Upgrade(metrics.UpgradeRejectedHandshake)
+		return
+	}
+
+	defer ws.Close()
+
+	log.Printf(logPrefix+"%v upgraded to websocket\n", req.RemoteAddr)
 
 	if len(deviceTag) < 1 {
-		s.sendResponseMsgToConnection(connection, -1, "URL Param 'deviceTag' is missing")
+		s.Metrics.Upgrade(metrics.UpgradeRejectedNoTag)
+		s.sendResponseMsgToConnection(ws, model.CodeError, "URL Param 'deviceTag' is missing")
 		return
 	}
 
-	uuid, _ := uuid.NewV4()
-	connectionID := uuid.String()
+	s.Metrics.Upgrade(metrics.UpgradeAccepted)
 
-	s.addConnection(deviceTag, connectionID, connection)
+	connectionID := uuid.NewV4().String()
 
-	s.readFromClient(connectionID, connection, deviceTag)
+	connection := newClientConnection(connectionID, model.ScopeDeviceTag(tenant, deviceTag), ws, s.settings, s.Metrics, s.onMessageDropped)
+	connection.tenant = tenant
+	defer connection.close(DisconnectReasonConnectionLost)
+
+	if s.upgrader.EnableCompression && offersCompression(req) {
+		connection.enableCompression(countingWriter.conn)
+	}
+
+	limits := s.limits.For(connection.deviceTag)
+	if limits.MaxMessageSize > 0 {
+		ws.SetReadLimit(int64(limits.MaxMessageSize))
+	}
+	connection.rateLimit = newTokenBucket(limits.ConnectionRate, limits.ConnectionBurst)
+
+	go connection.writeLoop()
+
+	s.addConnection(connection)
+
+	if headersListener, ok := s.Listener.(HeadersListener); ok {
+		headersListener.OnConnectionHeaders(connectionID, req.Header)
+	}
 
-	s.removeConnection(deviceTag, connectionID)
+	s.readFromClient(connection, req.RemoteAddr)
+
+	s.removeConnection(connection)
+}
+
+// resolveTenant returns tenant of the upgrade request as the resolver tells it, it is empty when tenants are not enabled
+// and may be empty for the default tenant
+func (s *Server) resolveTenant(req *http.Request) (string, error) {
+	if s.TenantResolver == nil {
+		return "", nil
+	}
+
+	tenant, err := s.TenantResolver.ResolveTenant(req)
+	if err != nil {
+		return "", err
+	}
+
+	if tenant == "" && !topics.ValidTenant(s.defaultTenant) {
+		return "", fmt.Errorf(logPrefix+"Invalid tenant %q", s.defaultTenant)
+	}
+
+	if tenant != "" && !topics.ValidTenant(tenant) {
+		return "", fmt.Errorf(logPrefix+"Invalid tenant %q", tenant)
+	}
+
+	return tenant, nil
 }
 
-func (s *Server) readFromClient(connectionID string, connection *websocket.Conn, deviceTag string) {
-	err := s.Listener.OnConnectionEstabilishedFromClient(connectionID, &deviceTag)
+// authenticate returns device tag the request is allowed to use, with tenants enabled credentials have to belong
+// to the tenant the resolver returned
+func (s *Server) authenticate(req *http.Request, tenant, deviceTag string) (string, error) {
+	if s.TenantResolver == nil {
+		return s.Authenticator.Authenticate(req, deviceTag)
+	}
+
+	tenantAuthenticator, ok := s.Authenticator.(TenantAuthenticator)
+	if !ok {
+		return "", ErrTenantsNotSupported
+	}
 
-	s.sendResponseMsgToClient(connection, deviceTag, 0, "Connection estabilished")
+	return tenantAuthenticator.AuthenticateInTenant(req, tenant, deviceTag)
+}
+
+// reserveTenantConnection counts connection against quota of the tenant before it is upgraded,
+// false is returned when the quota is exhausted
+func (s *Server) reserveTenantConnection(tenant string) bool {
+	if tenant == "" {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if quota := s.tenancy.Quota(tenant); quota > 0 && s.tenantConnections[tenant] >= quota {
+		return false
+	}
+
+	s.tenantConnections[tenant]++
+
+	return true
+}
+
+func (s *Server) releaseTenantConnection(tenant string) {
+	if tenant == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tenantConnections[tenant]--
+
+	if s.tenantConnections[tenant] <= 0 {
+		delete(s.tenantConnections, tenant)
+	}
+}
+
+func (s *Server) readFromClient(connection *clientConnection, remoteAddr string) {
+	connectionID := connection.id
+	deviceTag := connection.deviceTag
+
+	err := s.Listener.OnConnectionEstabilishedFromClient(connectionID, &deviceTag, remoteAddr)
+
+	s.sendResponseMsgToClient(connection, model.CodeSuccess, "Connection estabilished")
 
 	if err != nil {
-		s.sendErrorToClient(connection, deviceTag, fmt.Errorf(logPrefix+"Error OnConnectionEstabilishedFromClient. Err: %v", err))
+		s.sendErrorToClient(connection, fmt.Errorf(logPrefix+"Error OnConnectionEstabilishedFromClient. Err: %v", err))
+	} else if readyListener, ok := s.Listener.(ReadyListener); ok {
+		readyListener.OnConnectionReady(connectionID, &deviceTag)
 	}
 
+	connection.startReading()
+
 	for {
-		messageType, bMessage, err := connection.ReadMessage()
+		messageType, bMessage, err := connection.read()
 
 		if err != nil {
-			log.Printf(logPrefix+"Error reading message coming from client. Err: %v", err)
-			err = s.Listener.OnClientDisconnected(connectionID, &deviceTag)
+			reason := connection.disconnectReason(err)
+			log.Printf(logPrefix+"Error reading message coming from client. Reason: %v Err: %v", reason, err)
+			if reason == DisconnectReasonMessageTooBig {
+				s.Metrics.LimitExceeded(metrics.LimitMessageSize)
+			}
+			err = s.Listener.OnClientDisconnected(connectionID, &deviceTag, reason)
 			if err != nil {
 				log.Printf(logPrefix+"Error on client disconnecting. Err: %v", err)
 			}
 			break
 		}
 
-		if messageType != websocket.TextMessage {
-			s.sendErrorToClient(connection, deviceTag, fmt.Errorf(logPrefix+"Incorrect type of message. Client can send only text messages"))
+		if !s.withinRateLimits(connection) {
 			continue
 		}
 
-		message := string(bMessage)
-
-		err = s.Listener.OnMessageReceivedFromClient(connectionID, &message, &deviceTag)
+		if messageType == websocket.BinaryMessage {
+			err = s.onBinaryMessage(connectionID, bMessage, &deviceTag)
+		} else {
+			message := string(bMessage)
+			err = s.Listener.OnMessageReceivedFromClient(connectionID, &message, &deviceTag)
+		}
 
 		if err != nil {
-			s.sendErrorToClient(connection, deviceTag, err)
+			s.sendErrorToClient(connection, err)
 			continue
 		}
 
-		s.sendResponseMsgToClient(connection, deviceTag, 0, "Message succesfully sent to platform")
+		s.sendResponseMsgToClient(connection, model.CodeSuccess, "Message succesfully sent to platform")
+	}
+}
+
+// withinRateLimits applies violation policy to message over rate limit, false means the message must not be handled
+func (s *Server) withinRateLimits(connection *clientConnection) bool {
+	now := time.Now()
+
+	if s.violationPolicy == ViolationDelay {
+		wait, limit := connection.rateLimit.reserve(now), metrics.LimitConnectionRate
+		if deviceWait := connection.deviceLimit.reserve(now); deviceWait > wait {
+			wait, limit = deviceWait, metrics.LimitDeviceRate
+		}
+
+		if wait <= 0 {
+			return true
+		}
+
+		s.Metrics.LimitExceeded(limit)
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			//NOTE: pongs are not read while waiting so it can not count against the client
+			connection.refreshReadDeadline(time.Now())
+			return true
+		case <-connection.closed:
+			return false
+		}
+	}
+
+	limit := ""
+	if !connection.rateLimit.allow(now) {
+		limit = metrics.LimitConnectionRate
+	} else if !connection.deviceLimit.allow(now) {
+		connection.rateLimit.giveBack()
+		limit = metrics.LimitDeviceRate
 	}
+
+	if limit == "" {
+		return true
+	}
+
+	s.Metrics.LimitExceeded(limit)
+
+	if s.violationPolicy == ViolationDisconnect {
+		log.Printf(logPrefix+"Closing connection which exceeded %v limit. Device tag:%v connection:%v\n", limit, connection.deviceTag, connection.id)
+		connection.closeWithMessage(websocket.ClosePolicyViolation, DisconnectReasonRateLimited, DisconnectReasonRateLimited)
+		return false
+	}
+
+	s.sendResponseMsgToClient(connection, model.CodeRateLimited, "Rate limit exceeded, message was not sent to platform")
+
+	return false
 }
 
-func (s *Server) sendErrorToClient(connection *websocket.Conn, deviceTag string, err error) {
-	s.sendResponseMsgToClient(connection, deviceTag, -1, err.Error())
+func (s *Server) onBinaryMessage(connectionID string, msg []byte, deviceTag *string) error {
+	binaryListener, ok := s.Listener.(BinaryListener)
+	if !ok {
+		return fmt.Errorf(logPrefix + "Incorrect type of message. Client can send only text messages")
+	}
+
+	return binaryListener.OnBinaryMessageReceivedFromClient(connectionID, msg, deviceTag)
 }
 
-func (s *Server) sendResponseMsgToClient(connection *websocket.Conn, deviceTag string, code int, msg string) {
-	s.sendResponseMsgToConnection(connection, code, msg)
+func (s *Server) sendErrorToClient(connection *clientConnection, err error) {
+	if response, ok := err.(model.ResponseMsg); ok {
+		s.sendResponseMsgToClient(connection, response.Code, response.Message)
+		return
+	}
+
+	s.sendResponseMsgToClient(connection, model.CodeError, err.Error())
 }
 
+func (s *Server) sendResponseMsgToClient(connection *clientConnection, code int, msg string) {
+	jsonResponse := model.ResponseMsg{
+		Code:    code,
+		Message: msg,
+	}
+
+	data, err := json.Marshal(jsonResponse)
+	if err != nil {
+		log.Printf(logPrefix+"Can not marshal response msg err:%v", err)
+		return
+	}
+
+	sendErr := connection.send(outboundMsg{messageType: websocket.TextMessage, data: data})
+
+	if sendErr != nil {
+		log.Printf(logPrefix+"Can not send response to client err:%v", sendErr)
+		log.Printf(logPrefix+"Message that failed to be sent:%v code:%v", msg, code)
+	}
+}
+
+// writeHTTPResponse answers plain http request which has not been upgraded to websocket
+func (s *Server) writeHTTPResponse(wr http.ResponseWriter, status int, code int, msg string) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+
+	err := json.NewEncoder(wr).Encode(model.ResponseMsg{
+		Code:    code,
+		Message: msg,
+	})
+
+	if err != nil {
+		log.Printf(logPrefix+"Can not write http response to client err:%v", err)
+	}
+}
+
+// sendResponseMsgToConnection writes directly to the socket so it can be used only before the connection gets its writer
 func (s *Server) sendResponseMsgToConnection(connection *websocket.Conn, code int, msg string) {
 
 	jsonResponse := model.ResponseMsg{
@@ -187,24 +736,73 @@ func (s *Server) sendResponseMsgToConnection(connection *websocket.Conn, code in
 	}
 }
 
-func (s *Server) addConnection(deviceTag string, connectionID string, connection *websocket.Conn) {
+func (s *Server) onMessageDropped() {
+	atomic.AddUint64(&s.droppedMessages, 1)
+}
+
+func (s *Server) addConnection(connection *clientConnection) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if s.connections[deviceTag] == nil {
-		s.connections[deviceTag] = make(map[string]*websocket.Conn)
+	if s.connections[connection.deviceTag] == nil {
+		s.connections[connection.deviceTag] = make(map[string]*clientConnection)
 	}
 
-	s.connections[deviceTag][connectionID] = connection
+	s.connections[connection.deviceTag][connection.id] = connection
+	s.connectionCount++
+	connection.deviceLimit = s.acquireDeviceBucket(connection.deviceTag)
+
+	deviceConnections := len(s.connections[connection.deviceTag])
+	s.Metrics.ConnectionsChanged(s.connectionCount, len(s.connections), deviceConnections-1, deviceConnections)
 }
 
-func (s *Server) removeConnection(deviceTag string, connectionID string) {
+func (s *Server) removeConnection(connection *clientConnection) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	delete(s.connections[deviceTag], connectionID)
+	if _, ok := s.connections[connection.deviceTag][connection.id]; !ok {
+		return
+	}
+
+	delete(s.connections[connection.deviceTag], connection.id)
+	s.connectionCount--
+	s.releaseDeviceBucket(connection.deviceTag)
+
+	deviceConnections := len(s.connections[connection.deviceTag])
+	if deviceConnections == 0 {
+		delete(s.connections, connection.deviceTag)
+	}
+
+	s.Metrics.ConnectionsChanged(s.connectionCount, len(s.connections), deviceConnections+1, deviceConnections)
+}
+
+// acquireDeviceBucket returns rate limit shared by connections of the device tag, it has to be called with mutex locked
+func (s *Server) acquireDeviceBucket(deviceTag string) *tokenBucket {
+	shared, ok := s.deviceBuckets[deviceTag]
+	if !ok {
+		limits := s.limits.For(deviceTag)
+		bucket := newTokenBucket(limits.DeviceRate, limits.DeviceBurst)
+		if bucket == nil {
+			return nil
+		}
+
+		shared = &sharedBucket{bucket: bucket}
+		s.deviceBuckets[deviceTag] = shared
+	}
+
+	shared.connections++
+
+	return shared.bucket
+}
+
+// releaseDeviceBucket forgets rate limit of device tag without connections, it has to be called with mutex locked
+func (s *Server) releaseDeviceBucket(deviceTag string) {
+	shared, ok := s.deviceBuckets[deviceTag]
+	if !ok {
+		return
+	}
 
-	if len(s.connections[deviceTag]) == 0 {
-		delete(s.connections, deviceTag)
+	if shared.connections--; shared.connections <= 0 {
+		delete(s.deviceBuckets, deviceTag)
 	}
 }
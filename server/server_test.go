@@ -1,21 +1,26 @@
 package server_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/bxcodec/faker"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/suite"
 
+	"deviceproxy/metrics"
 	"deviceproxy/mocks_test"
 	"deviceproxy/model"
+	"deviceproxy/resources"
 	"deviceproxy/server"
 )
 
@@ -24,6 +29,7 @@ type ServerTestSuite struct {
 
 	listenerMock *mocks_test.Listener
 	server       *server.Server
+	config       *resources.Config
 
 	connection        *websocket.Conn
 	testConnectionURL string
@@ -40,13 +46,9 @@ func TestExecuteServerTestSuite(t *testing.T) {
 
 func (suite *ServerTestSuite) SetupTest() {
 	suite.listenerMock = &mocks_test.Listener{}
+	suite.config = resources.DefaultConfig()
 
-	suite.server = server.NewServer()
-	suite.server.Listener = suite.listenerMock
-
-	testServer := httptest.NewServer(http.HandlerFunc(suite.server.ProxyHandler))
-
-	suite.testConnectionURL = "ws" + strings.TrimPrefix(testServer.URL, "http")
+	suite.startServer()
 
 	faker.FakeData(&suite.deviceTag1)
 	faker.FakeData(&suite.deviceTag2)
@@ -58,6 +60,28 @@ func (suite *ServerTestSuite) AfterTest(suiteName, testName string) {
 	suite.listenerMock.AssertExpectations(suite.T())
 }
 
+// TearDownTest closes connections left by the test, so they do not call listener while the next test is set up
+func (suite *ServerTestSuite) TearDownTest() {
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, mock.Anything, mock.Anything).Maybe().Return(nil)
+	suite.server.Shutdown()
+}
+
+func (suite *ServerTestSuite) startServer() {
+	suite.server = server.NewServer(suite.config)
+	suite.server.Listener = suite.listenerMock
+
+	testServer := httptest.NewServer(http.HandlerFunc(suite.server.ProxyHandler))
+
+	suite.testConnectionURL = "ws" + strings.TrimPrefix(testServer.URL, "http")
+}
+
+func (suite *ServerTestSuite) startServerWithHeartbeat(pingInterval, pongWait, readIdleTimeout time.Duration) {
+	suite.config.Connection.PingInterval = pingInterval
+	suite.config.Connection.PongWait = pongWait
+	suite.config.Connection.ReadIdleTimeout = readIdleTimeout
+	suite.startServer()
+}
+
 func (suite *ServerTestSuite) Test_ConnectionIsDroppedIfDeviceTagIsNotProvided() {
 	clientConnection, _, err := websocket.DefaultDialer.Dial(suite.testConnectionURL, nil)
 	defer clientConnection.Close()
@@ -73,6 +97,32 @@ func (suite *ServerTestSuite) Test_ConnectionIsEstabilishedIfDeviceTagIsProvided
 	suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
 }
 
+type headersListener struct {
+	*mocks_test.Listener
+	headers chan http.Header
+}
+
+func (l headersListener) OnConnectionHeaders(connectionID string, headers http.Header) {
+	l.headers <- headers
+}
+
+func (suite *ServerTestSuite) Test_HeadersOfUpgradeRequestArePassedToListener() {
+	listener := headersListener{Listener: suite.listenerMock, headers: make(chan http.Header, 1)}
+	suite.server.Listener = listener
+
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection, _, err := websocket.DefaultDialer.Dial(appendDeviceTagToURL(suite.testConnectionURL, suite.deviceTag1),
+		http.Header{"X-Correlation-ID": {"abc"}})
+	suite.Require().Nil(err)
+	suite.expectSuccesfullResponse(clientConnection)
+
+	suite.Equal("abc", (<-listener.headers).Get("X-Correlation-ID"))
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
 func (suite *ServerTestSuite) Test_ListenerIsCalledWhenMessageIsSent() {
 	clientConnection1 := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
 	defer clientConnection1.Close()
@@ -90,6 +140,61 @@ func (suite *ServerTestSuite) Test_ListenerIsCalledWhenMessageIsSent() {
 	suite.expectSuccesfullResponse(clientConnection1)
 }
 
+func (suite *ServerTestSuite) Test_DeviceWithDottedTagCanConnectPublishAndReceive() {
+	deviceTag := "sensor.edge.msg.example.com"
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(deviceTag)
+	defer clientConnection.Close()
+
+	msg := "msg"
+
+	suite.listenerMock.On("OnMessageReceivedFromClient", mock.Anything, &msg, &deviceTag).Once().Return(nil)
+
+	suite.Nil(clientConnection.WriteMessage(websocket.TextMessage, []byte(msg)))
+	suite.expectSuccesfullResponse(clientConnection)
+
+	suite.Nil(suite.server.SendMsg("hello", deviceTag))
+
+	_, received, err := clientConnection.ReadMessage()
+	suite.Nil(err)
+	suite.Equal("hello", string(received))
+}
+
+func (suite *ServerTestSuite) Test_BinaryFramesArePassedInBothDirections() {
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	msg := []byte{0xa1, 0x01, 0x02}
+
+	suite.listenerMock.On("OnBinaryMessageReceivedFromClient", mock.Anything, msg, &suite.deviceTag1).Once().Return(nil)
+
+	suite.Nil(clientConnection.WriteMessage(websocket.BinaryMessage, msg))
+	suite.expectSuccesfullResponse(clientConnection)
+
+	suite.Nil(suite.server.SendBinaryMsg(msg, suite.deviceTag1))
+
+	messageType, received, err := clientConnection.ReadMessage()
+	suite.Nil(err)
+	suite.Equal(websocket.BinaryMessage, messageType)
+	suite.Equal(msg, received)
+}
+
+func (suite *ServerTestSuite) Test_ListenerDecidesAboutResponseCode() {
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	msg := "msg"
+	rejection := model.ResponseMsg{Code: model.CodeQueueUnavailable, Message: "retry later"}
+
+	suite.listenerMock.On("OnMessageReceivedFromClient", mock.Anything, &msg, &suite.deviceTag1).Once().Return(rejection)
+
+	err := clientConnection.WriteMessage(websocket.TextMessage, []byte(msg))
+	suite.Nil(err)
+
+	responseMsg := model.ResponseMsg{}
+	suite.Nil(clientConnection.ReadJSON(&responseMsg))
+	suite.Equal(rejection, responseMsg)
+}
+
 func (suite *ServerTestSuite) Test_MultipleConnectionsCanSendMessageToOneDeviceTag() {
 	clientConnection1 := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
 	defer clientConnection1.Close()
@@ -130,7 +235,7 @@ func (suite *ServerTestSuite) Test_SecondConnectionSendsSuccesfullyToClientIfThe
 	suite.Nil(err)
 	suite.expectSuccesfullResponse(clientConnection1)
 
-	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1).Times(1).Return(nil)
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Times(1).Return(nil)
 	clientConnection1.Close()
 
 	msg2 := "msg2"
@@ -144,7 +249,7 @@ func (suite *ServerTestSuite) Test_SecondConnectionSendsSuccesfullyToClientIfThe
 	err = suite.server.SendMsg("{}", suite.deviceTag1)
 	suite.Nil(err)
 
-	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1).Times(1).Return(nil)
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Times(1).Return(nil)
 	clientConnection2.Close()
 	time.Sleep(50 * time.Millisecond)
 }
@@ -165,7 +270,7 @@ func (suite *ServerTestSuite) Test_ClientIsNotDisconnectedWhenOtherOneDropsWithT
 
 	suite.expectSuccesfullResponse(clientConnection1)
 
-	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1).Times(1).Return(nil)
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Times(1).Return(nil)
 
 	clientConnection1.Close()
 
@@ -187,12 +292,462 @@ func (suite *ServerTestSuite) Test_ListenerIsCalledWhenClientIsDisconnected() {
 	clientConnection2 := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag2)
 	defer clientConnection2.Close()
 
-	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1).Once().Return(nil)
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
 
 	clientConnection1.Close()
 	time.Sleep(50 * time.Millisecond)
 }
 
+func (suite *ServerTestSuite) Test_ConnectionIsRejectedBeforeUpgradeIfAuthenticationFails() {
+	suite.server.Authenticator = server.AuthenticatorFunc(func(req *http.Request, deviceTag string) (string, error) {
+		return "", server.ErrInvalidCredentials
+	})
+
+	_, response, err := websocket.DefaultDialer.Dial(appendDeviceTagToURL(suite.testConnectionURL, suite.deviceTag1), nil)
+	suite.Equal(websocket.ErrBadHandshake, err)
+	suite.Equal(http.StatusUnauthorized, response.StatusCode)
+
+	responseMsg := model.ResponseMsg{}
+	suite.Nil(json.NewDecoder(response.Body).Decode(&responseMsg))
+	suite.EqualValues(model.CodeUnauthorized, responseMsg.Code)
+}
+
+func (suite *ServerTestSuite) Test_AuthenticatorDecidesAboutDeviceTag() {
+	suite.server.Authenticator = server.AuthenticatorFunc(func(req *http.Request, deviceTag string) (string, error) {
+		return suite.deviceTag2, nil
+	})
+
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &suite.deviceTag2, mock.Anything).Once().Return(nil)
+
+	clientConnection, _, err := websocket.DefaultDialer.Dial(suite.testConnectionURL, nil)
+	suite.Nil(err)
+	defer clientConnection.Close()
+
+	suite.expectSuccesfullResponse(clientConnection)
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag2, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_ConnectionIsClosedWhenClientDoesNotAnswerPings() {
+	suite.startServerWithHeartbeat(20*time.Millisecond, 60*time.Millisecond, 0)
+
+	// client never reads after handshake so it never answers pings
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, server.DisconnectReasonPongTimeout).Once().Return(nil)
+	time.Sleep(200 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_ConnectionIsClosedWhenClientIsIdle() {
+	suite.startServerWithHeartbeat(20*time.Millisecond, 60*time.Millisecond, 100*time.Millisecond)
+
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	go func() {
+		for {
+			if _, _, err := clientConnection.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, server.DisconnectReasonIdleTimeout).Once().Return(nil)
+	time.Sleep(250 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_ConcurrentSendMsgIsDeliveredAsSeparateFrames() {
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	senders := 10
+	for i := 0; i < senders; i++ {
+		go func() {
+			err := suite.server.SendMsg("{\"code\":0}", suite.deviceTag1)
+			suite.Nil(err)
+		}()
+	}
+
+	for i := 0; i < senders; i++ {
+		suite.expectSuccesfullResponse(clientConnection)
+	}
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_KickedConnectionIsClosedWithPolicyViolation() {
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	connections := suite.server.Connections()
+	suite.Require().Len(connections, 1)
+	suite.Equal(suite.deviceTag1, connections[0].DeviceTag)
+
+	suite.listenerMock.On("OnClientDisconnected", connections[0].ConnectionID, &suite.deviceTag1, server.DisconnectReasonKicked).Once().Return(nil)
+
+	suite.True(suite.server.Disconnect(connections[0].ConnectionID))
+	suite.False(suite.server.Disconnect(connections[0].ConnectionID + "unknown"))
+
+	_, _, err := clientConnection.ReadMessage()
+	suite.True(websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+
+	time.Sleep(50 * time.Millisecond)
+	suite.Empty(suite.server.Connections())
+}
+
+func (suite *ServerTestSuite) Test_MetricsCountUpgradesAndConnections() {
+	suite.server.Metrics = metrics.NewMetrics()
+
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	rejectedConnection, _, err := websocket.DefaultDialer.Dial(suite.testConnectionURL, nil)
+	suite.Require().Nil(err)
+	rejectedConnection.ReadJSON(&model.ResponseMsg{})
+	rejectedConnection.Close()
+
+	expected := `
+# HELP deviceproxy_active_connections Number of open device websocket connections.
+# TYPE deviceproxy_active_connections gauge
+deviceproxy_active_connections 1
+# HELP deviceproxy_device_connections Number of device tags by count of their open connections, counts from 5+ up are summed.
+# TYPE deviceproxy_device_connections gauge
+deviceproxy_device_connections{connections="1"} 1
+# HELP deviceproxy_upgrades_total Websocket upgrade attempts by result.
+# TYPE deviceproxy_upgrades_total counter
+deviceproxy_upgrades_total{result="accepted"} 1
+deviceproxy_upgrades_total{result="missing_device_tag"} 1
+`
+	suite.Nil(testutil.GatherAndCompare(suite.server.Metrics.Registry(), strings.NewReader(expected),
+		"deviceproxy_active_connections", "deviceproxy_device_connections", "deviceproxy_upgrades_total"))
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_MessagesAboveThresholdAreCompressedWhenDeviceOffersIt() {
+	suite.config.Connection.Compression = true
+	suite.config.Connection.CompressionThreshold = 100
+	suite.startServer()
+	suite.server.Metrics = metrics.NewMetrics()
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+
+	clientConnection := suite.estabilishClientConnectionWithDialer(&dialer, suite.deviceTag1)
+	defer clientConnection.Close()
+
+	large := strings.Repeat(`{"temperature":21}`, 100)
+	small := `{"temperature":21}`
+
+	for _, msg := range []string{large, small} {
+		suite.Nil(suite.server.SendMsg(msg, suite.deviceTag1))
+
+		_, received, err := clientConnection.ReadMessage()
+		suite.Nil(err)
+		suite.Equal(msg, string(received))
+	}
+
+	suite.Eventually(func() bool {
+		families, err := suite.server.Metrics.Registry().Gather()
+		suite.Require().Nil(err)
+
+		for _, family := range families {
+			if family.GetName() == "deviceproxy_compression_ratio" {
+				histogram := family.GetMetric()[0].GetHistogram()
+				return histogram.GetSampleCount() == 1 && histogram.GetSampleSum() < 0.5
+			}
+		}
+
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_UpgradeFromForbiddenOriginIsRejected() {
+	suite.config.Connection.AllowedOrigins = []string{"https://*.example.com"}
+	suite.config.Connection.AllowEmptyOrigin = false
+	suite.startServer()
+	suite.server.Metrics = metrics.NewMetrics()
+
+	testConnectionURL := appendDeviceTagToURL(suite.testConnectionURL, suite.deviceTag1)
+
+	for _, origin := range []string{"https://evil.com", ""} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+
+		_, response, err := websocket.DefaultDialer.Dial(testConnectionURL, header)
+		suite.NotNil(err)
+		suite.Require().NotNil(response)
+		suite.Equal(http.StatusForbidden, response.StatusCode)
+	}
+
+	header := http.Header{"Origin": []string{"https://app.example.com"}}
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection, _, err := websocket.DefaultDialer.Dial(testConnectionURL, header)
+	suite.Require().Nil(err)
+	suite.expectSuccesfullResponse(clientConnection)
+
+	expected := `
+# HELP deviceproxy_upgrades_total Websocket upgrade attempts by result.
+# TYPE deviceproxy_upgrades_total counter
+deviceproxy_upgrades_total{result="accepted"} 1
+deviceproxy_upgrades_total{result="forbidden_origin"} 2
+`
+	suite.Nil(testutil.GatherAndCompare(suite.server.Metrics.Registry(), strings.NewReader(expected), "deviceproxy_upgrades_total"))
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_MessageOverConnectionRateIsRejected() {
+	suite.config.Limits.ConnectionRate = 0.01
+	suite.config.Limits.ConnectionBurst = 1
+	suite.startServer()
+	suite.server.Metrics = metrics.NewMetrics()
+
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	msg := "msg"
+	suite.listenerMock.On("OnMessageReceivedFromClient", mock.Anything, &msg, &suite.deviceTag1).Once().Return(nil)
+
+	suite.Nil(clientConnection.WriteMessage(websocket.TextMessage, []byte(msg)))
+	suite.expectSuccesfullResponse(clientConnection)
+
+	suite.Nil(clientConnection.WriteMessage(websocket.TextMessage, []byte(msg)))
+
+	responseMsg := model.ResponseMsg{}
+	suite.Nil(clientConnection.ReadJSON(&responseMsg))
+	suite.EqualValues(model.CodeRateLimited, responseMsg.Code)
+
+	expected := `
+# HELP deviceproxy_limit_violations_total Inbound messages which exceeded size or rate limit by limit.
+# TYPE deviceproxy_limit_violations_total counter
+deviceproxy_limit_violations_total{limit="connection_rate"} 1
+`
+	suite.Nil(testutil.GatherAndCompare(suite.server.Metrics.Registry(), strings.NewReader(expected), "deviceproxy_limit_violations_total"))
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_MessageOverConnectionRateIsDelayed() {
+	suite.config.Limits.ConnectionRate = 10
+	suite.config.Limits.ConnectionBurst = 1
+	suite.config.Limits.Violation = "delay"
+	suite.startServer()
+
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	msg := "msg"
+	suite.listenerMock.On("OnMessageReceivedFromClient", mock.Anything, &msg, &suite.deviceTag1).Twice().Return(nil)
+
+	start := time.Now()
+
+	suite.Nil(clientConnection.WriteMessage(websocket.TextMessage, []byte(msg)))
+	suite.Nil(clientConnection.WriteMessage(websocket.TextMessage, []byte(msg)))
+	suite.expectSuccesfullResponse(clientConnection)
+	suite.expectSuccesfullResponse(clientConnection)
+
+	suite.True(time.Since(start) >= 90*time.Millisecond, "second message was not delayed")
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_DeviceRateIsSharedByConnectionsOfDevice() {
+	suite.config.Limits.Violation = "disconnect"
+	suite.config.Limits.Devices = map[string]resources.DeviceLimits{
+		suite.deviceTag1: {DeviceRate: 0.01, DeviceBurst: 1},
+	}
+	suite.startServer()
+
+	clientConnection1 := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection1.Close()
+
+	clientConnection2 := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection2.Close()
+
+	msg := "msg"
+	suite.listenerMock.On("OnMessageReceivedFromClient", mock.Anything, &msg, &suite.deviceTag1).Once().Return(nil)
+
+	suite.Nil(clientConnection1.WriteMessage(websocket.TextMessage, []byte(msg)))
+	suite.expectSuccesfullResponse(clientConnection1)
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, server.DisconnectReasonRateLimited).Once().Return(nil)
+
+	suite.Nil(clientConnection2.WriteMessage(websocket.TextMessage, []byte(msg)))
+
+	_, _, err := clientConnection2.ReadMessage()
+	suite.True(websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, mock.Anything).Once().Return(nil)
+	clientConnection1.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_ConnectionSendingTooBigMessageIsClosed() {
+	suite.config.Limits.MaxMessageSize = 16
+	suite.startServer()
+
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, server.DisconnectReasonMessageTooBig).Once().Return(nil)
+
+	suite.Nil(clientConnection.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17))))
+
+	_, _, err := clientConnection.ReadMessage()
+	suite.True(websocket.IsCloseError(err, websocket.CloseMessageTooBig))
+
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_ShutdownAsksDevicesToReconnectAndRejectsNewUpgrades() {
+	clientConnection := suite.estabilishClientConnectionForDeviceTag(suite.deviceTag1)
+	defer clientConnection.Close()
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &suite.deviceTag1, server.DisconnectReasonServerShutdown).Once().Return(nil)
+
+	suite.Nil(suite.server.Shutdown())
+	suite.Empty(suite.server.Connections())
+
+	_, _, err := clientConnection.ReadMessage()
+	suite.True(websocket.IsCloseError(err, websocket.CloseGoingAway))
+
+	_, response, err := websocket.DefaultDialer.Dial(appendDeviceTagToURL(suite.testConnectionURL, suite.deviceTag1), nil)
+	suite.Equal(websocket.ErrBadHandshake, err)
+	suite.Equal(http.StatusServiceUnavailable, response.StatusCode)
+}
+
+func (suite *ServerTestSuite) Test_TenantScopesDeviceTagAndLimitsConnections() {
+	suite.config.Tenancy.MaxConnections = 1
+	suite.startServer()
+	suite.server.TenantResolver = server.TenantResolverFunc(func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Tenant"), nil
+	})
+
+	dial := func(tenant string) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(appendDeviceTagToURL(suite.testConnectionURL, suite.deviceTag1), http.Header{"X-Tenant": {tenant}})
+	}
+
+	acmeDeviceTag := model.ScopeDeviceTag("acme", suite.deviceTag1)
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &acmeDeviceTag, mock.Anything).Once().Return(nil)
+	acmeConnection, _, err := dial("acme")
+	suite.Require().Nil(err)
+	defer acmeConnection.Close()
+	suite.expectSuccesfullResponse(acmeConnection)
+
+	_, response, err := dial("acme")
+	suite.Equal(websocket.ErrBadHandshake, err)
+	suite.Equal(http.StatusTooManyRequests, response.StatusCode)
+
+	_, response, err = dial("")
+	suite.Equal(websocket.ErrBadHandshake, err)
+	suite.Equal(http.StatusForbidden, response.StatusCode)
+
+	otherDeviceTag := model.ScopeDeviceTag("other", suite.deviceTag1)
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &otherDeviceTag, mock.Anything).Once().Return(nil)
+	otherConnection, _, err := dial("other")
+	suite.Require().Nil(err)
+	defer otherConnection.Close()
+	suite.expectSuccesfullResponse(otherConnection)
+
+	connections := suite.server.Connections()
+	suite.Require().Len(connections, 2)
+	suite.Equal("acme", connections[0].Tenant)
+	suite.Equal(suite.deviceTag1, connections[0].DeviceTag)
+	suite.Equal("other", connections[1].Tenant)
+	suite.Equal(suite.deviceTag1, connections[1].DeviceTag)
+
+	suite.Nil(suite.server.SendMsg("msg", acmeDeviceTag))
+	_, msg, err := acmeConnection.ReadMessage()
+	suite.Nil(err)
+	suite.Equal("msg", string(msg))
+	suite.NotNil(suite.server.SendMsg("msg", suite.deviceTag1))
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &acmeDeviceTag, mock.Anything).Once().Return(nil)
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &otherDeviceTag, mock.Anything).Once().Return(nil)
+	acmeConnection.Close()
+	otherConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &acmeDeviceTag, mock.Anything).Once().Return(nil)
+	acmeConnection, _, err = dial("acme")
+	suite.Require().Nil(err)
+	suite.expectSuccesfullResponse(acmeConnection)
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &acmeDeviceTag, mock.Anything).Once().Return(nil)
+	acmeConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_CredentialsOfTenantCanNotBeUsedInAnotherTenant() {
+	suite.server.TenantResolver = server.TenantResolverFunc(func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Tenant"), nil
+	})
+	suite.server.Authenticator = server.NewJWTAuthenticator([]byte("secret"))
+
+	token := signJWT("secret", `{"deviceTag":"`+suite.deviceTag1+`","tenant":"acme"}`)
+	dial := func(tenant string) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(appendDeviceTagToURL(suite.testConnectionURL, suite.deviceTag1),
+			http.Header{"X-Tenant": {tenant}, "Authorization": {"Bearer " + token}})
+	}
+
+	_, response, err := dial("other")
+	suite.Equal(websocket.ErrBadHandshake, err)
+	suite.Equal(http.StatusUnauthorized, response.StatusCode)
+
+	acmeDeviceTag := model.ScopeDeviceTag("acme", suite.deviceTag1)
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &acmeDeviceTag, mock.Anything).Once().Return(nil)
+	acmeConnection, _, err := dial("acme")
+	suite.Require().Nil(err)
+	suite.expectSuccesfullResponse(acmeConnection)
+
+	suite.listenerMock.On("OnClientDisconnected", mock.Anything, &acmeDeviceTag, mock.Anything).Once().Return(nil)
+	acmeConnection.Close()
+	time.Sleep(50 * time.Millisecond)
+}
+
+func (suite *ServerTestSuite) Test_AuthenticatorWhichDoesNotKnowTenantsIsNotTrustedWithTenants() {
+	suite.server.TenantResolver = server.TenantResolverFunc(func(req *http.Request) (string, error) {
+		return req.Header.Get("X-Tenant"), nil
+	})
+	suite.server.Authenticator = server.AuthenticatorFunc(func(req *http.Request, deviceTag string) (string, error) {
+		return deviceTag, nil
+	})
+
+	_, response, err := websocket.DefaultDialer.Dial(appendDeviceTagToURL(suite.testConnectionURL, suite.deviceTag1), http.Header{"X-Tenant": {"acme"}})
+	suite.Equal(websocket.ErrBadHandshake, err)
+	suite.Equal(http.StatusUnauthorized, response.StatusCode)
+}
+
+func (suite *ServerTestSuite) Test_DeviceTagWhichSubscribesToWildcardIsRejected() {
+	for _, deviceTag := range []string{">", "#", "devices.*", "a/b", "a b"} {
+		_, response, err := websocket.DefaultDialer.Dial(appendDeviceTagToURL(suite.testConnectionURL, url.QueryEscape(deviceTag)), nil)
+		suite.Equal(websocket.ErrBadHandshake, err, deviceTag)
+		suite.Equal(http.StatusBadRequest, response.StatusCode, deviceTag)
+	}
+
+	suite.Empty(suite.server.Connections())
+}
+
 func (suite *ServerTestSuite) expectSuccesfullResponse(clientConnection *websocket.Conn) {
 	responseMsg := model.ResponseMsg{}
 	err := clientConnection.ReadJSON(&responseMsg)
@@ -201,11 +756,15 @@ func (suite *ServerTestSuite) expectSuccesfullResponse(clientConnection *websock
 }
 
 func (suite *ServerTestSuite) estabilishClientConnectionForDeviceTag(deviceTag string) *websocket.Conn {
-	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &deviceTag).Once().Return(nil)
+	return suite.estabilishClientConnectionWithDialer(websocket.DefaultDialer, deviceTag)
+}
+
+func (suite *ServerTestSuite) estabilishClientConnectionWithDialer(dialer *websocket.Dialer, deviceTag string) *websocket.Conn {
+	suite.listenerMock.On("OnConnectionEstabilishedFromClient", mock.Anything, &deviceTag, mock.Anything).Once().Return(nil)
 
 	testConnectionURL := appendDeviceTagToURL(suite.testConnectionURL, deviceTag)
 
-	clientConnection, _, err := websocket.DefaultDialer.Dial(testConnectionURL, nil)
+	clientConnection, _, err := dialer.Dial(testConnectionURL, nil)
 	suite.Nil(err)
 
 	suite.expectSuccesfullResponse(clientConnection)
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrUnknownTenant is returned when tenant can not be resolved from the request
+var ErrUnknownTenant = errors.New(logPrefix + "Tenant could not be resolved from request")
+
+// TenantResolver tells which tenant the upgrade request belongs to, it is consulted before authentication
+// and Authenticator has to implement TenantAuthenticator. Empty tenant means the default tenant of the server.
+type TenantResolver interface {
+	ResolveTenant(req *http.Request) (string, error)
+}
+
+// TenantResolverFunc allows to use custom callback as TenantResolver
+type TenantResolverFunc func(req *http.Request) (string, error)
+
+// ResolveTenant ...
+func (f TenantResolverFunc) ResolveTenant(req *http.Request) (string, error) {
+	return f(req)
+}
+
+// SubdomainTenantResolver takes tenant from subdomain of the host devices connect to, e.g. acme.devices.example.com
+type SubdomainTenantResolver struct {
+	suffix string
+}
+
+// NewSubdomainTenantResolver ...
+func NewSubdomainTenantResolver(domain string) *SubdomainTenantResolver {
+	return &SubdomainTenantResolver{suffix: "." + strings.ToLower(strings.Trim(domain, "."))}
+}
+
+// ResolveTenant ...
+func (r *SubdomainTenantResolver) ResolveTenant(req *http.Request) (string, error) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	if !strings.HasSuffix(host, r.suffix) {
+		return "", ErrUnknownTenant
+	}
+
+	tenant := strings.TrimSuffix(host, r.suffix)
+	if tenant == "" || strings.Contains(tenant, ".") {
+		return "", ErrUnknownTenant
+	}
+
+	return tenant, nil
+}
+
+// PathTenantResolver takes tenant from path segment in front of the endpoint, e.g. /acme/deviceproxy
+type PathTenantResolver struct {
+	endpoint string
+}
+
+// NewPathTenantResolver ...
+func NewPathTenantResolver(endpoint string) *PathTenantResolver {
+	return &PathTenantResolver{endpoint: endpoint}
+}
+
+// ResolveTenant ...
+func (r *PathTenantResolver) ResolveTenant(req *http.Request) (string, error) {
+	path := req.URL.Path
+
+	if !strings.HasSuffix(path, r.endpoint) {
+		return "", ErrUnknownTenant
+	}
+
+	tenant := strings.TrimPrefix(strings.TrimSuffix(path, r.endpoint), "/")
+	if tenant == "" || strings.Contains(tenant, "/") {
+		return "", ErrUnknownTenant
+	}
+
+	return tenant, nil
+}
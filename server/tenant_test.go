@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"deviceproxy/server"
+)
+
+func TestJWTAuthenticatorResolvesTenantFromClaim(t *testing.T) {
+	authenticator := server.NewJWTAuthenticator([]byte("secret"))
+
+	tenant, err := authenticator.ResolveTenant(requestWithToken(signJWT("secret", `{"deviceTag":"device1","tenant":"acme"}`)))
+	assert.Nil(t, err)
+	assert.Equal(t, "acme", tenant)
+
+	tenant, err = authenticator.ResolveTenant(requestWithToken(signJWT("secret", `{"deviceTag":"device1"}`)))
+	assert.Nil(t, err)
+	assert.Equal(t, "", tenant)
+
+	_, err = authenticator.ResolveTenant(requestWithToken(signJWT("other", `{"deviceTag":"device1","tenant":"acme"}`)))
+	assert.Equal(t, server.ErrInvalidCredentials, err)
+}
+
+func TestSubdomainTenantResolver(t *testing.T) {
+	resolver := server.NewSubdomainTenantResolver("devices.example.com")
+
+	for host, expected := range map[string]string{
+		"acme.devices.example.com":      "acme",
+		"ACME.devices.example.com:8443": "acme",
+		"devices.example.com":           "",
+		"a.b.devices.example.com":       "",
+		"acme.example.com":              "",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/deviceproxy", nil)
+		tenant, err := resolver.ResolveTenant(req)
+
+		if expected == "" {
+			assert.Equal(t, server.ErrUnknownTenant, err, host)
+		} else {
+			assert.Nil(t, err, host)
+			assert.Equal(t, expected, tenant, host)
+		}
+	}
+}
+
+func TestPathTenantResolver(t *testing.T) {
+	resolver := server.NewPathTenantResolver("/deviceproxy")
+
+	for path, expected := range map[string]string{
+		"/acme/deviceproxy":   "acme",
+		"/deviceproxy":        "",
+		"/a/b/deviceproxy":    "",
+		"/acme/deviceproxy/x": "",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+		tenant, err := resolver.ResolveTenant(req)
+
+		if expected == "" {
+			assert.Equal(t, server.ErrUnknownTenant, err, path)
+		} else {
+			assert.Nil(t, err, path)
+			assert.Equal(t, expected, tenant, path)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// CertIdentity says which part of client certificate carries device tag
+type CertIdentity int
+
+const (
+	// CertIdentityCN takes device tag from subject common name
+	CertIdentityCN CertIdentity = iota
+	// CertIdentitySANURI takes device tag from the first SAN URI with "device" scheme, e.g. device:tag or device://tag
+	CertIdentitySANURI
+)
+
+const deviceURIScheme = "device"
+
+// ErrMissingClientCertificate ...
+var ErrMissingClientCertificate = errors.New(logPrefix + "Missing client certificate")
+
+// ParseCertIdentity ...
+func ParseCertIdentity(identity string) (CertIdentity, error) {
+	switch identity {
+	case "cn":
+		return CertIdentityCN, nil
+	case "san-uri":
+		return CertIdentitySANURI, nil
+	}
+
+	return CertIdentityCN, fmt.Errorf(logPrefix+"Unknown certificate identity:%v", identity)
+}
+
+// NewTLSConfig loads server certificate. When clientCAFile is set client certificates signed by one of
+// the CAs are required, optionally checked against revocation list from crlFile.
+func NewTLSConfig(certFile, keyFile, clientCAFile, crlFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not load server certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not read client CA bundle: %v", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf(logPrefix+"Client CA bundle %v does not contain any certificate", clientCAFile)
+	}
+
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = clientCAs
+
+	if crlFile == "" {
+		return config, nil
+	}
+
+	revoked, err := loadRevokedSerials(crlFile, caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		return checkRevocation(revoked, verifiedChains)
+	}
+
+	return config, nil
+}
+
+// revokedSerials holds serial numbers of revoked certificates per raw subject of the CA which revoked them,
+// serials are unique only within their issuer
+type revokedSerials map[string]map[string]bool
+
+func (r revokedSerials) revoked(certificate *x509.Certificate) bool {
+	return r[string(certificate.RawIssuer)][certificate.SerialNumber.String()]
+}
+
+// loadRevokedSerials reads one or more DER or PEM encoded CRLs, every one of them has to be signed by one of client CAs
+func loadRevokedSerials(crlFile string, caPEM []byte) (revokedSerials, error) {
+	data, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return nil, fmt.Errorf(logPrefix+"Can not read CRL: %v", err)
+	}
+
+	crls := [][]byte{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		crls = append(crls, block.Bytes)
+	}
+
+	if len(crls) == 0 {
+		crls = append(crls, data)
+	}
+
+	revoked := revokedSerials{}
+
+	for _, der := range crls {
+		crl, err := x509.ParseDERCRL(der)
+		if err != nil {
+			return nil, fmt.Errorf(logPrefix+"Can not parse CRL: %v", err)
+		}
+
+		issuer := crlIssuer(crl, caPEM)
+		if issuer == nil {
+			return nil, fmt.Errorf(logPrefix+"CRL %v is not signed by any of client CAs", crlFile)
+		}
+
+		serials := revoked[string(issuer.RawSubject)]
+		if serials == nil {
+			serials = map[string]bool{}
+			revoked[string(issuer.RawSubject)] = serials
+		}
+
+		for _, entry := range crl.TBSCertList.RevokedCertificates {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+
+	return revoked, nil
+}
+
+// crlIssuer returns the client CA which signed the CRL
+func crlIssuer(crl *pkix.CertificateList, caPEM []byte) *x509.Certificate {
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		if ca.CheckCRLSignature(crl) == nil {
+			return ca
+		}
+	}
+
+	return nil
+}
+
+func checkRevocation(revoked revokedSerials, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, certificate := range chain {
+			if revoked.revoked(certificate) {
+				return fmt.Errorf(logPrefix+"Certificate %v has been revoked", certificate.Subject.CommonName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ClientCertAuthenticator takes device tag from verified client certificate of mutual TLS connection
+type ClientCertAuthenticator struct {
+	identity CertIdentity
+}
+
+// NewClientCertAuthenticator ...
+func NewClientCertAuthenticator(identity CertIdentity) *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{identity: identity}
+}
+
+// Authenticate ...
+func (a *ClientCertAuthenticator) Authenticate(req *http.Request, deviceTag string) (string, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return "", ErrMissingClientCertificate
+	}
+
+	certificateDeviceTag, err := a.deviceTagFromCertificate(req.TLS.PeerCertificates[0])
+	if err != nil {
+		return "", err
+	}
+
+	return matchDeviceTag(deviceTag, certificateDeviceTag)
+}
+
+func (a *ClientCertAuthenticator) deviceTagFromCertificate(certificate *x509.Certificate) (string, error) {
+	if a.identity == CertIdentityCN {
+		if certificate.Subject.CommonName == "" {
+			return "", fmt.Errorf(logPrefix + "Client certificate has empty common name")
+		}
+
+		return certificate.Subject.CommonName, nil
+	}
+
+	for _, uri := range certificate.URIs {
+		if deviceTag := deviceTagFromURI(uri); uri.Scheme == deviceURIScheme && deviceTag != "" {
+			return deviceTag, nil
+		}
+	}
+
+	return "", fmt.Errorf(logPrefix+"Client certificate does not have %v SAN URI", deviceURIScheme)
+}
+
+func deviceTagFromURI(uri *url.URL) string {
+	if uri.Opaque != "" {
+		return uri.Opaque
+	}
+
+	return uri.Host
+}
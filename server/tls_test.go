@@ -0,0 +1,193 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/server"
+)
+
+type TLSTestSuite struct {
+	suite.Suite
+
+	dir    string
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+}
+
+func TestExecuteTLSTestSuite(t *testing.T) {
+	suite.Run(t, new(TLSTestSuite))
+}
+
+func (suite *TLSTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "deviceproxy-tls")
+	suite.Require().Nil(err)
+	suite.dir = dir
+
+	suite.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.caCert = suite.createCertificate(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "devices CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, &suite.caKey.PublicKey)
+
+	suite.writePEM("ca.pem", "CERTIFICATE", suite.caCert.Raw)
+
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverCert := suite.createCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &serverKey.PublicKey)
+
+	serverKeyDER, _ := x509.MarshalECPrivateKey(serverKey)
+	suite.writePEM("server.pem", "CERTIFICATE", serverCert.Raw)
+	suite.writePEM("server-key.pem", "EC PRIVATE KEY", serverKeyDER)
+}
+
+func (suite *TLSTestSuite) TearDownTest() {
+	os.RemoveAll(suite.dir)
+}
+
+func (suite *TLSTestSuite) Test_DeviceTagIsTakenFromCommonName() {
+	clientCert := suite.createClientCertificate(10, "device1", nil)
+
+	deviceTag, err := server.NewClientCertAuthenticator(server.CertIdentityCN).Authenticate(requestWithCertificate(clientCert), "")
+	suite.Nil(err)
+	suite.Equal("device1", deviceTag)
+
+	_, err = server.NewClientCertAuthenticator(server.CertIdentityCN).Authenticate(requestWithCertificate(clientCert), "device2")
+	suite.Equal(server.ErrDeviceTagMismatch, err)
+}
+
+func (suite *TLSTestSuite) Test_DeviceTagIsTakenFromSANURI() {
+	uri, _ := url.Parse("device:device2")
+	clientCert := suite.createClientCertificate(11, "ignored", []*url.URL{uri})
+
+	deviceTag, err := server.NewClientCertAuthenticator(server.CertIdentitySANURI).Authenticate(requestWithCertificate(clientCert), "")
+	suite.Nil(err)
+	suite.Equal("device2", deviceTag)
+}
+
+func (suite *TLSTestSuite) Test_ConnectionWithoutCertificateIsRejected() {
+	_, err := server.NewClientCertAuthenticator(server.CertIdentityCN).Authenticate(requestWithCertificate(nil), "device1")
+	suite.Equal(server.ErrMissingClientCertificate, err)
+}
+
+func (suite *TLSTestSuite) Test_RevokedCertificateFailsVerification() {
+	revokedCert := suite.createClientCertificate(20, "revoked", nil)
+	validCert := suite.createClientCertificate(21, "valid", nil)
+
+	// certificate of another CA with the same serial as the revoked one
+	otherCAKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherCA := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+	}
+	otherCADER, err := x509.CreateCertificate(rand.Reader, otherCA, otherCA, &otherCAKey.PublicKey, otherCAKey)
+	suite.Require().Nil(err)
+	otherCA, _ = x509.ParseCertificate(otherCADER)
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: revokedCert.SerialNumber,
+		Subject:      pkix.Name{CommonName: "other"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, otherCA, &otherKey.PublicKey, otherCAKey)
+	suite.Require().Nil(err)
+	otherCert, _ := x509.ParseCertificate(otherDER)
+
+	crl, err := suite.caCert.CreateCRL(rand.Reader, suite.caKey, []pkix.RevokedCertificate{
+		{SerialNumber: revokedCert.SerialNumber, RevocationTime: time.Now()},
+	}, time.Now(), time.Now().Add(time.Hour))
+	suite.Require().Nil(err)
+	suite.writePEM("ca.crl", "X509 CRL", crl)
+
+	config, err := server.NewTLSConfig(suite.path("server.pem"), suite.path("server-key.pem"), suite.path("ca.pem"), suite.path("ca.crl"))
+	suite.Require().Nil(err)
+	suite.Equal(tls.RequireAndVerifyClientCert, config.ClientAuth)
+
+	suite.NotNil(config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{revokedCert, suite.caCert}}))
+	suite.Nil(config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{validCert, suite.caCert}}))
+	suite.Nil(config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{otherCert, otherCA}}))
+}
+
+func (suite *TLSTestSuite) Test_TLSConfigWithoutClientCADoesNotRequireClientCertificates() {
+	config, err := server.NewTLSConfig(suite.path("server.pem"), suite.path("server-key.pem"), "", "")
+	suite.Nil(err)
+	suite.Equal(tls.NoClientCert, config.ClientAuth)
+}
+
+func (suite *TLSTestSuite) createClientCertificate(serial int64, commonName string, uris []*url.URL) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	return suite.createCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		URIs:         uris,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &key.PublicKey)
+}
+
+func (suite *TLSTestSuite) createCertificate(template *x509.Certificate, publicKey *ecdsa.PublicKey) *x509.Certificate {
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent := suite.caCert
+	if template.IsCA {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, suite.caKey)
+	suite.Require().Nil(err)
+
+	certificate, err := x509.ParseCertificate(der)
+	suite.Require().Nil(err)
+
+	return certificate
+}
+
+func (suite *TLSTestSuite) writePEM(name, blockType string, data []byte) {
+	err := ioutil.WriteFile(suite.path(name), pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	suite.Require().Nil(err)
+}
+
+func (suite *TLSTestSuite) path(name string) string {
+	return filepath.Join(suite.dir, name)
+}
+
+func requestWithCertificate(certificate *x509.Certificate) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "https://localhost/deviceproxy", nil)
+	req.TLS = &tls.ConnectionState{}
+
+	if certificate != nil {
+		req.TLS.PeerCertificates = []*x509.Certificate{certificate}
+	}
+
+	return req
+}
@@ -0,0 +1,229 @@
+package topics
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const logPrefix = "DeviceProxyTopics "
+
+// Variables which can be used in templates
+const (
+	// VarDeviceTag is replaced with device tag, it is required in every template, see ValidDeviceTag
+	VarDeviceTag = "{tag}"
+	// VarTenant is replaced with tenant, see ValidTenant
+	VarTenant = "{tenant}"
+)
+
+// Default templates of topics used by the proxy
+const (
+	DefaultPublish = "cloud.msg." + VarDeviceTag
+	DefaultEvent   = "edge.msg." + VarDeviceTag
+	DefaultAck     = "cloud.ack." + VarDeviceTag
+	DefaultRPC     = "rpc.req." + VarDeviceTag
+)
+
+// ErrTopicMismatch is returned when topic has not been produced by the template
+var ErrTopicMismatch = errors.New(logPrefix + "Topic does not match template")
+
+var variablePattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// Params are values of template variables
+type Params struct {
+	Tenant    string
+	DeviceTag string
+}
+
+// Template builds topic names from pattern like "{tenant}.devices.{tag}.up" and parses them back
+type Template struct {
+	pattern   string
+	variables []string
+	matcher   *regexp.Regexp
+}
+
+// NewTemplate ...
+func NewTemplate(pattern string) (*Template, error) {
+	t := &Template{pattern: pattern}
+	expression := "^"
+	last := 0
+
+	for _, location := range variablePattern.FindAllStringIndex(pattern, -1) {
+		literal, variable := pattern[last:location[0]], pattern[location[0]:location[1]]
+
+		//NOTE: without text between variables the boundary between their values can not be found
+		if last > 0 && literal == "" {
+			return nil, fmt.Errorf(logPrefix+"Template %q has to separate variables with text", pattern)
+		}
+
+		if t.uses(variable) {
+			return nil, fmt.Errorf(logPrefix+"Template %q contains variable %v more than once", pattern, variable)
+		}
+
+		expression += regexp.QuoteMeta(literal)
+
+		switch variable {
+		case VarDeviceTag:
+			expression += "(.+)"
+		case VarTenant:
+			expression += "([^./]+)"
+		default:
+			return nil, fmt.Errorf(logPrefix+"Template %q contains unknown variable %v", pattern, variable)
+		}
+
+		t.variables = append(t.variables, variable)
+		last = location[1]
+	}
+
+	if !t.uses(VarDeviceTag) {
+		return nil, fmt.Errorf(logPrefix+"Template %q has to contain %v", pattern, VarDeviceTag)
+	}
+
+	t.matcher = regexp.MustCompile(expression + regexp.QuoteMeta(pattern[last:]) + "$")
+
+	return t, nil
+}
+
+// Format ...
+func (t *Template) Format(params Params) string {
+	return strings.NewReplacer(VarDeviceTag, params.DeviceTag, VarTenant, params.Tenant).Replace(t.pattern)
+}
+
+// Parse extracts variables from topic built by Format, ErrTopicMismatch is returned for any other topic
+func (t *Template) Parse(topic string) (Params, error) {
+	params := Params{}
+
+	match := t.matcher.FindStringSubmatch(topic)
+	if match == nil {
+		return params, ErrTopicMismatch
+	}
+
+	for i, variable := range t.variables {
+		switch variable {
+		case VarDeviceTag:
+			params.DeviceTag = match[i+1]
+		case VarTenant:
+			params.Tenant = match[i+1]
+		}
+	}
+
+	return params, nil
+}
+
+// uses says whether variable is part of the template
+func (t *Template) uses(variable string) bool {
+	for _, v := range t.variables {
+		if v == variable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UsesTenant ...
+func (t *Template) UsesTenant() bool {
+	return t.uses(VarTenant)
+}
+
+// String ...
+func (t *Template) String() string {
+	return t.pattern
+}
+
+// Set groups templates of all per device topics used by the proxy
+type Set struct {
+	// Publish is where messages from devices are published
+	Publish *Template
+	// Event is where messages for devices come from
+	Event *Template
+	// Ack is where delivery acks of devices are published
+	Ack *Template
+	// RPC is where RPC requests for devices come from
+	RPC *Template
+}
+
+// NewSet ...
+func NewSet(publish, event, ack, rpc string) (*Set, error) {
+	set := &Set{}
+	var err error
+
+	if set.Publish, err = NewTemplate(publish); err != nil {
+		return nil, err
+	}
+	if set.Event, err = NewTemplate(event); err != nil {
+		return nil, err
+	}
+	if set.Ack, err = NewTemplate(ack); err != nil {
+		return nil, err
+	}
+	if set.RPC, err = NewTemplate(rpc); err != nil {
+		return nil, err
+	}
+
+	//NOTE: subscribed topics are told apart by parsing, so one template can not produce topics of the other one
+	if set.Event.overlaps(set.RPC) {
+		return nil, fmt.Errorf(logPrefix+"Event template %v and RPC template %v produce the same topics", set.Event, set.RPC)
+	}
+
+	return set, nil
+}
+
+// DefaultSet ...
+func DefaultSet() *Set {
+	set, _ := NewSet(DefaultPublish, DefaultEvent, DefaultAck, DefaultRPC)
+	return set
+}
+
+// UsesTenant says whether any of templates contains tenant
+func (s *Set) UsesTenant() bool {
+	return s.Publish.UsesTenant() || s.Event.UsesTenant() || s.Ack.UsesTenant() || s.RPC.UsesTenant()
+}
+
+// SeparatesTenants says whether every template contains tenant, so topics of devices with the same tag
+// and different tenants never collide
+func (s *Set) SeparatesTenants() bool {
+	return s.Publish.UsesTenant() && s.Event.UsesTenant() && s.Ack.UsesTenant() && s.RPC.UsesTenant()
+}
+
+// Owns says whether topic is produced by any of templates, i.e. it is a topic of some device
+func (s *Set) Owns(topic string) bool {
+	for _, template := range []*Template{s.Publish, s.Event, s.Ack, s.RPC} {
+		if _, err := template.Parse(topic); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wildcardChars are wildcards in NATS and MQTT subscriptions, / also separates tenant in scoped device tags
+const wildcardChars = "*>+#/"
+
+// ValidTenant says whether tenant can be put in place of VarTenant, it can not contain '.' because parser
+// tells tenant from device tag by topic levels
+func ValidTenant(tenant string) bool {
+	return tenant != "" && !strings.ContainsAny(tenant, "."+wildcardChars) && !containsSpace(tenant)
+}
+
+// ValidDeviceTag says whether device tag can be put in place of VarDeviceTag without subscribing to topics
+// of other devices. Dots are allowed, parser keeps them in device tag.
+func ValidDeviceTag(deviceTag string) bool {
+	return deviceTag != "" && !strings.ContainsAny(deviceTag, wildcardChars) && !containsSpace(deviceTag)
+}
+
+func containsSpace(s string) bool {
+	return strings.IndexFunc(s, unicode.IsSpace) >= 0
+}
+
+// overlaps checks whether topic of a sample device parses with both templates
+func (t *Template) overlaps(other *Template) bool {
+	sample := Params{Tenant: "tenant", DeviceTag: "device"}
+
+	_, errThis := other.Parse(t.Format(sample))
+	_, errOther := t.Parse(other.Format(sample))
+
+	return errThis == nil || errOther == nil
+}
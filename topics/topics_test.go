@@ -0,0 +1,107 @@
+package topics_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"deviceproxy/topics"
+)
+
+type TopicsTestSuite struct {
+	suite.Suite
+}
+
+func TestExecuteTopicsTestSuite(t *testing.T) {
+	suite.Run(t, new(TopicsTestSuite))
+}
+
+func (suite *TopicsTestSuite) Test_DefaultTemplatesKeepPreviousTopicNames() {
+	set := topics.DefaultSet()
+	params := topics.Params{DeviceTag: "device"}
+
+	suite.Equal("cloud.msg.device", set.Publish.Format(params))
+	suite.Equal("edge.msg.device", set.Event.Format(params))
+	suite.Equal("cloud.ack.device", set.Ack.Format(params))
+	suite.Equal("rpc.req.device", set.RPC.Format(params))
+	suite.False(set.UsesTenant())
+}
+
+func (suite *TopicsTestSuite) Test_ParseReturnsParamsUsedByFormat() {
+	template, err := topics.NewTemplate("{tenant}.devices.{tag}.down")
+	suite.NoError(err)
+
+	for _, params := range []topics.Params{
+		{Tenant: "acme", DeviceTag: "device"},
+		{Tenant: "acme", DeviceTag: "with.dots.devices.inside"},
+		{Tenant: "acme-eu", DeviceTag: "ends.down"},
+	} {
+		parsed, err := template.Parse(template.Format(params))
+
+		suite.NoError(err)
+		suite.Equal(params, parsed)
+	}
+}
+
+func (suite *TopicsTestSuite) Test_ParseKeepsDeviceTagContainingTemplateText() {
+	template, err := topics.NewTemplate(topics.DefaultEvent)
+	suite.NoError(err)
+
+	params, err := template.Parse("edge.msg.edge.msg.device")
+
+	suite.NoError(err)
+	suite.Equal("edge.msg.device", params.DeviceTag)
+}
+
+func (suite *TopicsTestSuite) Test_ParseRejectsForeignTopics() {
+	template, err := topics.NewTemplate("{tenant}.devices.{tag}.down")
+	suite.NoError(err)
+
+	for _, topic := range []string{
+		"acme.devices.device.up",
+		"acme.devices..down",
+		"acme.eu.devices.device.down",
+		"edge.msg.device",
+	} {
+		_, err := template.Parse(topic)
+		suite.Equal(topics.ErrTopicMismatch, err, topic)
+	}
+}
+
+func (suite *TopicsTestSuite) Test_DeviceTagsWithWildcardsOrSeparatorsAreInvalid() {
+	suite.True(topics.ValidDeviceTag("sensor-1_a"))
+	suite.True(topics.ValidDeviceTag("device.example.com"))
+
+	for _, deviceTag := range []string{"", ">", "*", "+", "#", "a/b", "a.*", "a b", "a\tb"} {
+		suite.False(topics.ValidDeviceTag(deviceTag), deviceTag)
+	}
+}
+
+func (suite *TopicsTestSuite) Test_SetOwnsTopicsOfEveryTemplate() {
+	set := topics.DefaultSet()
+
+	suite.True(set.Owns("cloud.msg.device"))
+	suite.True(set.Owns("edge.msg.device"))
+	suite.True(set.Owns("cloud.ack.device"))
+	suite.True(set.Owns("rpc.req.device"))
+	suite.False(set.Owns("backend.replies"))
+}
+
+func (suite *TopicsTestSuite) Test_InvalidTemplatesAreRejected() {
+	for _, pattern := range []string{
+		"",
+		"devices.{tenant}",
+		"devices.{device}",
+		"devices.{tag}{tenant}",
+		"devices.{tag}.{tag}",
+	} {
+		_, err := topics.NewTemplate(pattern)
+		suite.Error(err, pattern)
+	}
+}
+
+func (suite *TopicsTestSuite) Test_SetRejectsOverlappingEventAndRPCTemplates() {
+	_, err := topics.NewSet(topics.DefaultPublish, "device.{tag}", topics.DefaultAck, "device.rpc.{tag}")
+
+	suite.Error(err)
+}